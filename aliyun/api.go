@@ -1,11 +1,11 @@
 package aliyun
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/tidwall/gjson"
-	"goaldfuse/aliyun/cache"
 	"goaldfuse/aliyun/model"
 	"goaldfuse/aliyun/net"
 	"goaldfuse/utils"
@@ -18,29 +18,61 @@ import (
 	"time"
 )
 
-func GetList(token string, driveId string, parentFileId string, marker ...string) (model.FileListModel, error) {
-	return GetListA(token, driveId, parentFileId, false, marker...)
+func (c *Client) GetList(ctx context.Context, token string, driveId string, parentFileId string, marker ...string) (model.FileListModel, error) {
+	return c.GetListA(ctx, token, driveId, parentFileId, false, marker...)
 }
 
-func GetListA(token string, driveId string, parentFileId string, folderOnly bool, marker ...string) (model.FileListModel, error) {
+func (c *Client) GetListA(ctx context.Context, token string, driveId string, parentFileId string, folderOnly bool, marker ...string) (model.FileListModel, error) {
 
 	if len(parentFileId) == 0 {
 		parentFileId = "root"
 	}
 
+	// only a listing from the first page is looked up and stored
+	complete := len(marker) == 0 && !folderOnly
+	if complete {
+		if cached, ok := c.Cache.List(parentFileId); ok {
+			return cached, nil
+		}
+	}
+
 	var list model.FileListModel
-	if result, ok := cache.GoCache.Get(parentFileId); ok {
-		list, ok = result.(model.FileListModel)
-		if ok {
-			return list, nil
+	if len(marker) > 0 {
+		list.NextMarker = marker[0]
+	}
+	for {
+		page, err := c.GetListPage(ctx, token, driveId, parentFileId, folderOnly, list.NextMarker)
+		if err != nil {
+			return model.FileListModel{}, err
 		}
+		list.Items = append(list.Items, page.Items...)
+		list.NextMarker = page.NextMarker
+		if list.NextMarker == "" {
+			break
+		}
+		//utils.Verbose(utils.VerboseLog,"Next Page Marker: " + list.NextMarker)
+	}
+	if complete {
+		c.Cache.SetList(parentFileId, list)
+	}
+	return list, nil
+}
+
+// GetListPage fetches the single page of up to 200 children starting at
+// marker, the first one for an empty marker. NextMarker is empty on the
+// last page.
+func (c *Client) GetListPage(ctx context.Context, token string, driveId string, parentFileId string, folderOnly bool, marker string) (model.FileListModel, error) {
+	if len(parentFileId) == 0 {
+		parentFileId = "root"
 	}
+	var list model.FileListModel
 
 	postData := make(map[string]interface{})
 	postData["drive_id"] = driveId
 	postData["parent_file_id"] = parentFileId
 	postData["limit"] = 200
-	postData["all"] = false
+	// hidden files too, symlinks may be hidden from the web UI
+	postData["all"] = true
 	postData["url_expire_sec"] = 1600
 	postData["image_thumbnail_process"] = "image/resize,w_400/format,jpeg"
 	postData["image_url_process"] = "image/resize,w_1920/format,jpeg"
@@ -50,7 +82,7 @@ func GetListA(token string, driveId string, parentFileId string, folderOnly bool
 	postData["order_direction"] = "DESC"
 	//add marker post data
 	if len(marker) > 0 {
-		postData["marker"] = marker[0]
+		postData["marker"] = marker
 	}
 	if folderOnly {
 		postData["type"] = "folder"
@@ -63,43 +95,28 @@ func GetListA(token string, driveId string, parentFileId string, folderOnly bool
 	}
 
 	for i := 0; i < 5; i++ {
-		body := net.Post(model.APILISTURL, token, data)
+		body := net.Post(ctx, c.url(c.Endpoints.List), token, data)
 		e := json.Unmarshal(body, &list)
-		if e != nil {
-			utils.Verbose(utils.VerboseLog, "❌  GetList Failed", e, string(body), "retry in 5 seconds")
-			time.Sleep(5 * time.Second)
-		} else {
-			break
+		if e == nil {
+			return list, nil
 		}
-	}
-
-	if list.NextMarker != "" {
-		//utils.Verbose(utils.VerboseLog,"Next Page Marker: " + list.NextMarker)
-		var newList, _ = GetListA(token, driveId, parentFileId, folderOnly, list.NextMarker)
-		list.Items = append(list.Items, newList.Items...)
-		list.NextMarker = newList.NextMarker
-	}
-	if len(list.Items) > 0 {
-		cache.GoCache.SetDefault(parentFileId, list)
-		for _, item := range list.Items {
-			cache.GoCache.Set("FI_"+item.FileId, item, -1)
+		utils.Verbose(utils.VerboseLog, "❌  GetList Failed", e, string(body), "retry in 5 seconds")
+		if err := net.SleepContext(ctx, 5*time.Second); err != nil {
+			return model.FileListModel{}, err
 		}
 	}
-	return list, nil
+	return model.FileListModel{}, errors.New("list " + parentFileId + " failed")
 }
 
-func GetFilePath(token string, driveId string, parentFileId string, fileId string, typeStr string) (string, error) {
+func (c *Client) GetFilePath(ctx context.Context, token string, driveId string, parentFileId string, fileId string, typeStr string) (string, error) {
 
 	if len(parentFileId) == 0 {
 		parentFileId = "root"
 	}
 	path := "/"
 	var list model.ListFilePath
-	if result, ok := cache.GoCache.Get(parentFileId + "path"); ok {
-		path, ok = result.(string)
-		if ok {
-			return path, nil
-		}
+	if cached, ok := c.Cache.FolderPath(parentFileId); ok {
+		return cached, nil
 	}
 
 	postData := make(map[string]interface{})
@@ -112,11 +129,12 @@ func GetFilePath(token string, driveId string, parentFileId string, fileId strin
 		return "/", err
 	}
 
-	body := net.Post(model.APIFILEPATH, token, data)
+	body := net.Post(ctx, c.url(c.Endpoints.FilePath), token, data)
 
 	e := json.Unmarshal(body, &list)
 	if e != nil {
 		utils.Verbose(utils.VerboseLog, "❌   GetFilePath Failed", e, string(body))
+		return path, nil
 	}
 	minNum := 0
 	if typeStr == "folder" {
@@ -128,14 +146,14 @@ func GetFilePath(token string, driveId string, parentFileId string, fileId strin
 		}
 	}
 
-	cache.GoCache.SetDefault(parentFileId+"path", path)
+	c.Cache.SetFolderPath(parentFileId, path)
 
 	return path, nil
 }
 
-func GetFile(url string, token string, rangeStr string) *http.Response {
+func (c *Client) GetFile(ctx context.Context, url string, token string, rangeStr string) *http.Response {
 
-	res, err := net.Get(url, token, rangeStr)
+	res, err := net.Get(ctx, url, token, rangeStr)
 	if err == nil {
 		return res
 	}
@@ -145,7 +163,7 @@ func GetFile(url string, token string, rangeStr string) *http.Response {
 	//return []byte{}
 }
 
-func RefreshToken(refreshToken string) model.RefreshTokenModel {
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) model.RefreshTokenModel {
 	path := refreshToken
 	if _, errs := os.Stat(path); errs == nil {
 		buf, _ := ioutil.ReadFile(path)
@@ -154,7 +172,7 @@ func RefreshToken(refreshToken string) model.RefreshTokenModel {
 			refreshToken = refreshToken[:32] // refreshToken is only 32 bit?? FIXME
 		}
 	}
-	rs := net.Post(model.APIREFRESHTOKENURL, "", []byte(`{"refresh_token":"`+refreshToken+`"}`))
+	rs := net.Post(ctx, c.url(c.Endpoints.RefreshToken), "", []byte(`{"refresh_token":"`+refreshToken+`"}`))
 	var refresh model.RefreshTokenModel
 
 	if len(rs) <= 0 {
@@ -182,7 +200,7 @@ func RefreshToken(refreshToken string) model.RefreshTokenModel {
 		return refresh
 	}
 
-	err = ioutil.WriteFile(path, []byte(refresh.RefreshToken), 0600)
+	err = c.SaveRefreshToken(path, refresh.RefreshToken)
 	if err != nil {
 		utils.Verbose(utils.VerboseLog, "更新token文件失败,失败信息", err)
 	}
@@ -190,62 +208,136 @@ func RefreshToken(refreshToken string) model.RefreshTokenModel {
 	return refresh
 }
 
-func RemoveTrash(token string, driveId string, fileId string, parentFileId string) bool {
-	net.Post(model.APIREMOVETRASH, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
-	//if len(rs) == 0 {
-	//	cache.GoCache.Delete(parentFileId)
-	//}
-	cache.GoCache.Delete(parentFileId)
+func (c *Client) RemoveTrash(ctx context.Context, token string, driveId string, fileId string, parentFileId string) bool {
+	net.Post(ctx, c.url(c.Endpoints.Trash), token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
+	c.Cache.InvalidateFile(fileId)
+	c.Cache.InvalidateDir(parentFileId)
 	return false
 }
 
-func ReName(token string, driveId string, newName string, fileId string) bool {
-	rs := net.Post(model.APIFILEUPDATE, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`","name":"`+newName+`","check_name_mode":"refuse"}`))
+func (c *Client) ReName(ctx context.Context, token string, driveId string, newName string, fileId string) bool {
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.Update), token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`","name":"`+newName+`","check_name_mode":"refuse"}`))
+	c.Cache.InvalidateFile(fileId)
+	if code != http.StatusOK {
+		utils.Verbose(utils.VerboseLog, "重命名失败", fileId, newName, code, string(rs))
+		return false
+	}
 	var m model.ListModel
-	e := json.Unmarshal(rs, &m)
-	if e != nil {
+	if e := json.Unmarshal(rs, &m); e != nil {
+		utils.Verbose(utils.VerboseLog, e)
+		return false
+	}
+	c.Cache.InvalidateDir(m.ParentFileId)
+	return true
+}
+
+// UpdateUserMeta 替换文件的 user_meta
+func (c *Client) UpdateUserMeta(ctx context.Context, token string, driveId string, fileId string, userMeta string) bool {
+	data, _ := json.Marshal(map[string]string{"drive_id": driveId, "file_id": fileId, "user_meta": userMeta})
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.Update), token, data)
+	c.Cache.InvalidateFile(fileId)
+	if code != http.StatusOK {
+		utils.Verbose(utils.VerboseLog, "更新 user_meta 失败", fileId, code, string(rs))
+		return false
+	}
+	var m model.ListModel
+	if e := json.Unmarshal(rs, &m); e != nil {
+		utils.Verbose(utils.VerboseLog, e)
+		return false
+	}
+	c.Cache.InvalidateDir(m.ParentFileId)
+	return true
+}
+
+// MarkSymlink 把刚上传的文件标记为符号链接，hidden 时在网页端隐藏
+func (c *Client) MarkSymlink(ctx context.Context, token string, driveId string, fileId string, userMeta string, hidden bool) bool {
+	postData := map[string]interface{}{"drive_id": driveId, "file_id": fileId, "user_meta": userMeta}
+	if hidden {
+		postData["hidden"] = true
+	}
+	data, _ := json.Marshal(postData)
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.Update), token, data)
+	c.Cache.InvalidateFile(fileId)
+	if code != http.StatusOK {
+		utils.Verbose(utils.VerboseLog, "标记符号链接失败", fileId, code, string(rs))
+		return false
+	}
+	var m model.ListModel
+	if e := json.Unmarshal(rs, &m); e != nil {
+		utils.Verbose(utils.VerboseLog, e)
+		return false
+	}
+	c.Cache.InvalidateDir(m.ParentFileId)
+	return true
+}
+
+// SetStarred 收藏或取消收藏文件
+func (c *Client) SetStarred(ctx context.Context, token string, driveId string, fileId string, starred bool) bool {
+	data, _ := json.Marshal(map[string]interface{}{"drive_id": driveId, "file_id": fileId, "starred": starred})
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.Update), token, data)
+	c.Cache.InvalidateFile(fileId)
+	if code != http.StatusOK {
+		utils.Verbose(utils.VerboseLog, "收藏失败", fileId, starred, code, string(rs))
+		return false
+	}
+	var m model.ListModel
+	if e := json.Unmarshal(rs, &m); e != nil {
 		utils.Verbose(utils.VerboseLog, e)
+		return false
 	}
-	cache.GoCache.Delete(m.ParentFileId)
-	//utils.Verbose(utils.VerboseLog,string(rs))
+	c.Cache.InvalidateDir(m.ParentFileId)
 	return true
 }
 
+// SearchStarred 列出整个网盘中收藏的文件和文件夹，从 marker 开始的一页
+func (c *Client) SearchStarred(ctx context.Context, token string, driveId string, marker string) (model.FileListModel, error) {
+	postData := map[string]interface{}{
+		"drive_id": driveId,
+		"query":    "starred = true",
+		"order_by": "name ASC",
+		"limit":    100,
+	}
+	if len(marker) > 0 {
+		postData["marker"] = marker
+	}
+	data, _ := json.Marshal(postData)
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.Search), token, data)
+	if code != http.StatusOK {
+		return model.FileListModel{}, fmt.Errorf("search starred: %v %s", code, rs)
+	}
+	var list model.FileListModel
+	err := json.Unmarshal(rs, &list)
+	return list, err
+}
+
 // Walk 通过路径查找对应项目及所有子项目，当新建文件或文件夹时，也返回Not Found
-func Walk(token string, driverId string, paths []string) (model.ListModel, model.FileListModel, error) {
-	return WalkFolder(token, driverId, paths, false)
+func (c *Client) Walk(ctx context.Context, token string, driverId string, paths []string) (model.ListModel, model.FileListModel, error) {
+	return c.WalkFolder(ctx, token, driverId, paths, false)
 }
 
 // WalkFolder 通过路径查找对应项目及所有子项目，当新建文件或文件夹时，也返回Not Found
-func WalkFolder(token string, driverId string, paths []string, folderOnly bool) (model.ListModel, model.FileListModel, error) {
-	var item = GetFileDetail(token, driverId, "root")
+func (c *Client) WalkFolder(ctx context.Context, token string, driverId string, paths []string, folderOnly bool) (model.ListModel, model.FileListModel, error) {
+	var item = c.GetFileDetail(ctx, token, driverId, "root")
 	var list model.FileListModel
 	var err error
 	err = errors.New("not found")
 	if len(paths) == 0 || paths[0] == "" {
-		list, _ = GetListA(token, driverId, "root", folderOnly)
+		list, _ = c.GetListA(ctx, token, driverId, "root", folderOnly)
 		return item, list, nil
 	}
 
 	for j, path := range paths {
-		item = GetFileDetail(token, driverId, item.FileId)
+		item = c.GetFileDetail(ctx, token, driverId, item.FileId)
 		if reflect.DeepEqual(item, model.ListModel{}) {
 			return model.ListModel{}, model.FileListModel{}, err
 		}
 
-		list, _ = GetListA(token, driverId, item.FileId, folderOnly)
+		list, _ = c.GetListA(ctx, token, driverId, item.FileId, folderOnly)
 		for i, v := range list.Items {
-			if _, ok := cache.GoCache.Get("FI_" + v.FileId); !ok {
-				cache.GoCache.Set("FI_"+v.FileId, v, -1)
-			}
 			if j == 0 {
-				if _, ok := cache.GoCache.Get("FID_" + v.Name); !ok {
-					cache.GoCache.Set("FID_"+v.Name, v.FileId, -1)
-				}
+				c.Cache.SetFileIdByPath(v.Name, v.FileId)
 			} else {
-				if _, ok := cache.GoCache.Get("FID_" + strings.Join(paths[:j], "/") + "/" + v.Name); !ok {
-					cache.GoCache.Set("FID_"+strings.Join(paths[:j], "/")+"/"+v.Name, v.FileId, -1)
-				}
+				c.Cache.SetFileIdByPath(strings.Join(paths[:j], "/")+"/"+v.Name, v.FileId)
 			}
 			//找到一个马上跳出去进入下一个路径
 			if v.Name == path {
@@ -258,96 +350,185 @@ func WalkFolder(token string, driverId string, paths []string, folderOnly bool)
 			}
 		}
 		if item.Name == path && j == len(paths)-1 {
-			list, _ = GetListA(token, driverId, item.FileId, folderOnly)
+			list, _ = c.GetListA(ctx, token, driverId, item.FileId, folderOnly)
 			return item, list, nil
 		}
 	}
 	return model.ListModel{}, model.FileListModel{}, err
 }
 
-func Search(token string, driveId string, name string, parentFileId string, Type string) model.FileListModel {
+func (c *Client) Search(ctx context.Context, token string, driveId string, name string, parentFileId string, Type string) model.FileListModel {
 	var list model.FileListModel
-	if c, ok := cache.GoCache.Get("SearchResult_" + parentFileId + name); ok {
-		return c.(model.FileListModel)
-	}
 	if Type == "" {
 		Type = "folder"
 	}
+	if cached, ok := c.Cache.Search(parentFileId, name, Type); ok {
+		return cached
+	}
 	//{"drive_id":"67476554","query":"parent_file_id = \"61bdf6d66eced7c2c5324bb9a1fa54ae0d5e0f7d\" and (name = \"Screen Shot 2021-08-20 at 22.17.53.png\")","order_by":"name ASC","limit":100}
-	body := net.Post(model.APISEARCH, token, []byte(`{"drive_id":"`+driveId+`","query":"parent_file_id = \"`+parentFileId+`\" and (name = \"`+name+`\") and (type=\"`+Type+`\")","order_by":"name ASC","limit":200}`))
+	body := net.Post(ctx, c.url(c.Endpoints.Search), token, []byte(`{"drive_id":"`+driveId+`","query":"parent_file_id = \"`+parentFileId+`\" and (name = \"`+name+`\") and (type=\"`+Type+`\")","order_by":"name ASC","limit":200}`))
 	e := json.Unmarshal(body, &list)
 	if e != nil {
 		utils.Verbose(utils.VerboseLog, e)
-	}
-	if len(list.Items) > 0 {
-		cache.GoCache.Set("SearchResult_"+parentFileId+name, list, -1)
+	} else {
+		c.Cache.SetSearch(parentFileId, name, Type, list)
 	}
 	return list
 }
-func MakeDir(token string, driveId string, name string, parentFileId string) model.CreateModel {
-	rs := net.Post(model.APIMKDIR, token, []byte(`{"drive_id":"`+driveId+`","parent_file_id":"`+parentFileId+`","name":"`+name+`","check_name_mode":"refuse","type":"folder"}`))
+func (c *Client) MakeDir(ctx context.Context, token string, driveId string, name string, parentFileId string) model.CreateModel {
+	rs := net.Post(ctx, c.url(c.Endpoints.Mkdir), token, []byte(`{"drive_id":"`+driveId+`","parent_file_id":"`+parentFileId+`","name":"`+name+`","check_name_mode":"refuse","type":"folder"}`))
 	var fi model.CreateModel
 	err := json.Unmarshal(rs, &fi)
 	if err == nil {
 		if fi.Name == name {
-			cache.GoCache.Delete(parentFileId)
+			c.Cache.InvalidateDir(parentFileId)
 		}
 		return fi
 	}
 	return fi
 }
 
-func GetFileDetail(token string, driveId string, fileId string) model.ListModel {
+func (c *Client) GetFileDetail(ctx context.Context, token string, driveId string, fileId string) model.ListModel {
 	if fileId != "root" {
-		if va, ok := cache.GoCache.Get("FI_" + fileId); ok {
-			if va != nil {
-				return va.(model.ListModel)
-			}
-
+		if cached, ok := c.Cache.File(fileId); ok {
+			return cached
 		}
 	}
 
-	rs := net.Post(model.APIFILEDETAIL, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
+	rs := net.Post(ctx, c.url(c.Endpoints.Get), token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
 	var m model.ListModel
 	e := json.Unmarshal(rs, &m)
 	if e != nil {
 		utils.Verbose(utils.VerboseLog, "❌   GetFileDetail Failed", e, string(rs))
-	} else {
-		cache.GoCache.Set("FI_"+fileId, e, -1)
+	} else if fileId != "root" {
+		c.Cache.SetFile(m)
 	}
 	return m
 }
 
-func BatchFile(token string, driveId string, fileId string, parentFileId string) bool {
+// BatchFile moves fileId into parentFileId, renaming it to newName unless
+// that is empty.
+func (c *Client) BatchFile(ctx context.Context, token string, driveId string, fileId string, parentFileId string, newName string) bool {
 
 	//	{
 	//		"requests": ,
 	//	"resource": "file"
 	//	}
 
-	var bodyJson string = `{"drive_id": "` + driveId + `","file_id": "` + fileId + `","to_drive_id": "` + driveId + `","to_parent_file_id": "` + parentFileId + `"}`
+	body := map[string]string{"drive_id": driveId, "file_id": fileId, "to_drive_id": driveId, "to_parent_file_id": parentFileId}
+	if newName != "" {
+		body["new_name"] = newName
+	}
+	data, _ := json.Marshal(body)
+	var bodyJson string = string(data)
 	var contentType string = `{"Content-Type": "application/json"}`
 
 	var requests string = `{"requests":[{"body": ` + bodyJson + `,"headers": ` + contentType + `,"id": "` + fileId + `","method": "POST","url": "/file/move"}],"resource": "file"}`
 
-	rs := net.Post(model.APIFILEBATCH, token, []byte(requests))
-	if gjson.GetBytes(rs, "responses.0.friends").Num == 200 {
-		cache.GoCache.Delete(parentFileId)
-		cache.GoCache.Delete(fileId)
+	rs := net.Post(ctx, c.url(c.Endpoints.Batch), token, []byte(requests))
+	if gjson.GetBytes(rs, "responses.0.status").Num == 200 {
+		c.Cache.InvalidateFile(fileId)
+		c.Cache.InvalidateDir(parentFileId)
 		return true
 	}
 
 	return false
 }
-func UpdateFileFolder(token string, driveId string, fileName string, parentFileId string) bool {
+
+// BatchDelete moves up to 100 entries to the recycle bin in one request,
+// or deletes them for good with permanent. The result tells which of them
+// are gone, one that no longer exists counts as gone.
+func (c *Client) BatchDelete(ctx context.Context, token string, driveId string, fileIds []string, permanent bool) []bool {
+	url := "/recyclebin/trash"
+	if permanent {
+		url = "/file/delete"
+	}
+	done := c.batch(ctx, token, driveId, url, fileIds, http.StatusNotFound)
+	for _, fileId := range fileIds {
+		c.Cache.InvalidateFile(fileId)
+	}
+	return done
+}
+
+// BatchRestore puts up to 100 entries back from the recycle bin into the
+// folders they were deleted from.
+func (c *Client) BatchRestore(ctx context.Context, token string, driveId string, fileIds []string) []bool {
+	return c.batch(ctx, token, driveId, "/recyclebin/restore", fileIds, 0)
+}
+
+// batch sends url for every file in one /v3/batch request and reports
+// which succeeded, a status of alsoOk counting as success too.
+func (c *Client) batch(ctx context.Context, token string, driveId string, url string, fileIds []string, alsoOk int64) []bool {
+	requests := make([]map[string]interface{}, len(fileIds))
+	index := make(map[string]int, len(fileIds))
+	for i, fileId := range fileIds {
+		requests[i] = map[string]interface{}{
+			"body":    map[string]string{"drive_id": driveId, "file_id": fileId},
+			"headers": map[string]string{"Content-Type": "application/json"},
+			"id":      fileId,
+			"method":  "POST",
+			"url":     url,
+		}
+		index[fileId] = i
+	}
+	data, _ := json.Marshal(map[string]interface{}{"requests": requests, "resource": "file"})
+	rs := net.Post(ctx, c.url(c.Endpoints.Batch), token, data)
+
+	done := make([]bool, len(fileIds))
+	for _, r := range gjson.GetBytes(rs, "responses").Array() {
+		i, ok := index[r.Get("id").String()]
+		if !ok {
+			continue
+		}
+		status := r.Get("status").Int()
+		done[i] = (status >= 200 && status < 300) || status == alsoOk
+		if !done[i] {
+			utils.Verbose(utils.VerboseLog, url, "失败", fileIds[i], status, r.Get("body").String())
+		}
+	}
+	return done
+}
+
+// RecycleBinList lists one page of the recycle bin.
+func (c *Client) RecycleBinList(ctx context.Context, token string, driveId string, marker string) (model.FileListModel, error) {
+	postData := map[string]interface{}{
+		"drive_id":        driveId,
+		"limit":           200,
+		"order_by":        "name",
+		"order_direction": "DESC",
+	}
+	if len(marker) > 0 {
+		postData["marker"] = marker
+	}
+	data, _ := json.Marshal(postData)
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.RecycleBinList), token, data)
+	if code != http.StatusOK {
+		return model.FileListModel{}, fmt.Errorf("list recycle bin: %v %s", code, rs)
+	}
+	var list model.FileListModel
+	err := json.Unmarshal(rs, &list)
+	return list, err
+}
+
+// ClearRecycleBin deletes everything in the recycle bin for good.
+func (c *Client) ClearRecycleBin(ctx context.Context, token string, driveId string) bool {
+	rs, code := net.PostExpectStatus(ctx, c.url(c.Endpoints.RecycleBinClear), token, []byte(`{"drive_id":"`+driveId+`"}`))
+	if code < 200 || code >= 300 {
+		utils.Verbose(utils.VerboseLog, "清空回收站失败", code, string(rs))
+		return false
+	}
+	return true
+}
+
+func (c *Client) UpdateFileFolder(ctx context.Context, token string, driveId string, fileName string, parentFileId string) bool {
 
 	//	{
 	//		"requests": ,
 	//	"resource": "file"
 	//	}
 	createData := `{"drive_id": "` + driveId + `","parent_file_id": "` + parentFileId + `","name": "` + fileName + `","check_name_mode": "refuse","type": "folder"}`
-	net.Post(model.APIFILEUPLOAD, token, []byte(createData))
-	// rs := net.Post(model.APIFILEUPLOAD, token, []byte(createData))
+	net.Post(ctx, c.url(c.Endpoints.Create), token, []byte(createData))
+	// rs := net.Post(ctx, c.url(c.Endpoints.Create), token, []byte(createData))
 	// utils.Verbose(utils.VerboseLog,string(rs))
 	//正确返回占星显示
 	//	{"parent_file_id":"60794ad941ee2d8d24f843b7a0ffd80279927dfc","type":"folder","file_id":"613caeb4d5b1ba9fb4604d4aa5aef2b408ab3121","domain_id":"bj29","drive_id":"1662258","file_name":"1SDSDSD.png","encrypt_mode":"none"}
@@ -376,7 +557,7 @@ func UpdateFileFolder(token string, driveId string, fileName string, parentFileI
 	return false
 }
 
-func UpdateFileFile(token string, driveId string, fileName string, parentFileId string, size string, length int, contentHash string, proof string, flashUpload bool) ([]gjson.Result, string, string, bool) {
+func (c *Client) UpdateFileFile(ctx context.Context, token string, driveId string, fileName string, parentFileId string, size string, length int, contentHash string, proof string, flashUpload bool) ([]gjson.Result, string, string, bool) {
 
 	if len(parentFileId) == 0 {
 		parentFileId = "root"
@@ -396,7 +577,7 @@ func UpdateFileFile(token string, driveId string, fileName string, parentFileId
 	} else {
 		createData = `{"drive_id":"` + driveId + `","part_info_list":` + partStr + `,"parent_file_id":"` + parentFileId + `","name":"` + fileName + `","type":"file","check_name_mode":"overwrite","size":` + size + `,"content_hash_name":"","proof_version":"v1"}`
 	}
-	rs := net.Post(model.APIFILEUPLOAD, token, []byte(createData))
+	rs := net.Post(ctx, c.url(c.Endpoints.Create), token, []byte(createData))
 	rapidUpload := gjson.GetBytes(rs, "rapid_upload").Bool()
 	if rapidUpload == true {
 		return nil, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, true
@@ -408,30 +589,32 @@ func UpdateFileFile(token string, driveId string, fileName string, parentFileId
 	return urlArr, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, false
 
 }
-func UploadFile(url string, token string, data []byte) bool {
+func (c *Client) UploadFile(ctx context.Context, url string, token string, data []byte) bool {
 	//最多试15次
 	for i := 0; i < 15; i++ {
-		rs, status := net.Put(url, token, data)
+		rs, status := net.Put(ctx, url, token, data)
 		if len(rs) == 0 && status == 0 {
 			return true
 		} else {
 			utils.Verbose(utils.VerboseLog, "❌  Upload Error: ", string(rs), " Retrying in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if net.SleepContext(ctx, 5*time.Second) != nil {
+				return false
+			}
 		}
 	}
 	return false
 }
-func UploadFileComplete(token string, driveId string, uploadId string, fileId string, parentId string) bool {
+func (c *Client) UploadFileComplete(ctx context.Context, token string, driveId string, uploadId string, fileId string, parentId string) bool {
 
 	createData := `{"drive_id": "` + driveId + `","file_id": "` + fileId + `","upload_id": "` + uploadId + `"}`
 
-	rs := net.Post(model.APIFILECOMPLETE, token, []byte(createData))
+	rs := net.Post(ctx, c.url(c.Endpoints.Complete), token, []byte(createData))
 	utils.Verbose(utils.VerboseLog, "⬆️  Upload Result:", gjson.GetBytes(rs, "file_id").Str, gjson.GetBytes(rs, "name").Str, gjson.GetBytes(rs, "size").Str)
-	cache.GoCache.Delete(parentId)
+	c.Cache.InvalidateDir(parentId)
 
 	return false
 }
-func GetDownloadUrl(token string, driveId string, fileId string) string {
+func (c *Client) GetDownloadUrl(ctx context.Context, token string, driveId string, fileId string) string {
 
 	postData := make(map[string]interface{})
 	postData["drive_id"] = driveId
@@ -439,21 +622,21 @@ func GetDownloadUrl(token string, driveId string, fileId string) string {
 
 	data, _ := json.Marshal(postData)
 
-	body := net.Post(model.APIFILEDOWNLOAD, token, data)
+	body := net.Post(ctx, c.url(c.Endpoints.DownloadURL), token, data)
 	return gjson.GetBytes(body, "url").Str
 
 }
-func GetBoxSize(token string) (string, string) {
+func (c *Client) GetBoxSize(ctx context.Context, token string) (string, string) {
 
 	postData := make(map[string]interface{})
 
 	data, _ := json.Marshal(postData)
 
-	body := net.Post(model.APITOTLESIZE, token, data)
+	body := net.Post(ctx, c.url(c.Endpoints.PersonalInfo), token, data)
 	return gjson.GetBytes(body, "personal_space_info.total_size").String(), gjson.GetBytes(body, "personal_space_info.used_size").String()
 
 }
-func GetUploadUrls(token string, driveId string, fileId string, uploadId string, length int) []gjson.Result {
+func (c *Client) GetUploadUrls(ctx context.Context, token string, driveId string, fileId string, uploadId string, length int) []gjson.Result {
 	var partStr string = "["
 	for i := 0; i < length; i++ {
 		partStr += `{"part_number":` + strconv.Itoa(i+1) + `},`
@@ -461,7 +644,7 @@ func GetUploadUrls(token string, driveId string, fileId string, uploadId string,
 	partStr = partStr[:len(partStr)-1]
 	partStr += "]"
 	uploadRequest := `{"drive_id":"` + driveId + `","part_info_list":` + partStr + `,"file_id":"` + fileId + `","upload_id":"` + uploadId + `"}`
-	rs := net.Post(model.APIFILEUPLOADURL, token, []byte(uploadRequest))
+	rs := net.Post(ctx, c.url(c.Endpoints.UploadURL), token, []byte(uploadRequest))
 	//utils.Verbose(utils.VerboseLog,"ℹ️  GetUploadUrls", string(rs))
 	return gjson.GetBytes(rs, "part_info_list.#.upload_url").Array()
 }
@@ -1,11 +1,339 @@
+// Package cache keeps the API metadata of one client: folder listings, file
+// details, path lookups and search results, each in its own namespace with
+// its own expiry and a bound on the number of entries.
 package cache
 
 import (
-	"github.com/patrickmn/go-cache"
+	"container/list"
+	"strings"
+	"sync"
 	"time"
+
+	"goaldfuse/aliyun/model"
 )
 
-var GoCache *cache.Cache //定义全局变量
-func Init() {
-	GoCache = cache.New(5*time.Minute, 60*time.Second)
+type Options struct {
+	ListTTL   time.Duration
+	FileTTL   time.Duration
+	PathTTL   time.Duration
+	SearchTTL time.Duration
+	// MaxEntries bounds every namespace, the least recently used entries
+	// go first. Zero means no limit.
+	MaxEntries int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ListTTL:    5 * time.Minute,
+		FileTTL:    5 * time.Minute,
+		PathTTL:    5 * time.Minute,
+		SearchTTL:  time.Minute,
+		MaxEntries: 10000,
+	}
+}
+
+// Stats are the counters of one namespace.
+type Stats struct {
+	Name      string
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// store is one namespace, an LRU list with per entry expiry.
+type store struct {
+	name string
+	ttl  time.Duration
+	max  int
+
+	mu        sync.Mutex
+	ll        *list.List
+	items     map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newStore(name string, ttl time.Duration, max int) *store {
+	return &store{name: name, ttl: ttl, max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *store) get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if ok && time.Now().After(el.Value.(*entry).expires) {
+		s.removeLocked(el)
+		ok = false
+	}
+	if !ok {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	s.ll.MoveToFront(el)
+	return el.Value.(*entry).value, true
+}
+
+// peek is get without touching the counters or the order.
+func (s *store) peek(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok || time.Now().After(el.Value.(*entry).expires) {
+		return nil, false
+	}
+	return el.Value.(*entry).value, true
+}
+
+func (s *store) set(key string, value interface{}) {
+	if s.ttl <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(s.ttl)
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		s.ll.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.ll.PushFront(&entry{key: key, value: value, expires: expires})
+	for s.max > 0 && s.ll.Len() > s.max {
+		s.removeLocked(s.ll.Back())
+		s.evictions++
+	}
+}
+
+func (s *store) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeLocked(el)
+	}
+}
+
+// deleteIf drops every entry f matches.
+func (s *store) deleteIf(f func(key string, value interface{}) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, el := range s.items {
+		if f(key, el.Value.(*entry).value) {
+			s.removeLocked(el)
+		}
+	}
+}
+
+func (s *store) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ll.Init()
+	s.items = make(map[string]*list.Element)
+}
+
+func (s *store) removeLocked(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.items, el.Value.(*entry).key)
+}
+
+func (s *store) stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{Name: s.name, Entries: s.ll.Len(), Hits: s.hits, Misses: s.misses, Evictions: s.evictions}
+}
+
+// Cache is safe for concurrent use. A nil *Cache caches nothing.
+type Cache struct {
+	lists    *store
+	files    *store
+	paths    *store
+	searches *store
+}
+
+func New(opts Options) *Cache {
+	return &Cache{
+		lists:    newStore("lists", opts.ListTTL, opts.MaxEntries),
+		files:    newStore("files", opts.FileTTL, opts.MaxEntries),
+		paths:    newStore("paths", opts.PathTTL, opts.MaxEntries),
+		searches: newStore("searches", opts.SearchTTL, opts.MaxEntries),
+	}
+}
+
+// List returns the cached complete listing of a folder.
+func (c *Cache) List(parentFileId string) (model.FileListModel, bool) {
+	if c == nil {
+		return model.FileListModel{}, false
+	}
+	v, ok := c.lists.get(parentFileId)
+	if !ok {
+		return model.FileListModel{}, false
+	}
+	return v.(model.FileListModel), true
+}
+
+// SetList caches a complete listing, and the details of every item in it.
+func (c *Cache) SetList(parentFileId string, l model.FileListModel) {
+	if c == nil {
+		return
+	}
+	c.lists.set(parentFileId, l)
+	for _, item := range l.Items {
+		c.files.set(item.FileId, item)
+	}
+}
+
+// AddToList appends item to the cached listing of its parent, if there is
+// one, so a new file does not cost another listing. It replaces the entry
+// with the same FileId, or with the same name and type, a folder and a
+// file may share a name.
+func (c *Cache) AddToList(parentFileId string, item model.ListModel) {
+	if c == nil || item.FileId == "" {
+		return
+	}
+	if v, ok := c.lists.peek(parentFileId); ok {
+		l := v.(model.FileListModel)
+		items := make([]model.ListModel, 0, len(l.Items)+1)
+		for _, it := range l.Items {
+			if it.FileId != item.FileId && (it.Name != item.Name || it.Type != item.Type) {
+				items = append(items, it)
+			}
+		}
+		l.Items = append(items, item)
+		c.lists.set(parentFileId, l)
+	}
+	c.files.set(item.FileId, item)
+}
+
+func (c *Cache) File(fileId string) (model.ListModel, bool) {
+	if c == nil {
+		return model.ListModel{}, false
+	}
+	v, ok := c.files.get(fileId)
+	if !ok {
+		return model.ListModel{}, false
+	}
+	return v.(model.ListModel), true
+}
+
+func (c *Cache) SetFile(item model.ListModel) {
+	if c == nil || item.FileId == "" {
+		return
+	}
+	c.files.set(item.FileId, item)
+}
+
+// FileIdByPath returns the FileId found at a slash separated path.
+func (c *Cache) FileIdByPath(path string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	v, ok := c.paths.get("id:" + path)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+func (c *Cache) SetFileIdByPath(path string, fileId string) {
+	if c == nil {
+		return
+	}
+	c.paths.set("id:"+path, fileId)
+}
+
+// FolderPath returns the cached path of the folder fileId.
+func (c *Cache) FolderPath(fileId string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	v, ok := c.paths.get("path:" + fileId)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+func (c *Cache) SetFolderPath(fileId string, path string) {
+	if c == nil {
+		return
+	}
+	c.paths.set("path:"+fileId, path)
+}
+
+func searchKey(parentFileId string, name string, typ string) string {
+	return parentFileId + "\x00" + typ + "\x00" + name
+}
+
+func (c *Cache) Search(parentFileId string, name string, typ string) (model.FileListModel, bool) {
+	if c == nil {
+		return model.FileListModel{}, false
+	}
+	v, ok := c.searches.get(searchKey(parentFileId, name, typ))
+	if !ok {
+		return model.FileListModel{}, false
+	}
+	return v.(model.FileListModel), true
+}
+
+func (c *Cache) SetSearch(parentFileId string, name string, typ string, l model.FileListModel) {
+	if c == nil {
+		return
+	}
+	c.searches.set(searchKey(parentFileId, name, typ), l)
+}
+
+// InvalidateDir drops everything derived from the contents of a folder,
+// called after a child was added, removed or renamed.
+func (c *Cache) InvalidateDir(parentFileId string) {
+	if c == nil {
+		return
+	}
+	c.lists.delete(parentFileId)
+	prefix := parentFileId + "\x00"
+	c.searches.deleteIf(func(key string, _ interface{}) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	// the paths below the folder may have changed too
+	c.paths.clear()
+}
+
+// InvalidateFile drops the details of fileId and the listing it was
+// last seen in, called after it was moved, renamed or deleted.
+func (c *Cache) InvalidateFile(fileId string) {
+	if c == nil {
+		return
+	}
+	if item, ok := c.files.peek(fileId); ok {
+		c.InvalidateDir(item.(model.ListModel).ParentFileId)
+	}
+	c.files.delete(fileId)
+	c.lists.delete(fileId)
+	c.paths.clear()
+}
+
+// Clear empties every namespace.
+func (c *Cache) Clear() {
+	if c == nil {
+		return
+	}
+	c.lists.clear()
+	c.files.clear()
+	c.paths.clear()
+	c.searches.clear()
+}
+
+func (c *Cache) Stats() []Stats {
+	if c == nil {
+		return nil
+	}
+	return []Stats{c.lists.stats(), c.files.stats(), c.paths.stats(), c.searches.stats()}
 }
@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	"goaldfuse/aliyun/model"
+)
+
+func TestAddToList(t *testing.T) {
+	c := New(DefaultOptions())
+	c.SetList("p", model.FileListModel{Items: []model.ListModel{
+		{FileId: "d", Name: "x", Type: "folder"},
+		{FileId: "f", Name: "x", Type: "file"},
+		{FileId: "g", Name: "g", Type: "file"},
+	}})
+	// a new upload of x replaces the file, not the folder of that name
+	c.AddToList("p", model.ListModel{FileId: "f2", Name: "x", Type: "file"})
+	// renamed in place
+	c.AddToList("p", model.ListModel{FileId: "g", Name: "h", Type: "file"})
+
+	l, ok := c.List("p")
+	if !ok {
+		t.Fatal("listing dropped")
+	}
+	var got []string
+	for _, it := range l.Items {
+		got = append(got, it.FileId+":"+it.Name)
+	}
+	if want := "[d:x f2:x g:h]"; fmt.Sprint(got) != want {
+		t.Errorf("listing %v, want %v", got, want)
+	}
+}
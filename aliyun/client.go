@@ -0,0 +1,36 @@
+package aliyun
+
+import (
+	"io/ioutil"
+
+	"goaldfuse/aliyun/cache"
+	"goaldfuse/aliyun/model"
+)
+
+// Client talks to one Aliyun Drive API deployment. Tests and integration
+// environments point it at a fake server by changing Endpoints.
+type Client struct {
+	Endpoints model.Endpoints
+	// Cache holds the metadata fetched by this client only, nil
+	// disables caching.
+	Cache *cache.Cache
+	// Replaying is set when the API answers from a cassette: its tokens
+	// are placeholders, they are neither saved nor refreshed.
+	Replaying bool
+}
+
+func NewClient(endpoints model.Endpoints) *Client {
+	return &Client{Endpoints: endpoints, Cache: cache.New(cache.DefaultOptions())}
+}
+
+// SaveRefreshToken writes token to the file path, nothing when replaying.
+func (c *Client) SaveRefreshToken(path string, token string) error {
+	if c.Replaying {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(token), 0600)
+}
+
+func (c *Client) url(path string) string {
+	return c.Endpoints.URL(path)
+}
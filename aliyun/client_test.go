@@ -0,0 +1,226 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"testing"
+
+	"goaldfuse/aliyun/fakedrive"
+	"goaldfuse/aliyun/model"
+)
+
+// newTestClient logs in to a fresh fake drive. The client doesn't cache,
+// every call reaches the server.
+func newTestClient(t *testing.T) (*fakedrive.Server, *Client, string) {
+	srv := fakedrive.NewServer()
+	t.Cleanup(srv.Close)
+	c := NewClient(srv.Endpoints())
+	c.Cache = nil
+	rr := c.RefreshToken(context.Background(), srv.RefreshToken())
+	if rr.AccessToken == "" || rr.DefaultDriveId != fakedrive.DriveId {
+		t.Fatalf("refresh token: %+v", rr)
+	}
+	return srv, c, rr.AccessToken
+}
+
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// upload stores data as name in parentId through ContentHandle.
+func upload(t *testing.T, c *Client, token string, parentId string, name string, data []byte) string {
+	f, err := ioutil.TempFile(t.TempDir(), "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	fileId := c.ContentHandle(context.Background(), f, token, fakedrive.DriveId, parentId, name, uint64(len(data)))
+	if fileId == "" {
+		t.Fatalf("uploading %v failed", name)
+	}
+	return fileId
+}
+
+func names(items []model.ListModel) []string {
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUpload(t *testing.T) {
+	srv, c, token := newTestClient(t)
+	complete := model.DefaultEndpoints().Complete
+	for _, tc := range []struct {
+		name string
+		size int
+		// parts is how many parts a normal upload sends
+		parts int
+	}{
+		{"empty", 0, 0},
+		{"small", 100, 1},
+		{"prehashed", 20000, 1},
+		{"multipart", 2*10485760 + 5, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := srv.Requests(complete)
+			data := randomData(tc.size, int64(tc.size))
+			fileId := upload(t, c, token, fakedrive.RootId, tc.name, data)
+			if got := srv.Content(fileId); !bytes.Equal(got, data) {
+				t.Fatalf("content has %v bytes, want %v", len(got), len(data))
+			}
+			if n := srv.Requests(complete) - before; (tc.parts != 0) != (n == 1) {
+				t.Errorf("%v complete requests", n)
+			}
+			if tc.parts > 1 {
+				f, _ := srv.Get(fileId)
+				if f.Size != int64(tc.size) {
+					t.Errorf("size %v, want %v", f.Size, tc.size)
+				}
+			}
+		})
+	}
+}
+
+func TestRapidUpload(t *testing.T) {
+	srv, c, token := newTestClient(t)
+	e := model.DefaultEndpoints()
+	data := randomData(50000, 1)
+	first := upload(t, c, token, fakedrive.RootId, "a", data)
+
+	// the pre_hash of the first 1K matches, answered with 409, then the
+	// proof_code and the content hash make the server copy the file
+	creates, completes := srv.Requests(e.Create), srv.Requests(e.Complete)
+	second := upload(t, c, token, fakedrive.RootId, "b", data)
+	if second == first {
+		t.Fatal("rapid upload returned the original file")
+	}
+	if !bytes.Equal(srv.Content(second), data) {
+		t.Fatal("rapid upload has different content")
+	}
+	if n := srv.Requests(e.Create) - creates; n != 2 {
+		t.Errorf("%v create requests, want pre_hash and proof", n)
+	}
+	if srv.Requests(e.Complete) != completes {
+		t.Error("rapid upload sent the content")
+	}
+}
+
+func TestPreHashCollision(t *testing.T) {
+	srv, c, token := newTestClient(t)
+	e := model.DefaultEndpoints()
+	data := randomData(50000, 2)
+	upload(t, c, token, fakedrive.RootId, "a", data)
+
+	// same size and first 1K, the pre_hash matches but the content hash
+	// doesn't, so the content has to be sent after all
+	other := append([]byte(nil), data...)
+	other[len(other)-1]++
+	completes := srv.Requests(e.Complete)
+	fileId := upload(t, c, token, fakedrive.RootId, "b", other)
+	if !bytes.Equal(srv.Content(fileId), other) {
+		t.Fatal("wrong content after a pre_hash match")
+	}
+	if srv.Requests(e.Complete) != completes+1 {
+		t.Error("content not uploaded")
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	srv, c, token := newTestClient(t)
+	data := randomData(1000, 3)
+	fileId := srv.AddFile(fakedrive.RootId, "f", data)
+	ctx := context.Background()
+
+	url := c.GetDownloadUrl(ctx, token, fakedrive.DriveId, fileId)
+	if url == "" {
+		t.Fatal("no download url")
+	}
+	for _, tc := range []struct {
+		rangeStr string
+		status   int
+		want     []byte
+	}{
+		{"", http.StatusOK, data},
+		{"bytes=2-9", http.StatusPartialContent, data[2:10]},
+		{"bytes=990-", http.StatusPartialContent, data[990:]},
+	} {
+		resp := c.GetFile(ctx, url, token, tc.rangeStr)
+		if resp == nil {
+			t.Fatalf("%q: no response", tc.rangeStr)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status || !bytes.Equal(got, tc.want) {
+			t.Errorf("%q: status %v with %v bytes, want %v with %v", tc.rangeStr, resp.StatusCode, len(got), tc.status, len(tc.want))
+		}
+	}
+}
+
+func TestBatchAndTrash(t *testing.T) {
+	srv, c, token := newTestClient(t)
+	ctx := context.Background()
+	drive := fakedrive.DriveId
+	dir := srv.AddFolder(fakedrive.RootId, "dir")
+	a := srv.AddFile(fakedrive.RootId, "a", []byte("a"))
+	b := srv.AddFile(fakedrive.RootId, "b", []byte("b"))
+	d := srv.AddFile(fakedrive.RootId, "d", []byte("d"))
+
+	if !c.BatchFile(ctx, token, drive, d, dir, "") {
+		t.Fatal("move failed")
+	}
+	if l, err := c.GetList(ctx, token, drive, dir); err != nil || len(l.Items) != 1 || l.Items[0].FileId != d {
+		t.Fatalf("dir after move: %v %v", names(l.Items), err)
+	}
+
+	// a missing entry counts as deleted
+	done := c.BatchDelete(ctx, token, drive, []string{a, b, "missing"}, false)
+	if len(done) != 3 || !done[0] || !done[1] || !done[2] {
+		t.Fatalf("trash: %v", done)
+	}
+	trash, err := c.RecycleBinList(ctx, token, drive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(trash.Items); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("recycle bin: %v", got)
+	}
+
+	if done = c.BatchRestore(ctx, token, drive, []string{a}); !done[0] {
+		t.Fatal("restore failed")
+	}
+	l, err := c.GetList(ctx, token, drive, fakedrive.RootId)
+	if got := names(l.Items); err != nil || len(got) != 2 || got[0] != "a" || got[1] != "dir" {
+		t.Fatalf("root after restore: %v %v", got, err)
+	}
+
+	if done = c.BatchDelete(ctx, token, drive, []string{d}, true); !done[0] {
+		t.Fatal("permanent delete failed")
+	}
+	if _, ok := srv.Get(d); ok {
+		t.Error("permanently deleted file still there")
+	}
+
+	if !c.ClearRecycleBin(ctx, token, drive) {
+		t.Fatal("clearing the recycle bin failed")
+	}
+	if trash, err = c.RecycleBinList(ctx, token, drive, ""); err != nil || len(trash.Items) != 0 {
+		t.Fatalf("recycle bin after clearing: %v %v", names(trash.Items), err)
+	}
+	if _, ok := srv.Get(b); ok {
+		t.Error("cleared file still there")
+	}
+}
@@ -0,0 +1,1127 @@
+// Package fakedrive is an in-memory stand-in for the Aliyun Drive API. It
+// serves the endpoints used by goaldfuse from an httptest.Server so the
+// aliyun client, the fs layer and the upload path can be exercised end to
+// end without network access.
+//
+//	srv := fakedrive.NewServer()
+//	defer srv.Close()
+//	client := aliyun.NewClient(srv.Endpoints())
+//
+// Download and upload URLs handed out by the fake point back at the same
+// server, downloads honour Range headers.
+package fakedrive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goaldfuse/aliyun/model"
+)
+
+const (
+	DriveId       = "fake-drive"
+	DomainId      = "fake"
+	RootId        = "root"
+	DefaultQuota  = 1 << 40
+	urlExpiration = 15 * time.Minute
+	emptySha1     = "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"
+)
+
+// File is one entry of the fake drive, serialized the way the real API
+// returns it.
+type File struct {
+	DriveId         string    `json:"drive_id"`
+	DomainId        string    `json:"domain_id"`
+	FileId          string    `json:"file_id"`
+	ParentFileId    string    `json:"parent_file_id"`
+	Name            string    `json:"name"`
+	Type            string    `json:"type"`
+	Status          string    `json:"status"`
+	Size            int64     `json:"size"`
+	ContentType     string    `json:"content_type,omitempty"`
+	FileExtension   string    `json:"file_extension,omitempty"`
+	MimeType        string    `json:"mime_type,omitempty"`
+	Category        string    `json:"category,omitempty"`
+	ContentHash     string    `json:"content_hash,omitempty"`
+	ContentHashName string    `json:"content_hash_name,omitempty"`
+	Crc64Hash       string    `json:"crc64_hash,omitempty"`
+	Starred         bool      `json:"starred"`
+	Hidden          bool      `json:"hidden"`
+	Description     string    `json:"description,omitempty"`
+	UserMeta        string    `json:"user_meta,omitempty"`
+	Labels          []string  `json:"labels,omitempty"`
+	Trashed         bool      `json:"trashed,omitempty"`
+	TrashedAt       string    `json:"trashed_at,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	data []byte
+}
+
+type upload struct {
+	uploadId    string
+	fileId      string
+	parentId    string
+	name        string
+	size        int64
+	overwrite   bool
+	parts       map[int][]byte
+	partCount   int
+	contentHash string
+}
+
+// Fault makes the server misbehave for requests whose path starts with
+// Path. Times limits how many requests are affected, zero means forever.
+type Fault struct {
+	Path string
+	// Delay is applied before anything else.
+	Delay time.Duration
+	// Status and Body replace the real response when Status is not zero.
+	Status int
+	Body   string
+	// Reset drops the connection without answering.
+	Reset bool
+	// Truncate cuts the real response body after that many bytes.
+	Truncate int
+	Times    int
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	files    map[string]*File
+	uploads  map[string]*upload
+	nextId   uint64
+	tokens   map[string]bool
+	refresh  string
+	faults   []*Fault
+	requests map[string]int
+	quota    int64
+}
+
+func NewServer() *Server {
+	s := &Server{
+		files:    make(map[string]*File),
+		uploads:  make(map[string]*upload),
+		tokens:   make(map[string]bool),
+		requests: make(map[string]int),
+		refresh:  "fake-refresh-token",
+		quota:    DefaultQuota,
+	}
+	now := time.Now().UTC()
+	s.files[RootId] = &File{DriveId: DriveId, DomainId: DomainId, FileId: RootId,
+		ParentFileId: "", Name: "root", Type: "folder", Status: "available",
+		CreatedAt: now, UpdatedAt: now}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoints returns the default API paths rooted at this server.
+func (s *Server) Endpoints() model.Endpoints {
+	e := model.DefaultEndpoints()
+	e.Base = s.URL
+	return e
+}
+
+// RefreshToken is the refresh token the server currently accepts.
+func (s *Server) RefreshToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refresh
+}
+
+// ExpireTokens invalidates every access token handed out so far, the next
+// authenticated request gets the AccessTokenInvalid error.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.tokens {
+		s.tokens[t] = false
+	}
+}
+
+// InjectFault adds f to the active faults, faults are tried in order.
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns how many requests were made to the given path.
+func (s *Server) Requests(p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[p]
+}
+
+// AddFolder creates a folder under parentId and returns its id.
+func (s *Server) AddFolder(parentId string, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addFile(parentId, name, "folder", nil).FileId
+}
+
+// AddFile creates a file with the given content under parentId and
+// returns its id.
+func (s *Server) AddFile(parentId string, name string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addFile(parentId, name, "file", data).FileId
+}
+
+// Lookup resolves a slash separated path from the root, trashed entries
+// are not visible.
+func (s *Server) Lookup(p string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.files[RootId]
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if f = s.child(f.FileId, name); f == nil {
+			return File{}, false
+		}
+	}
+	return *f, true
+}
+
+// Get returns the entry with the given id, trashed or not.
+func (s *Server) Get(fileId string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[fileId]
+	if !ok {
+		return File{}, false
+	}
+	return *f, true
+}
+
+// Content returns the data stored for a file.
+func (s *Server) Content(fileId string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[fileId]; ok {
+		return append([]byte(nil), f.data...)
+	}
+	return nil
+}
+
+// Tree lists every live path below the root, folders end with a slash.
+func (s *Server) Tree() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	var walk func(id string, prefix string)
+	walk = func(id string, prefix string) {
+		for _, c := range s.children(id) {
+			if c.Type == "folder" {
+				out = append(out, prefix+c.Name+"/")
+				walk(c.FileId, prefix+c.Name+"/")
+			} else {
+				out = append(out, prefix+c.Name)
+			}
+		}
+	}
+	walk(RootId, "/")
+	sort.Strings(out)
+	return out
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) newId() string {
+	s.nextId++
+	return fmt.Sprintf("%040x", s.nextId)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) addFile(parentId string, name string, typ string, data []byte) *File {
+	now := time.Now().UTC()
+	f := &File{DriveId: DriveId, DomainId: DomainId, FileId: s.newId(),
+		ParentFileId: parentId, Name: name, Type: typ, Status: "available",
+		CreatedAt: now, UpdatedAt: now}
+	if typ == "file" {
+		s.setContent(f, data)
+	}
+	s.files[f.FileId] = f
+	s.touch(parentId)
+	return f
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) setContent(f *File, data []byte) {
+	f.data = data
+	f.Size = int64(len(data))
+	sum := sha1.Sum(data)
+	f.ContentHash = strings.ToUpper(hex.EncodeToString(sum[:]))
+	f.ContentHashName = "sha1"
+	f.Crc64Hash = strconv.FormatUint(crc64.Checksum(data, crc64.MakeTable(crc64.ECMA)), 10)
+	ext := strings.TrimPrefix(path.Ext(f.Name), ".")
+	f.FileExtension = ext
+	switch strings.ToLower(ext) {
+	case "jpg", "jpeg", "png", "gif", "heic":
+		f.Category, f.MimeType = "image", "image/"+strings.ToLower(ext)
+	case "mp4", "mkv", "mov":
+		f.Category, f.MimeType = "video", "video/"+strings.ToLower(ext)
+	case "txt", "md":
+		f.Category, f.MimeType = "doc", "text/plain"
+	default:
+		f.Category, f.MimeType = "others", "application/octet-stream"
+	}
+	f.ContentType = f.MimeType
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) touch(id string) {
+	if f, ok := s.files[id]; ok {
+		f.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) children(parentId string) []*File {
+	var out []*File
+	for _, f := range s.files {
+		if f.ParentFileId == parentId && f.FileId != RootId && !f.Trashed {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) child(parentId string, name string) *File {
+	for _, f := range s.children(parentId) {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) used() (used int64) {
+	for _, f := range s.files {
+		used += f.Size
+	}
+	return
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, apiError{Code: code, Message: message})
+}
+
+// truncateWriter forwards at most n body bytes.
+type truncateWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (t *truncateWriter) Write(p []byte) (int, error) {
+	if t.n <= 0 {
+		return len(p), nil
+	}
+	if len(p) > t.n {
+		p = p[:t.n]
+	}
+	t.n -= len(p)
+	return t.ResponseWriter.Write(p)
+}
+
+func (s *Server) takeFault(p string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if !strings.HasPrefix(p, f.Path) {
+			continue
+		}
+		fault := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &fault
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	s.mu.Unlock()
+
+	if f := s.takeFault(r.URL.Path); f != nil {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.Reset {
+			if hj, ok := w.(http.Hijacker); ok {
+				conn, _, err := hj.Hijack()
+				if err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if f.Status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(f.Status)
+			_, _ = w.Write([]byte(f.Body))
+			return
+		}
+		if f.Truncate > 0 {
+			w = &truncateWriter{ResponseWriter: w, n: f.Truncate}
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		s.serveDownload(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		s.serveUploadPart(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidParameter", err.Error())
+		return
+	}
+	req := make(map[string]interface{})
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidParameter", err.Error())
+			return
+		}
+	}
+
+	e := model.DefaultEndpoints()
+	if r.URL.Path == e.RefreshToken {
+		s.serveRefreshToken(w, req)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "AccessTokenInvalid", "AccessToken is invalid. ErrValidateTokenFailed")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case e.List:
+		s.serveList(w, req)
+	case e.Get:
+		s.serveGet(w, req)
+	case e.FilePath:
+		s.serveGetPath(w, req)
+	case e.Search:
+		s.serveSearch(w, req)
+	case e.Create, e.CreateWithProof:
+		s.serveCreate(w, r, req)
+	case e.UploadURL:
+		s.serveUploadURL(w, r, req)
+	case e.Complete:
+		s.serveComplete(w, req)
+	case e.DownloadURL:
+		s.serveDownloadURL(w, r, req)
+	case e.Update:
+		s.serveUpdate(w, req)
+	case e.Batch:
+		s.serveBatch(w, req)
+	case e.Trash:
+		s.serveTrash(w, req)
+	case e.RecycleBinList:
+		s.serveRecycleBinList(w, req)
+	case e.RecycleBinClear:
+		for id, f := range s.files {
+			if f.Trashed {
+				s.remove(id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case e.PersonalInfo:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"personal_space_info": map[string]int64{"total_size": s.quota, "used_size": s.used()},
+		})
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", r.URL.Path)
+	}
+}
+
+func bearer(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := bearer(r)
+	valid, known := s.tokens[token]
+	// tokens that were never issued are accepted so tests can skip the
+	// refresh dance, expired ones are not
+	return token != "" && (!known || valid)
+}
+
+func str(req map[string]interface{}, key string) string {
+	v, _ := req[key].(string)
+	return v
+}
+
+func num(req map[string]interface{}, key string) int64 {
+	switch v := req[key].(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func (s *Server) serveRefreshToken(w http.ResponseWriter, req map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if str(req, "refresh_token") != s.refresh {
+		writeError(w, http.StatusBadRequest, "InvalidParameter.RefreshToken", "refresh_token is not valid")
+		return
+	}
+	s.refresh = "fake-refresh-" + s.newId()[32:]
+	access := "fake-access-" + s.newId()[32:]
+	s.tokens[access] = true
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":     access,
+		"refresh_token":    s.refresh,
+		"default_drive_id": DriveId,
+		"expires_in":       7200,
+		"token_type":       "Bearer",
+	})
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveList(w http.ResponseWriter, req map[string]interface{}) {
+	parentId := str(req, "parent_file_id")
+	if parentId == "" {
+		parentId = RootId
+	}
+	if p, ok := s.files[parentId]; !ok || p.Trashed {
+		writeError(w, http.StatusNotFound, "NotFound.File", "The resource file cannot be found. file not exist")
+		return
+	}
+	all := s.children(parentId)
+	if hidden, _ := req["all"].(bool); !hidden {
+		filtered := all[:0:0]
+		for _, f := range all {
+			if !f.Hidden {
+				filtered = append(filtered, f)
+			}
+		}
+		all = filtered
+	}
+	if str(req, "type") != "" {
+		filtered := all[:0:0]
+		for _, f := range all {
+			if f.Type == str(req, "type") {
+				filtered = append(filtered, f)
+			}
+		}
+		all = filtered
+	}
+	if str(req, "order_by") == "updated_at" {
+		desc := str(req, "order_direction") == "DESC"
+		sort.SliceStable(all, func(i, j int) bool {
+			if desc {
+				return all[i].UpdatedAt.After(all[j].UpdatedAt)
+			}
+			return all[i].UpdatedAt.Before(all[j].UpdatedAt)
+		})
+	}
+	limit := int(num(req, "limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 100
+	}
+	start, _ := strconv.Atoi(str(req, "marker"))
+	if start > len(all) {
+		start = len(all)
+	}
+	end := start + limit
+	next := ""
+	if end < len(all) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(all)
+	}
+	items := make([]File, 0, end-start)
+	for _, f := range all[start:end] {
+		items = append(items, *f)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": next})
+}
+
+// serveRecycleBinList lists the trashed entries, those inside a trashed
+// folder are not listed on their own.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveRecycleBinList(w http.ResponseWriter, req map[string]interface{}) {
+	var all []*File
+	for _, f := range s.files {
+		if f.Trashed {
+			all = append(all, f)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].FileId < all[j].FileId })
+	limit := int(num(req, "limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 100
+	}
+	start, _ := strconv.Atoi(str(req, "marker"))
+	if start > len(all) {
+		start = len(all)
+	}
+	end := start + limit
+	next := ""
+	if end < len(all) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(all)
+	}
+	items := make([]File, 0, end-start)
+	for _, f := range all[start:end] {
+		items = append(items, *f)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": next})
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveGet(w http.ResponseWriter, req map[string]interface{}) {
+	f, ok := s.files[str(req, "file_id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound.File", "The resource file cannot be found. file not exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveGetPath(w http.ResponseWriter, req map[string]interface{}) {
+	f, ok := s.files[str(req, "file_id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound.File", "The resource file cannot be found. file not exist")
+		return
+	}
+	// the file itself first, then its ancestors up to but not including root
+	var items []File
+	for f != nil && f.FileId != RootId {
+		items = append(items, *f)
+		f = s.files[f.ParentFileId]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+var queryTerm = regexp.MustCompile(`(\w+)\s*=\s*("(?:[^"\\]|\\.)*"|\w+)`)
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveSearch(w http.ResponseWriter, req map[string]interface{}) {
+	conds := make(map[string]string)
+	for _, m := range queryTerm.FindAllStringSubmatch(str(req, "query"), -1) {
+		v := m[2]
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		conds[m[1]] = v
+	}
+	var items []File
+	for _, f := range s.files {
+		if f.FileId == RootId || f.Trashed {
+			continue
+		}
+		match := true
+		for k, v := range conds {
+			switch k {
+			case "parent_file_id":
+				match = match && f.ParentFileId == v
+			case "name":
+				match = match && f.Name == v
+			case "type":
+				match = match && f.Type == v
+			case "starred":
+				match = match && strconv.FormatBool(f.Starred) == v
+			case "category":
+				match = match && f.Category == v
+			}
+		}
+		if match {
+			items = append(items, *f)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": ""})
+}
+
+func (s *Server) partURL(u *upload, part int) string {
+	return fmt.Sprintf("%v/upload/%v/%v/%v?x-oss-expires=%v&x-oss-signature=fake",
+		s.URL, u.fileId, u.uploadId, part, time.Now().Add(urlExpiration).Unix())
+}
+
+func (s *Server) partInfoList(r *http.Request, u *upload) []map[string]interface{} {
+	parts := make([]map[string]interface{}, 0, u.partCount)
+	for i := 1; i <= u.partCount; i++ {
+		parts = append(parts, map[string]interface{}{"part_number": i, "upload_url": s.partURL(u, i)})
+	}
+	return parts
+}
+
+// proof is the rapid upload proof for data, computed as the client does:
+// 8 bytes at an offset derived from the md5 of the access token.
+func proof(token string, data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	sum := md5.Sum([]byte(token))
+	first16 := hex.EncodeToString(sum[:])[:16]
+	n, _ := strconv.ParseUint(first16, 16, 64)
+	offset := n % uint64(len(data))
+	end := offset + 8
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	return base64.StdEncoding.EncodeToString(data[offset:end])
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveCreate(w http.ResponseWriter, r *http.Request, req map[string]interface{}) {
+	parentId := str(req, "parent_file_id")
+	if parentId == "" {
+		parentId = RootId
+	}
+	parent, ok := s.files[parentId]
+	if !ok || parent.Trashed || parent.Type != "folder" {
+		writeError(w, http.StatusNotFound, "NotFound.File", "parent folder not found")
+		return
+	}
+	name := str(req, "name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "InvalidParameter.Name", "name is empty")
+		return
+	}
+	mode := str(req, "check_name_mode")
+	existing := s.child(parentId, name)
+
+	if str(req, "type") == "folder" {
+		if existing != nil && mode != "auto_rename" {
+			writeJSON(w, http.StatusCreated, map[string]interface{}{
+				"parent_file_id": parentId, "type": "folder", "file_id": existing.FileId,
+				"drive_id": DriveId, "domain_id": DomainId, "file_name": existing.Name, "exist": true,
+			})
+			return
+		}
+		if existing != nil {
+			name = fmt.Sprintf("%v(%v)", name, time.Now().UnixNano())
+		}
+		f := s.addFile(parentId, name, "folder", nil)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"parent_file_id": parentId, "type": "folder", "file_id": f.FileId,
+			"drive_id": DriveId, "domain_id": DomainId, "file_name": f.Name,
+		})
+		return
+	}
+
+	if existing != nil && mode == "refuse" {
+		writeError(w, http.StatusConflict, "AlreadyExist.File", "The resource file has already exists.")
+		return
+	}
+	size := num(req, "size")
+
+	if preHash := str(req, "pre_hash"); preHash != "" {
+		for _, f := range s.files {
+			if f.Type != "file" || f.Size != size || len(f.data) == 0 {
+				continue
+			}
+			head := f.data
+			if len(head) > 1024 {
+				head = head[:1024]
+			}
+			sum := sha1.Sum(head)
+			if strings.EqualFold(hex.EncodeToString(sum[:]), preHash) {
+				writeError(w, http.StatusConflict, "PreHashMatched", "Pre hash matched.")
+				return
+			}
+		}
+	}
+
+	if hash := str(req, "content_hash"); hash != "" {
+		if size == 0 && strings.EqualFold(hash, emptySha1) {
+			if existing != nil {
+				existing.Trashed = true
+			}
+			nf := s.addFile(parentId, name, "file", nil)
+			writeJSON(w, http.StatusCreated, map[string]interface{}{
+				"parent_file_id": parentId, "type": "file", "file_id": nf.FileId,
+				"upload_id": "", "rapid_upload": true, "drive_id": DriveId,
+				"domain_id": DomainId, "file_name": name,
+			})
+			return
+		}
+		for _, f := range s.files {
+			if f.Type != "file" || f.Trashed || f.Size != size || !strings.EqualFold(f.ContentHash, hash) {
+				continue
+			}
+			if size > 0 && str(req, "proof_code") != proof(bearer(r), f.data) {
+				writeError(w, http.StatusBadRequest, "InvalidParameter.ProofCode", "proof code does not match")
+				return
+			}
+			if existing != nil {
+				existing.Trashed = true
+			}
+			nf := s.addFile(parentId, name, "file", append([]byte(nil), f.data...))
+			writeJSON(w, http.StatusCreated, map[string]interface{}{
+				"parent_file_id": parentId, "type": "file", "file_id": nf.FileId,
+				"upload_id": "", "rapid_upload": true, "drive_id": DriveId,
+				"domain_id": DomainId, "file_name": name,
+			})
+			return
+		}
+	}
+
+	parts := 0
+	if v, ok := req["part_info_list"].([]interface{}); ok {
+		parts = len(v)
+	}
+	if parts == 0 {
+		parts = 1
+	}
+	u := &upload{uploadId: strings.ToUpper(s.newId()[8:]), fileId: s.newId(),
+		parentId: parentId, name: name, size: size, overwrite: mode == "overwrite",
+		parts: make(map[int][]byte), partCount: parts, contentHash: str(req, "content_hash")}
+	s.uploads[u.uploadId] = u
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"parent_file_id": parentId, "part_info_list": s.partInfoList(r, u),
+		"upload_id": u.uploadId, "rapid_upload": false, "type": "file",
+		"file_id": u.fileId, "drive_id": DriveId, "domain_id": DomainId, "file_name": name,
+	})
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveUploadURL(w http.ResponseWriter, r *http.Request, req map[string]interface{}) {
+	u, ok := s.uploads[str(req, "upload_id")]
+	if !ok || u.fileId != str(req, "file_id") {
+		writeError(w, http.StatusNotFound, "NotFound.UploadId", "upload not found")
+		return
+	}
+	if v, ok := req["part_info_list"].([]interface{}); ok && len(v) > u.partCount {
+		u.partCount = len(v)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"upload_id": u.uploadId, "file_id": u.fileId, "part_info_list": s.partInfoList(r, u),
+	})
+}
+
+func (s *Server) serveUploadPart(w http.ResponseWriter, r *http.Request) {
+	// /upload/<file_id>/<upload_id>/<part>
+	seg := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/"), "/")
+	if r.Method != http.MethodPut || len(seg) != 3 {
+		http.Error(w, "bad upload url", http.StatusBadRequest)
+		return
+	}
+	exp, _ := strconv.ParseInt(r.URL.Query().Get("x-oss-expires"), 10, 64)
+	if time.Now().Unix() > exp {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Request has expired.</Message></Error>`))
+		return
+	}
+	part, err := strconv.Atoi(seg[2])
+	if err != nil {
+		http.Error(w, "bad part number", http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[seg[1]]
+	if !ok || u.fileId != seg[0] {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchUpload</Code></Error>`))
+		return
+	}
+	u.parts[part] = data
+	w.Header().Set("ETag", fmt.Sprintf("%x", md5.Sum(data)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveComplete(w http.ResponseWriter, req map[string]interface{}) {
+	u, ok := s.uploads[str(req, "upload_id")]
+	if !ok || u.fileId != str(req, "file_id") {
+		writeError(w, http.StatusNotFound, "NotFound.UploadId", "upload not found")
+		return
+	}
+	var buf bytes.Buffer
+	for i := 1; i <= u.partCount; i++ {
+		p, ok := u.parts[i]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidParameter.PartNumber", fmt.Sprintf("part %v missing", i))
+			return
+		}
+		buf.Write(p)
+	}
+	if u.size >= 0 && int64(buf.Len()) != u.size {
+		writeError(w, http.StatusBadRequest, "InvalidParameter.Size", fmt.Sprintf("size %v != %v", buf.Len(), u.size))
+		return
+	}
+	delete(s.uploads, u.uploadId)
+	if existing := s.child(u.parentId, u.name); existing != nil {
+		existing.Trashed = true
+	}
+	now := time.Now().UTC()
+	f := &File{DriveId: DriveId, DomainId: DomainId, FileId: u.fileId,
+		ParentFileId: u.parentId, Name: u.name, Type: "file", Status: "available",
+		CreatedAt: now, UpdatedAt: now}
+	s.setContent(f, buf.Bytes())
+	s.files[f.FileId] = f
+	s.touch(u.parentId)
+	writeJSON(w, http.StatusOK, f)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveDownloadURL(w http.ResponseWriter, r *http.Request, req map[string]interface{}) {
+	f, ok := s.files[str(req, "file_id")]
+	if !ok || f.Type != "file" {
+		writeError(w, http.StatusNotFound, "NotFound.File", "The resource file cannot be found. file not exist")
+		return
+	}
+	exp := time.Now().Add(urlExpiration)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"url":        fmt.Sprintf("%v/download/%v?x-oss-expires=%v&x-oss-signature=fake", s.URL, f.FileId, exp.Unix()),
+		"size":       f.Size,
+		"expiration": exp.UTC().Format(time.RFC3339),
+		"method":     "GET",
+	})
+}
+
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request) {
+	exp, _ := strconv.ParseInt(r.URL.Query().Get("x-oss-expires"), 10, 64)
+	if time.Now().Unix() > exp {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Request has expired.</Message></Error>`))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/download/")
+	s.mu.Lock()
+	f, ok := s.files[id]
+	var data []byte
+	var mtime time.Time
+	if ok {
+		data, mtime = f.data, f.UpdatedAt
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "", mtime, bytes.NewReader(data))
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveUpdate(w http.ResponseWriter, req map[string]interface{}) {
+	f, ok := s.files[str(req, "file_id")]
+	if !ok || f.FileId == RootId {
+		writeError(w, http.StatusNotFound, "NotFound.File", "The resource file cannot be found. file not exist")
+		return
+	}
+	if name, ok := req["name"].(string); ok && name != f.Name {
+		if other := s.child(f.ParentFileId, name); other != nil {
+			if str(req, "check_name_mode") == "refuse" {
+				writeError(w, http.StatusConflict, "AlreadyExist.File", "The resource file has already exists.")
+				return
+			}
+			other.Trashed = true
+		}
+		f.Name = name
+	}
+	if v, ok := req["starred"].(bool); ok {
+		f.Starred = v
+	}
+	if v, ok := req["hidden"].(bool); ok {
+		f.Hidden = v
+	}
+	if v, ok := req["description"].(string); ok {
+		f.Description = v
+	}
+	if v, ok := req["user_meta"].(string); ok {
+		f.UserMeta = v
+	}
+	f.UpdatedAt = time.Now().UTC()
+	writeJSON(w, http.StatusOK, f)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) trash(id string) (int, interface{}) {
+	f, ok := s.files[id]
+	if !ok || f.FileId == RootId {
+		return http.StatusNotFound, apiError{Code: "NotFound.File", Message: "file not exist"}
+	}
+	f.Trashed = true
+	f.TrashedAt = time.Now().UTC().Format(time.RFC3339)
+	s.touch(f.ParentFileId)
+	return http.StatusNoContent, nil
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) remove(id string) (int, interface{}) {
+	f, ok := s.files[id]
+	if !ok || f.FileId == RootId {
+		return http.StatusNotFound, apiError{Code: "NotFound.File", Message: "file not exist"}
+	}
+	var drop func(id string)
+	drop = func(id string) {
+		for cid, c := range s.files {
+			if c.ParentFileId == id {
+				drop(cid)
+			}
+		}
+		delete(s.files, id)
+	}
+	drop(id)
+	s.touch(f.ParentFileId)
+	return http.StatusNoContent, nil
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) move(req map[string]interface{}) (int, interface{}) {
+	f, ok := s.files[str(req, "file_id")]
+	if !ok || f.FileId == RootId {
+		return http.StatusNotFound, apiError{Code: "NotFound.File", Message: "file not exist"}
+	}
+	to := str(req, "to_parent_file_id")
+	parent, ok := s.files[to]
+	if !ok || parent.Type != "folder" {
+		return http.StatusNotFound, apiError{Code: "NotFound.ParentFileId", Message: "parent not exist"}
+	}
+	for p := parent; p != nil; p = s.files[p.ParentFileId] {
+		if p.FileId == f.FileId {
+			return http.StatusBadRequest, apiError{Code: "InvalidParameter.ToParentFileId", Message: "can not move into itself"}
+		}
+		if p.FileId == RootId {
+			break
+		}
+	}
+	name := f.Name
+	if n := str(req, "new_name"); n != "" {
+		name = n
+	}
+	if other := s.child(to, name); other != nil && other != f {
+		if str(req, "check_name_mode") != "overwrite" {
+			return http.StatusConflict, apiError{Code: "AlreadyExist.File", Message: "The resource file has already exists."}
+		}
+		other.Trashed = true
+	}
+	old := f.ParentFileId
+	f.ParentFileId = to
+	f.Name = name
+	f.UpdatedAt = time.Now().UTC()
+	s.touch(old)
+	s.touch(to)
+	return http.StatusOK, map[string]string{"drive_id": DriveId, "file_id": f.FileId}
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) restore(id string) (int, interface{}) {
+	f, ok := s.files[id]
+	if !ok || !f.Trashed {
+		return http.StatusNotFound, apiError{Code: "NotFound.File", Message: "file not in recycle bin"}
+	}
+	f.Trashed = false
+	f.TrashedAt = ""
+	s.touch(f.ParentFileId)
+	return http.StatusNoContent, nil
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveBatch(w http.ResponseWriter, req map[string]interface{}) {
+	reqs, _ := req["requests"].([]interface{})
+	if len(reqs) > 100 {
+		writeError(w, http.StatusBadRequest, "InvalidParameter.Requests", "at most 100 requests per batch")
+		return
+	}
+	responses := make([]map[string]interface{}, 0, len(reqs))
+	for _, rr := range reqs {
+		sub, _ := rr.(map[string]interface{})
+		body, _ := sub["body"].(map[string]interface{})
+		var status int
+		var out interface{}
+		switch str(sub, "url") {
+		case "/file/move":
+			status, out = s.move(body)
+		case "/recyclebin/trash":
+			status, out = s.trash(str(body, "file_id"))
+		case "/recyclebin/restore":
+			status, out = s.restore(str(body, "file_id"))
+		case "/file/delete":
+			status, out = s.remove(str(body, "file_id"))
+		default:
+			status, out = http.StatusNotFound, apiError{Code: "NotFound", Message: str(sub, "url")}
+		}
+		resp := map[string]interface{}{"id": str(sub, "id"), "status": status}
+		if out != nil {
+			resp["body"] = out
+		}
+		responses = append(responses, resp)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"responses": responses})
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Server) serveTrash(w http.ResponseWriter, req map[string]interface{}) {
+	status, out := s.trash(str(req, "file_id"))
+	if out != nil {
+		writeJSON(w, status, out)
+		return
+	}
+	w.WriteHeader(status)
+}
@@ -1,24 +1,92 @@
 package model
 
-const (
-	APIBASE            = "https://api.aliyundrive.com"
-	APILISTURL         = APIBASE + "/adrive/v3/file/list"
-	APIFILEPATH        = APIBASE + "/adrive/v1/file/get_path"
-	APIREFRESHTOKENURL = APIBASE + "/token/refresh"
-	APIREMOVETRASH     = APIBASE + "/v2/recyclebin/trash" //移动到垃圾箱
-	APIFILEUPDATE      = APIBASE + "/v3/file/update"
-	APIMKDIR           = APIBASE + "/adrive/v2/file/createWithFolders"
-	APIFILEDETAIL      = APIBASE + "/v2/file/get"
-	APIFILEBATCH       = APIBASE + "/v3/batch"
-	APIFILEUPLOAD      = APIBASE + "/adrive/v2/file/createWithFolders"
-	APIFILEUPLOADURL   = APIBASE + "/v2/file/get_upload_url"
-	APIFILEUPLOADFILE  = APIBASE + "/v2/file/create_with_proof" //"/v2/file/create"
-	APIFILECOMPLETE    = APIBASE + "/v2/file/complete"
-	APIFILEDOWNLOAD    = APIBASE + "/v2/file/get_download_url"
-	APITOTLESIZE       = APIBASE + "/v2/databox/get_personal_info"
-	APISEARCH          = APIBASE + "/adrive/v3/file/search"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
 )
 
+const APIBASE = "https://api.aliyundrive.com"
+
+// Endpoints are the URLs of the Aliyun Drive API. Paths are joined onto
+// Base, a path that is already an absolute URL is used as is, so the auth
+// server can live somewhere else than the file API.
+type Endpoints struct {
+	Base            string `json:"base"`
+	List            string `json:"list"`
+	FilePath        string `json:"get_path"`
+	RefreshToken    string `json:"refresh_token"`
+	Trash           string `json:"trash"`
+	Update          string `json:"update"`
+	Mkdir           string `json:"mkdir"`
+	Get             string `json:"get"`
+	Batch           string `json:"batch"`
+	Create          string `json:"create"`
+	UploadURL       string `json:"get_upload_url"`
+	CreateWithProof string `json:"create_with_proof"`
+	Complete        string `json:"complete"`
+	DownloadURL     string `json:"get_download_url"`
+	PersonalInfo    string `json:"personal_info"`
+	Search          string `json:"search"`
+	RecycleBinList  string `json:"recyclebin_list"`
+	RecycleBinClear string `json:"recyclebin_clear"`
+}
+
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		Base:            APIBASE,
+		List:            "/adrive/v3/file/list",
+		FilePath:        "/adrive/v1/file/get_path",
+		RefreshToken:    "/token/refresh",
+		Trash:           "/v2/recyclebin/trash", //移动到垃圾箱
+		Update:          "/v3/file/update",
+		Mkdir:           "/adrive/v2/file/createWithFolders",
+		Get:             "/v2/file/get",
+		Batch:           "/v3/batch",
+		Create:          "/adrive/v2/file/createWithFolders",
+		UploadURL:       "/v2/file/get_upload_url",
+		CreateWithProof: "/v2/file/create_with_proof", //"/v2/file/create"
+		Complete:        "/v2/file/complete",
+		DownloadURL:     "/v2/file/get_download_url",
+		PersonalInfo:    "/v2/databox/get_personal_info",
+		Search:          "/adrive/v3/file/search",
+		RecycleBinList:  "/adrive/v2/recyclebin/list",
+		RecycleBinClear: "/v2/recyclebin/clear",
+	}
+}
+
+// LoadEndpoints overlays the JSON object in path onto e, keys missing from
+// the file keep their current value.
+func LoadEndpoints(path string, e *Endpoints) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, e)
+}
+
+// ResolveEndpoints starts from DefaultEndpoints, overlays the JSON file at
+// file and finally replaces Base with base. Empty arguments are skipped.
+func ResolveEndpoints(base string, file string) (Endpoints, error) {
+	e := DefaultEndpoints()
+	if file != "" {
+		if err := LoadEndpoints(file, &e); err != nil {
+			return e, err
+		}
+	}
+	if base != "" {
+		e.Base = base
+	}
+	return e, nil
+}
+
+func (e Endpoints) URL(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimRight(e.Base, "/") + path
+}
+
 type Config struct {
 	RefreshToken string `json:"refresh_token"`
 	Token        string `json:"token"`
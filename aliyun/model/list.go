@@ -3,25 +3,67 @@ package model
 import "time"
 
 type ListModel struct {
-	DriveId       string    `json:"drive_id"`
-	FileId        string    `json:"file_id"`
-	Name          string    `json:"name"`
-	Type          string    `json:"type"`
-	Status        string    `json:"status"`
-	ParentFileId  string    `json:"parent_file_id"`
-	Starred       bool      `json:"starred"`
-	ContentType   string    `json:"content_type"`
-	FileExtension string    `json:"file_extension"`
-	MimeType      string    `json:"mime_type"`
-	MimeExtension string    `json:"mime_extension"`
-	Hidden        bool      `json:"hidden"`
-	Size          int64     `json:"size"`
-	Category      string    `json:"category"`
-	DownloadUrl   string    `json:"download_url"`
-	Url           string    `json:"url"`
-	Thumbnail     string    `json:"thumbnail"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	DriveId         string    `json:"drive_id"`
+	FileId          string    `json:"file_id"`
+	Name            string    `json:"name"`
+	Type            string    `json:"type"`
+	Status          string    `json:"status"`
+	ParentFileId    string    `json:"parent_file_id"`
+	Starred         bool      `json:"starred"`
+	ContentType     string    `json:"content_type"`
+	FileExtension   string    `json:"file_extension"`
+	MimeType        string    `json:"mime_type"`
+	MimeExtension   string    `json:"mime_extension"`
+	Hidden          bool      `json:"hidden"`
+	Size            int64     `json:"size"`
+	Category        string    `json:"category"`
+	ContentHash     string    `json:"content_hash"`
+	ContentHashName string    `json:"content_hash_name"`
+	Crc64Hash       string    `json:"crc64_hash"`
+	DownloadUrl     string    `json:"download_url"`
+	Url             string    `json:"url"`
+	Thumbnail       string    `json:"thumbnail"`
+	Labels          []string  `json:"labels,omitempty"`
+	Description     string    `json:"description,omitempty"`
+	UserMeta        string    `json:"user_meta,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	ImageMediaMetadata   *ImageMediaMetadata   `json:"image_media_metadata,omitempty"`
+	VideoMediaMetadata   *VideoMediaMetadata   `json:"video_media_metadata,omitempty"`
+	VideoPreviewMetadata *VideoPreviewMetadata `json:"video_preview_metadata,omitempty"`
+}
+
+type ImageTag struct {
+	Name       string  `json:"name"`
+	ParentName string  `json:"parent_name,omitempty"`
+	Confidence float64 `json:"confidence"`
+	TagLevel   int     `json:"tag_level"`
+}
+
+type ImageMediaMetadata struct {
+	Width     int        `json:"width"`
+	Height    int        `json:"height"`
+	Exif      string     `json:"exif,omitempty"`
+	Time      string     `json:"time,omitempty"`
+	Location  string     `json:"location,omitempty"`
+	ImageTags []ImageTag `json:"image_tags,omitempty"`
+}
+
+type VideoMediaMetadata struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Duration string `json:"duration,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+type VideoPreviewMetadata struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Duration    string `json:"duration,omitempty"`
+	AudioFormat string `json:"audio_format,omitempty"`
+	VideoFormat string `json:"video_format,omitempty"`
 }
 
 type CreateModel struct {
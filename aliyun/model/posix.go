@@ -0,0 +1,37 @@
+package model
+
+import "encoding/json"
+
+// userMetaPosix is the key of the user_meta JSON object holding the mode
+// and owner of the file set through the mount.
+const userMetaPosix = "posix"
+
+// Posix is the permission bits, owner and group of a file, nil where the
+// defaults of the mount apply.
+type Posix struct {
+	Mode *uint32 `json:"mode,omitempty"`
+	Uid  *uint32 `json:"uid,omitempty"`
+	Gid  *uint32 `json:"gid,omitempty"`
+}
+
+// Posix returns the mode and owner kept in the user_meta of item.
+func (item *ListModel) Posix() Posix {
+	var meta map[string]json.RawMessage
+	var p Posix
+	if item.UserMeta == "" || json.Unmarshal([]byte(item.UserMeta), &meta) != nil {
+		return p
+	}
+	if raw, ok := meta[userMetaPosix]; !ok || json.Unmarshal(raw, &p) != nil {
+		return Posix{}
+	}
+	return p
+}
+
+// WithPosix returns userMeta with the mode and owner p, an error if
+// userMeta is not a JSON object.
+func WithPosix(userMeta string, p Posix) (string, error) {
+	if p == (Posix{}) {
+		return setUserMetaKey(userMeta, userMetaPosix, nil)
+	}
+	return setUserMetaKey(userMeta, userMetaPosix, p)
+}
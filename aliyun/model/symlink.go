@@ -0,0 +1,31 @@
+package model
+
+import "encoding/json"
+
+// userMetaSymlink is the key of the user_meta JSON object that marks a
+// file as a symlink, holding its target. The content of the file is the
+// target as well, for those who download it.
+const userMetaSymlink = "symlink"
+
+// SymlinkTarget returns where item points if it is a symlink made by the
+// mount.
+func (item *ListModel) SymlinkTarget() (string, bool) {
+	if item.Type == "folder" || item.UserMeta == "" {
+		return "", false
+	}
+	var meta map[string]json.RawMessage
+	if json.Unmarshal([]byte(item.UserMeta), &meta) != nil {
+		return "", false
+	}
+	var target string
+	if raw, ok := meta[userMetaSymlink]; !ok || json.Unmarshal(raw, &target) != nil || target == "" {
+		return "", false
+	}
+	return target, true
+}
+
+// SymlinkUserMeta returns the user_meta of a symlink to target.
+func SymlinkUserMeta(target string) string {
+	b, _ := json.Marshal(map[string]string{userMetaSymlink: target})
+	return string(b)
+}
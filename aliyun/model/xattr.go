@@ -0,0 +1,164 @@
+package model
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// XattrPrefix starts the names of the read-only extended attributes that
+// expose what the drive knows about a file.
+const XattrPrefix = "user.aliyun."
+
+// StarredXattr is the one of them that can be set, it stars the file.
+const StarredXattr = XattrPrefix + "starred"
+
+// ParseStarred reads a value of StarredXattr, ok is false if it is none
+// of the usual spellings of a boolean.
+func ParseStarred(value []byte) (starred bool, ok bool) {
+	switch string(value) {
+	case "1", "true", "yes", "on":
+		return true, true
+	case "", "0", "false", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// userMetaXattrs is the key of the user_meta JSON object holding the
+// extended attributes set through the mount, the other keys belong to
+// other clients and are kept as they are.
+const userMetaXattrs = "xattrs"
+
+// StoredXattr reports whether the extended attribute name can be set and
+// is kept in the user_meta of the file: every name but the read-only
+// ones and those of the kernel's namespaces.
+func StoredXattr(name string) bool {
+	for _, prefix := range []string{XattrPrefix, "system.", "security.", "trusted.", "com.apple.ResourceFork"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Xattrs returns the extended attributes of item by name, leaving out
+// the fields the drive didn't fill in. The media metadata is JSON.
+func (item *ListModel) Xattrs() map[string][]byte {
+	attrs := item.UserXattrs()
+	set := func(name string, value string) {
+		if value != "" {
+			attrs[XattrPrefix+name] = []byte(value)
+		}
+	}
+	setJSON := func(name string, v interface{}) {
+		if b, err := json.Marshal(v); err == nil {
+			attrs[XattrPrefix+name] = b
+		}
+	}
+	if item.FileId == "" {
+		// not uploaded yet
+		return attrs
+	}
+	set("file_id", item.FileId)
+	set("starred", strconv.FormatBool(item.Starred))
+	set("content_hash", item.ContentHash)
+	set("content_hash_name", item.ContentHashName)
+	set("crc64_hash", item.Crc64Hash)
+	set("category", item.Category)
+	set("mime_type", item.MimeType)
+	set("labels", strings.Join(item.Labels, ","))
+	set("thumbnail", item.Thumbnail)
+	if item.ImageMediaMetadata != nil {
+		setJSON("image_media_metadata", item.ImageMediaMetadata)
+	}
+	if item.VideoMediaMetadata != nil {
+		setJSON("video_media_metadata", item.VideoMediaMetadata)
+	}
+	if item.VideoPreviewMetadata != nil {
+		setJSON("video_preview_metadata", item.VideoPreviewMetadata)
+	}
+	return attrs
+}
+
+// UserXattrs returns the extended attributes kept in the user_meta of
+// item, none if it holds something else.
+func (item *ListModel) UserXattrs() map[string][]byte {
+	var meta map[string]json.RawMessage
+	attrs := make(map[string][]byte)
+	if item.UserMeta == "" || json.Unmarshal([]byte(item.UserMeta), &meta) != nil {
+		return attrs
+	}
+	if raw, ok := meta[userMetaXattrs]; !ok || json.Unmarshal(raw, &attrs) != nil {
+		return make(map[string][]byte)
+	}
+	for name := range attrs {
+		if !StoredXattr(name) {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// WithUserXattr returns userMeta with the extended attribute name set to
+// value, an error if userMeta is not a JSON object.
+func WithUserXattr(userMeta string, name string, value []byte) (string, error) {
+	return editUserXattrs(userMeta, func(attrs map[string][]byte) {
+		if value == nil {
+			value = []byte{}
+		}
+		attrs[name] = value
+	})
+}
+
+// WithoutUserXattr returns userMeta without the extended attribute name.
+func WithoutUserXattr(userMeta string, name string) (string, error) {
+	return editUserXattrs(userMeta, func(attrs map[string][]byte) {
+		delete(attrs, name)
+	})
+}
+
+func editUserXattrs(userMeta string, edit func(attrs map[string][]byte)) (string, error) {
+	meta := make(map[string]json.RawMessage)
+	if userMeta != "" {
+		if err := json.Unmarshal([]byte(userMeta), &meta); err != nil {
+			return "", err
+		}
+	}
+	attrs := make(map[string][]byte)
+	if raw, ok := meta[userMetaXattrs]; ok {
+		if err := json.Unmarshal(raw, &attrs); err != nil {
+			return "", err
+		}
+	}
+	edit(attrs)
+	if len(attrs) == 0 {
+		return setUserMetaKey(userMeta, userMetaXattrs, nil)
+	}
+	return setUserMetaKey(userMeta, userMetaXattrs, attrs)
+}
+
+// setUserMetaKey returns userMeta with key set to value, removed for a nil
+// value, keeping the other keys as they are.
+func setUserMetaKey(userMeta string, key string, value interface{}) (string, error) {
+	meta := make(map[string]json.RawMessage)
+	if userMeta != "" {
+		if err := json.Unmarshal([]byte(userMeta), &meta); err != nil {
+			return "", err
+		}
+	}
+	if value == nil {
+		delete(meta, key)
+	} else {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		meta[key] = raw
+	}
+	if len(meta) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(meta)
+	return string(b), err
+}
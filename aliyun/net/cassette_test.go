@@ -0,0 +1,165 @@
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	secretToken = "secret-access-token"
+	secretSig   = "secret-signature"
+)
+
+// tokenServer answers /token with credentials and a signed url, /bin with
+// binary data and everything else by echoing the request body.
+func tokenServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"` + secretToken + `","refresh_token":"r1",` +
+				`"url":"https://oss/x?x-oss-expires=100&x-oss-signature=` + secretSig + `"}`))
+		case "/bin":
+			w.Write([]byte{0xff, 0xfe, 0, 1})
+		default:
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Write(body)
+		}
+	}))
+}
+
+func fetch(t *testing.T, c *http.Client, method, url, body string) []byte {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v: %v", method, url, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{`{"access_token": "abc", "x": 1}`, `{"access_token": "REDACTED", "x": 1}`},
+		{`{"refresh_token":"abc","proof_code":"p","password":"pw"}`,
+			`{"refresh_token":"REDACTED","proof_code":"REDACTED","password":"REDACTED"}`},
+		{"https://h/p?x-oss-access-key-id=k&x-oss-expires=100&x-oss-signature=s",
+			"https://h/p?x-oss-access-key-id=REDACTED&x-oss-expires=100&x-oss-signature=REDACTED"},
+		{"https://h/p?OSSAccessKeyId=k&Signature=s&security-token=t",
+			"https://h/p?OSSAccessKeyId=REDACTED&Signature=REDACTED&security-token=REDACTED"},
+		{`{"name":"file.txt"}`, `{"name":"file.txt"}`},
+	} {
+		if got := Redact(tc.in); got != tc.want {
+			t.Errorf("Redact(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := tokenServer()
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	rec, err := NewRecorder(http.DefaultTransport, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: rec}
+	fetch(t, c, "POST", srv.URL+"/token", `{"refresh_token":"secret-refresh"}`)
+	fetch(t, c, "GET", srv.URL+"/bin", "")
+	fetch(t, c, "POST", srv.URL+"/echo", "one")
+	fetch(t, c, "POST", srv.URL+"/echo", "two")
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{secretToken, secretSig, "secret-refresh"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("cassette contains %v", secret)
+		}
+	}
+	if !bytes.Contains(data, []byte("x-oss-expires=100")) {
+		t.Error("x-oss-expires not kept in the cassette")
+	}
+
+	rep, err := LoadReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &http.Client{Transport: rep}
+
+	// requests are matched by body first, so the order may differ
+	if got := string(fetch(t, c, "POST", srv.URL+"/echo", "two")); got != "two" {
+		t.Errorf("echo two replayed %q", got)
+	}
+	if got := fetch(t, c, "GET", srv.URL+"/bin", ""); !bytes.Equal(got, []byte{0xff, 0xfe, 0, 1}) {
+		t.Errorf("binary body replayed as %v", got)
+	}
+	token := string(fetch(t, c, "POST", srv.URL+"/token", ""))
+	if !strings.Contains(token, `"access_token":"REDACTED"`) {
+		t.Errorf("token replayed as %v", token)
+	}
+	m := regexp.MustCompile(`x-oss-expires=(\d+)`).FindStringSubmatch(token)
+	if m == nil {
+		t.Fatalf("no x-oss-expires in %v", token)
+	}
+	if expires, _ := strconv.ParseInt(m[1], 10, 64); expires <= time.Now().Unix() {
+		t.Errorf("replayed x-oss-expires %v is not in the future", expires)
+	}
+	if got := string(fetch(t, c, "POST", srv.URL+"/echo", "other")); got != "one" {
+		t.Errorf("echo replayed %q, want the remaining one", got)
+	}
+
+	if n := rep.Remaining(); n != 0 {
+		t.Errorf("%v interactions left", n)
+	}
+	if _, err = c.Get(srv.URL + "/echo"); err == nil {
+		t.Error("replayed a request that wasn't recorded")
+	}
+}
+
+func TestRecordTruncated(t *testing.T) {
+	srv := tokenServer()
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	rec, err := NewRecorder(http.DefaultTransport, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.MaxBody = 4
+	c := &http.Client{Transport: rec}
+	if got := string(fetch(t, c, "POST", srv.URL+"/echo", "abcdefgh")); got != "abcdefgh" {
+		t.Errorf("client got %q", got)
+	}
+	rec.Close()
+
+	rep, err := LoadReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.tape) != 1 {
+		t.Fatalf("%v interactions", len(rep.tape))
+	}
+	in := rep.tape[0]
+	if !in.Truncated || in.RequestBody != "" || in.RequestLength != 8 || in.ResponseBody != "abcd" {
+		t.Errorf("recorded %+v", in)
+	}
+}
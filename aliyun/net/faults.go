@@ -0,0 +1,212 @@
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FaultRule describes one kind of failure injected by a FaultInjector.
+// A rule applies to requests whose url path contains Path (all requests when
+// empty) and whose method is Method (any when empty), with the given
+// Probability, zero meaning always. Times limits how often it fires, zero is
+// unlimited. Latency is added before any other effect.
+type FaultRule struct {
+	Path        string        `json:"path"`
+	Method      string        `json:"method"`
+	Probability float64       `json:"probability"`
+	Times       int           `json:"times"`
+	Latency     time.Duration `json:"-"`
+	LatencyStr  string        `json:"latency"`
+	// Reset fails the request as if the connection was reset.
+	Reset bool `json:"reset"`
+	// Status answers with this status code and Body without sending the
+	// request, e.g. 429 or 503.
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+	// Truncate cuts the real response body after this many bytes.
+	Truncate int64 `json:"truncate"`
+	// ExpireURLs moves every x-oss-expires in the response into the past.
+	ExpireURLs bool `json:"expire_urls"`
+	// ExpireToken answers 401 AccessTokenInvalid.
+	ExpireToken bool `json:"expire_token"`
+
+	fired int
+}
+
+// LoadFaultRules reads a JSON array of rules, latency is a duration string
+// such as "1.5s".
+func LoadFaultRules(path string) ([]*FaultRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*FaultRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %v: %v", path, err)
+	}
+	for _, r := range rules {
+		if r.LatencyStr != "" {
+			if r.Latency, err = time.ParseDuration(r.LatencyStr); err != nil {
+				return nil, fmt.Errorf("%v: latency %v: %v", path, r.LatencyStr, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// FaultInjector is an http.RoundTripper that sends requests on to Transport
+// and breaks some of them according to its rules. The first matching rule
+// that fires wins.
+type FaultInjector struct {
+	Transport http.RoundTripper
+
+	mu    sync.Mutex
+	rules []*FaultRule
+	rnd   *rand.Rand
+}
+
+func NewFaultInjector(rt http.RoundTripper, rules ...*FaultRule) *FaultInjector {
+	return &FaultInjector{Transport: rt, rules: rules, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Seed makes the probabilistic rules repeatable.
+func (f *FaultInjector) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rnd = rand.New(rand.NewSource(seed))
+}
+
+func (f *FaultInjector) AddRule(r *FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, r)
+}
+
+func (f *FaultInjector) ClearRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+}
+
+// Fired reports how many times rules have fired in total.
+func (f *FaultInjector) Fired() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.rules {
+		n += r.fired
+	}
+	return n
+}
+
+func (f *FaultInjector) pick(req *http.Request) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.rules {
+		if r.Method != "" && r.Method != req.Method {
+			continue
+		}
+		if r.Path != "" && !strings.Contains(req.URL.Path, r.Path) {
+			continue
+		}
+		if r.Times > 0 && r.fired >= r.Times {
+			continue
+		}
+		if r.Probability > 0 && f.rnd.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+		return r
+	}
+	return nil
+}
+
+func (f *FaultInjector) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := f.pick(req)
+	if r == nil {
+		return f.Transport.RoundTrip(req)
+	}
+	if r.Latency > 0 {
+		if err := SleepContext(req.Context(), r.Latency); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case r.Reset:
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, fmt.Errorf("injected fault: %w", syscall.ECONNRESET)
+	case r.ExpireToken:
+		return fakeResponse(req, http.StatusUnauthorized,
+			`{"code":"AccessTokenInvalid","message":"AccessToken is invalid. ErrValidateTokenFailed"}`), nil
+	case r.Status != 0:
+		return fakeResponse(req, r.Status, r.Body), nil
+	}
+
+	res, err := f.Transport.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	if r.ExpireURLs {
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		past := "x-oss-expires=" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		body = expiresRe.ReplaceAll(body, []byte(past))
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+		res.Header.Del("Content-Length")
+	}
+	if r.Truncate > 0 {
+		res.Body = &truncatedBody{ReadCloser: res.Body, left: r.Truncate}
+	}
+	return res, nil
+}
+
+func fakeResponse(req *http.Request, status int, body string) *http.Response {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// truncatedBody fails with io.ErrUnexpectedEOF once left bytes were read.
+type truncatedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
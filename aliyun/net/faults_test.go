@@ -0,0 +1,176 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// countingServer answers every request with body and counts them.
+func countingServer(body string) (*httptest.Server, *int32) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&n, 1)
+		w.Write([]byte(body))
+	}))
+	return srv, &n
+}
+
+func get(t *testing.T, rt http.RoundTripper, url string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res, body, err
+}
+
+func TestFaultProbability(t *testing.T) {
+	srv, _ := countingServer("ok")
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport, &FaultRule{Probability: 0.5, Status: 503})
+	fi.Seed(1)
+	failed := 0
+	for i := 0; i < 200; i++ {
+		res, _, err := get(t, fi, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode == 503 {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 || failed != fi.Fired() {
+		t.Errorf("%v of 200 failed, %v fired", failed, fi.Fired())
+	}
+
+	// the same seed fires on the same requests
+	again := NewFaultInjector(http.DefaultTransport, &FaultRule{Probability: 0.5, Status: 503})
+	again.Seed(1)
+	for i := 0; i < 200; i++ {
+		get(t, again, srv.URL)
+	}
+	if again.Fired() != failed {
+		t.Errorf("seeded again %v fired, want %v", again.Fired(), failed)
+	}
+}
+
+func TestFaultTimes(t *testing.T) {
+	srv, n := countingServer("ok")
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport,
+		&FaultRule{Path: "/other", Status: 500},
+		&FaultRule{Path: "/list", Method: "GET", Times: 2, Status: 429, Body: `{"code":"TooManyRequests"}`})
+	for i, want := range []int{429, 429, 200, 200} {
+		res, body, err := get(t, fi, srv.URL+"/file/list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != want {
+			t.Errorf("request %v: status %v, want %v", i, res.StatusCode, want)
+		}
+		if want == 429 && string(body) != `{"code":"TooManyRequests"}` {
+			t.Errorf("request %v: body %q", i, body)
+		}
+	}
+	if *n != 2 {
+		t.Errorf("server saw %v requests, want 2", *n)
+	}
+	if fi.Fired() != 2 {
+		t.Errorf("fired %v", fi.Fired())
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	srv, n := countingServer("ok")
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport, &FaultRule{Reset: true, Times: 1})
+	if _, _, err := get(t, fi, srv.URL); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("got %v, want a reset", err)
+	}
+	if _, _, err := get(t, fi, srv.URL); err != nil || *n != 1 {
+		t.Errorf("second request: %v, server saw %v", err, *n)
+	}
+}
+
+func TestFaultTruncate(t *testing.T) {
+	srv, _ := countingServer(strings.Repeat("x", 1000))
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport, &FaultRule{Truncate: 10})
+	_, body, err := get(t, fi, srv.URL)
+	if err != io.ErrUnexpectedEOF || len(body) != 10 {
+		t.Errorf("read %v bytes, %v", len(body), err)
+	}
+}
+
+func TestFaultExpireURLs(t *testing.T) {
+	srv, _ := countingServer(`{"url":"https://oss/a?x-oss-expires=9999999999&x-oss-signature=s"}`)
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport, &FaultRule{ExpireURLs: true})
+	res, body, err := get(t, fi, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`x-oss-expires=(\d+)&x-oss-signature=s`).FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("body %s", body)
+	}
+	if expires, _ := strconv.ParseInt(string(m[1]), 10, 64); expires >= time.Now().Unix() {
+		t.Errorf("x-oss-expires %v is not in the past", expires)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("content length %v, body has %v", res.ContentLength, len(body))
+	}
+}
+
+func TestFaultExpireToken(t *testing.T) {
+	srv, n := countingServer("ok")
+	defer srv.Close()
+	fi := NewFaultInjector(http.DefaultTransport, &FaultRule{ExpireToken: true})
+	res, body, err := get(t, fi, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "AccessTokenInvalid") {
+		t.Errorf("got %v %s", res.StatusCode, body)
+	}
+	if *n != 0 {
+		t.Error("request reached the server")
+	}
+}
+
+func TestLoadFaultRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.json")
+	err := os.WriteFile(path, []byte(`[{"path":"/file/list","status":503,"times":3,"latency":"1.5s"},{"expire_token":true}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadFaultRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Latency != 1500*time.Millisecond || rules[0].Times != 3 || !rules[1].ExpireToken {
+		t.Errorf("loaded %+v", rules)
+	}
+
+	os.WriteFile(path, []byte(`[{"latency":"soon"}]`), 0600)
+	if _, err = LoadFaultRules(path); err == nil {
+		t.Error("bad latency accepted")
+	}
+}
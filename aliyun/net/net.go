@@ -2,42 +2,87 @@ package net
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"goaldfuse/common"
 	"goaldfuse/utils"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 )
 
-func Post(url, token string, data []byte) []byte {
+const DefaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36"
 
-	res, code := PostExpectStatus(url, token, data)
+var (
+	clientMu  sync.RWMutex
+	client    = &http.Client{Transport: common.GetHTTPTransport()}
+	userAgent = DefaultUserAgent
+)
+
+// Configure replaces the transport and user agent used by every request
+// made through this package. An empty ua keeps DefaultUserAgent.
+func Configure(rt http.RoundTripper, ua string) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	client = &http.Client{Transport: rt}
+	userAgent = DefaultUserAgent
+	if ua != "" {
+		userAgent = ua
+	}
+}
+
+func httpClient() (*http.Client, string) {
+	clientMu.RLock()
+	defer clientMu.RUnlock()
+	return client, userAgent
+}
+
+// SleepContext waits for d, returning early with the context error if ctx is
+// cancelled first. It is used between retries so an interrupted operation
+// does not keep the caller blocked for the whole back-off.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func Post(ctx context.Context, url, token string, data []byte) []byte {
+
+	res, code := PostExpectStatus(ctx, url, token, data)
 	if code != -1 {
 		return res
 	}
 	return res
 }
 
-func PostExpectStatus(url, token string, data []byte) ([]byte, int) {
+func PostExpectStatus(ctx context.Context, url, token string, data []byte) ([]byte, int) {
 	method := "POST"
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
-
-	if err != nil {
-		utils.Verbose(utils.VerboseLog, err)
-		return nil, -1
-	}
-	req.Header.Add("accept", "application/json, text/plain, */*")
-	req.Header.Add("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
-	req.Header.Add("content-type", "application/json;charset=UTF-8")
-	req.Header.Add("origin", "https://www.aliyundrive.com")
-	req.Header.Add("referer", "https://www.aliyundrive.com/")
-	req.Header.Add("Authorization", "Bearer "+token)
+	client, ua := httpClient()
 
 	for i := 0; i < 5; i++ {
+		if waitRate(ctx) != nil {
+			return nil, -1
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+		if err != nil {
+			utils.Verbose(utils.VerboseLog, err)
+			return nil, -1
+		}
+		req.Header.Add("accept", "application/json, text/plain, */*")
+		req.Header.Add("user-agent", ua)
+		req.Header.Add("content-type", "application/json;charset=UTF-8")
+		req.Header.Add("origin", "https://www.aliyundrive.com")
+		req.Header.Add("referer", "https://www.aliyundrive.com/")
+		req.Header.Add("Authorization", "Bearer "+token)
 
 		res, err := client.Do(req)
 		var body []byte
@@ -48,9 +93,14 @@ func PostExpectStatus(url, token string, data []byte) ([]byte, int) {
 			} else {
 				utils.Verbose(utils.VerboseLog, "❌  Post Error", err, url)
 			}
+			if ctx.Err() != nil {
+				return nil, -1
+			}
 
 			utils.Verbose(utils.VerboseLog, "🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if SleepContext(ctx, 5*time.Second) != nil {
+				return nil, -1
+			}
 			continue
 		}
 		defer func(Body io.ReadCloser) {
@@ -69,23 +119,28 @@ func PostExpectStatus(url, token string, data []byte) ([]byte, int) {
 	}
 	return nil, -1
 }
-func Put(url, token string, data []byte) ([]byte, int) {
+func Put(ctx context.Context, url, token string, data []byte) ([]byte, int) {
 	method := "PUT"
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
-
-	if err != nil {
-		utils.Verbose(utils.VerboseLog, err)
-		return nil, -1
-	}
+	client, ua := httpClient()
 	var res *http.Response
 	for i := 0; i < 5; i++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+		if err != nil {
+			utils.Verbose(utils.VerboseLog, err)
+			return nil, -1
+		}
+		req.Header.Add("user-agent", ua)
 		res, err = client.Do(req)
 		var body []byte
 		if err != nil {
 			utils.Verbose(utils.VerboseLog, "❌  Put Error", err, url)
+			if ctx.Err() != nil {
+				return nil, -1
+			}
 			utils.Verbose(utils.VerboseLog, "🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if SleepContext(ctx, 5*time.Second) != nil {
+				return nil, -1
+			}
 			continue
 		}
 		defer func(Body io.ReadCloser) {
@@ -95,7 +150,7 @@ func Put(url, token string, data []byte) ([]byte, int) {
 			}
 		}(res.Body)
 
-		body, err := ioutil.ReadAll(res.Body)
+		body, err = ioutil.ReadAll(res.Body)
 		if err != nil {
 			utils.Verbose(utils.VerboseLog, err)
 			return nil, -1
@@ -105,12 +160,12 @@ func Put(url, token string, data []byte) ([]byte, int) {
 	utils.Verbose(utils.VerboseLog, "💀  Fail to PUT", url)
 	return nil, -1
 }
-func Get(url, token string, rangeStr string) (res *http.Response, err error) {
+func Get(ctx context.Context, url, token string, rangeStr string) (res *http.Response, err error) {
 
 	method := "GET"
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
+	client, ua := httpClient()
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 
 	if err != nil {
 		utils.Verbose(utils.VerboseLog, err)
@@ -120,6 +175,7 @@ func Get(url, token string, rangeStr string) (res *http.Response, err error) {
 	//req.Header.Add("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
 	//req.Header.Add("content-type", "application/json;charset=UTF-8")
 	//req.Header.Add("origin", "https://www.aliyundrive.com")
+	req.Header.Add("user-agent", ua)
 	req.Header.Add("referer", "https://www.aliyundrive.com/")
 	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("range", rangeStr)
@@ -134,20 +190,27 @@ func Get(url, token string, rangeStr string) (res *http.Response, err error) {
 				utils.Verbose(utils.VerboseLog, "❌  Get Error", err, url, string(body), res.StatusCode, res.Status)
 			}
 			utils.Verbose(utils.VerboseLog, "❌  Get Error", err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			utils.Verbose(utils.VerboseLog, "🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if e := SleepContext(ctx, 5*time.Second); e != nil {
+				return nil, e
+			}
 			continue
 		}
 
 		return res, nil
 	}
-	return res, nil
+	return res, errors.New("Get failed after retries")
 }
 func GetProxy(w http.ResponseWriter, req *http.Request, urlStr, token string) []byte {
 
 	//method := "GET"
 	u, _ := url.Parse(urlStr)
+	c, _ := httpClient()
 	proxy := httputil.ReverseProxy{
+		Transport: c.Transport,
 		Director: func(request *http.Request) {
 			request.URL = u
 			request.Header.Add("referer", "https://www.aliyundrive.com/")
@@ -0,0 +1,85 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The API requests, every POST to the drive API, are paced by a token
+// bucket shared by the whole mount. Background work such as the prefetch
+// crawler marks its context with Background and only gets a token while at
+// least half the bucket is left, so it never holds up the requests made
+// for the user.
+
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is in tokens per second, zero for no limit.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &rateLimiter{}
+
+type backgroundKey struct{}
+
+// SetRateLimit limits the API requests to rate per second, with bursts of
+// up to a second's worth. Zero removes the limit.
+func SetRateLimit(rate float64) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.rate = rate
+	limiter.burst = rate
+	if limiter.burst < 1 {
+		limiter.burst = 1
+	}
+	limiter.tokens = limiter.burst
+	limiter.last = time.Now()
+}
+
+// Background marks the requests made with ctx as background work, which
+// leaves half of the rate limit to the others.
+func Background(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+// take returns how long to wait for a token, or takes one and returns
+// zero. A background request needs half the bucket left over.
+func (l *rateLimiter) take(background bool) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	need := 1.0
+	if background {
+		need += l.burst / 2
+	}
+	if l.tokens >= need {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+}
+
+// waitRate blocks until the rate limit lets a request made with ctx go.
+func waitRate(ctx context.Context) error {
+	background := ctx.Value(backgroundKey{}) != nil
+	for {
+		d := limiter.take(background)
+		if d == 0 {
+			return nil
+		}
+		if err := SleepContext(ctx, d); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package net
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	SetRateLimit(10)
+	defer SetRateLimit(0)
+
+	// background requests leave half the bucket of 10
+	taken := 0
+	for limiter.take(true) == 0 {
+		taken++
+	}
+	if taken != 5 {
+		t.Errorf("%v background requests went through, want 5", taken)
+	}
+	for limiter.take(false) == 0 {
+		taken++
+	}
+	if taken != 10 {
+		t.Errorf("%v requests went through, want 10", taken)
+	}
+	if d := limiter.take(false); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("wait %v for the next token at 10 per second", d)
+	}
+	if d := limiter.take(true); d < 500*time.Millisecond {
+		t.Errorf("wait %v for a background token, want half a second", d)
+	}
+
+	start := time.Now()
+	if err := waitRate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("got a token after %v", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(Background(context.Background()), 10*time.Millisecond)
+	defer cancel()
+	if err := waitRate(ctx); err != context.DeadlineExceeded {
+		t.Errorf("background wait ended with %v", err)
+	}
+
+	SetRateLimit(0)
+	for i := 0; i < 100; i++ {
+		if d := limiter.take(true); d != 0 {
+			t.Fatalf("wait %v without a limit", d)
+		}
+	}
+}
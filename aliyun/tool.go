@@ -1,12 +1,11 @@
 package aliyun
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
 	"github.com/tidwall/gjson"
-	"goaldfuse/aliyun/cache"
-	"goaldfuse/aliyun/model"
 	"goaldfuse/aliyun/net"
 	"goaldfuse/utils"
 	"io"
@@ -18,7 +17,7 @@ import (
 )
 
 //处理内容
-func ContentHandle(intermediateFile *os.File, token string, driveId string, parentId string, fileName string, size uint64) string {
+func (c *Client) ContentHandle(ctx context.Context, intermediateFile *os.File, token string, driveId string, parentId string, fileName string, size uint64) string {
 	//需要判断参数里面的有效期
 	//默认截取长度10485760
 	//const DEFAULT int64 = 10485760
@@ -33,14 +32,10 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 	} else {
 		//空文件处理
 		sha1_0 := "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"
-		_, _, fileId, _ := UpdateFileFile(token, driveId, fileName, parentId, "0", 1, sha1_0, "", true)
+		_, _, fileId, _ := c.UpdateFileFile(ctx, token, driveId, fileName, parentId, "0", 1, sha1_0, "", true)
 		if fileId != "" {
 			utils.Verbose(utils.VerboseLog, "0⃣️  Created zero byte file", fileName)
-			if va, ok := cache.GoCache.Get(parentId); ok {
-				l := va.(model.FileListModel)
-				l.Items = append(l.Items, GetFileDetail(token, driveId, fileId))
-				cache.GoCache.SetDefault(parentId, l)
-			}
+			c.Cache.AddToList(parentId, c.GetFileDetail(ctx, token, driveId, fileId))
 
 			return fileId
 		} else {
@@ -81,7 +76,7 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 		//检查是否可以极速上传，逻辑如下
 		//取文件的前1K字节，做SHA1摘要，调用创建文件接口，pre_hash参数为SHA1摘要，如果返回409，则这个文件可以极速上传
 		preHashRequest := `{"drive_id":"` + driveId + `","parent_file_id":"` + parentId + `","name":"` + fileName + `","type":"file","check_name_mode":"overwrite","size":` + strconv.FormatUint(size, 10) + `,"pre_hash":"` + hex.EncodeToString(h.Sum(nil)) + `","proof_version":"v1"}`
-		_, code = net.PostExpectStatus(model.APIFILEUPLOAD, token, []byte(preHashRequest))
+		_, code = net.PostExpectStatus(ctx, c.url(c.Endpoints.Create), token, []byte(preHashRequest))
 		if code == 409 {
 			md := md5.New()
 			tokenBytes := []byte(token)
@@ -119,19 +114,15 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 			utils.Verbose(utils.VerboseLog, "❌  Error calculate SHA1", sha1Error, fileName, intermediateFile.Name(), size)
 			return ""
 		}
-		uploadUrl, uploadId, uploadFileId, flashUpload = UpdateFileFile(token, driveId, fileName, parentId, strconv.FormatUint(size, 10), int(count), strings.ToUpper(hex.EncodeToString(h2.Sum(nil))), proof, flashUpload)
+		uploadUrl, uploadId, uploadFileId, flashUpload = c.UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatUint(size, 10), int(count), strings.ToUpper(hex.EncodeToString(h2.Sum(nil))), proof, flashUpload)
 		if flashUpload && (uploadFileId != "") {
 			utils.Verbose(utils.VerboseLog, "⚡️⚡️  Rapid Upload ", fileName, size)
 			//UploadFileComplete(token, driveId, uploadId, uploadFileId, parentId)
-			if va, ok := cache.GoCache.Get(parentId); ok {
-				l := va.(model.FileListModel)
-				l.Items = append(l.Items, GetFileDetail(token, driveId, uploadFileId))
-				cache.GoCache.SetDefault(parentId, l)
-			}
+			c.Cache.AddToList(parentId, c.GetFileDetail(ctx, token, driveId, uploadFileId))
 			return uploadFileId
 		}
 	} else {
-		uploadUrl, uploadId, uploadFileId, flashUpload = UpdateFileFile(token, driveId, fileName, parentId, strconv.FormatUint(size, 10), int(count), "", "", false)
+		uploadUrl, uploadId, uploadFileId, flashUpload = c.UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatUint(size, 10), int(count), "", "", false)
 	}
 
 	if len(uploadUrl) == 0 {
@@ -178,12 +169,14 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 			utils.Verbose(utils.VerboseLog, "⚠️  Expire:", exp)
 			utils.Verbose(utils.VerboseLog, "⚠️  Uploading URL expired, renewing", uploadId, uploadFileId, fileName)
 			for i := 0; i < 10; i++ {
-				uploadUrl = GetUploadUrls(utils.AccessToken, utils.DriveId, uploadFileId, uploadId, int(count))
+				uploadUrl = c.GetUploadUrls(ctx, utils.AccessToken, utils.DriveId, uploadFileId, uploadId, int(count))
 				if len(uploadUrl) == int(count) {
 					break
 				}
 				utils.Verbose(utils.VerboseLog, "Retry in 10 seconds")
-				time.Sleep(10 * time.Second)
+				if net.SleepContext(ctx, 10*time.Second) != nil {
+					return ""
+				}
 			}
 
 			if len(uploadUrl) == 0 {
@@ -196,7 +189,7 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 				utils.Verbose(utils.VerboseLog, "  💻  Renew Upload URL Done, Total Parts", len(uploadUrl))
 			}
 		}
-		if ok := UploadFile(uploadUrl[i].Str, token, dataByte); !ok {
+		if ok := c.UploadFile(ctx, uploadUrl[i].Str, token, dataByte); !ok {
 			utils.Verbose(utils.VerboseLog, "❌  Upload part failed ", fileName, "Part#", i+1, " 😜   Cancel upload")
 			return ""
 		}
@@ -205,11 +198,7 @@ func ContentHandle(intermediateFile *os.File, token string, driveId string, pare
 	}
 	utils.Verbose(utils.VerboseLog, "⚡ ⚡ ⚡   Done. Elapsed ", time.Now().Sub(bg).String(), fileName, size)
 	//长时间上传可能之前传入的token已经过期，从全局变量中取
-	UploadFileComplete(utils.AccessToken, utils.DriveId, uploadId, uploadFileId, parentId)
-	if va, ok := cache.GoCache.Get(parentId); ok {
-		l := va.(model.FileListModel)
-		l.Items = append(l.Items, GetFileDetail(token, driveId, uploadFileId))
-		cache.GoCache.SetDefault(parentId, l)
-	}
+	c.UploadFileComplete(ctx, utils.AccessToken, utils.DriveId, uploadId, uploadFileId, parentId)
+	c.Cache.AddToList(parentId, c.GetFileDetail(ctx, token, driveId, uploadFileId))
 	return uploadFileId
 }
@@ -17,14 +17,26 @@
 package common
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type FlagStorage struct {
 	// File system
+	// MountOptions are the -o options. uid, gid and umask set the owner
+	// and modes of the entries without their own, the others go to the
+	// mount command.
 	MountOptions      map[string]string
 	MountPoint        string
 	MountPointArg     string
@@ -42,11 +54,106 @@ type FlagStorage struct {
 	StatCacheTTL time.Duration
 	TypeCacheTTL time.Duration
 	HTTPTimeout  time.Duration
+	// OpTimeout bounds how long a single metadata operation (lookup,
+	// readdir, mkdir, rename, ...) may spend talking to the API before
+	// it is abandoned. Zero disables the limit.
+	OpTimeout time.Duration
+	// InodeMapFile keeps the inode numbers of files whose number derived
+	// from the FileId collided with another file, so they survive a
+	// remount.
+	InodeMapFile string
+	// MaxCachedDirs caps how many directory listings are kept in memory,
+	// the least recently used are dropped first. Zero means no limit.
+	MaxCachedDirs int
+	// Expiry of the API metadata cached by the client, zero disables that
+	// part of the cache. MetaCacheSize bounds each part.
+	ListCacheTTL   time.Duration
+	FileCacheTTL   time.Duration
+	SearchCacheTTL time.Duration
+	MetaCacheSize  int
+	// MetaDBFile persists listings and file details across restarts, and
+	// is served read-only while the drive can't be reached.
+	MetaDBFile string
+	// PollInterval is how often the PollDirs most recently used
+	// directories are listed again to find remote changes, zero disables
+	// polling.
+	PollInterval time.Duration
+	PollDirs     int
+	// Prefetch lists the comma separated subtrees crawled in the
+	// background after mounting, "/" for the whole drive.
+	Prefetch        string
+	PrefetchWorkers int
+	// PermanentDelete deletes for good instead of moving to the recycle
+	// bin.
+	PermanentDelete bool
+	// HideSymlinks hides the small files holding symlinks from the web
+	// UI, which shows them as regular files otherwise.
+	HideSymlinks bool
+
+	// HTTP
+	// ProxyURL overrides the proxy from the environment, http, https and
+	// socks5 schemes are accepted, credentials go in the userinfo part.
+	ProxyURL            string
+	CABundle            string
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	MaxIdleConns        int
+	UserAgent           string
+	HTTP2               bool
+	// APIRate limits the API requests per second, zero for no limit.
+	// Background work such as the prefetch crawler only gets what is
+	// left over.
+	APIRate float64
 
 	// Debugging
 	DebugFuse        bool
 	DebugAliYunDrive bool
 	Foreground       bool
+	// RecordFile and ReplayFile name a cassette that API traffic is
+	// written to, or answered from instead of the network.
+	RecordFile string
+	ReplayFile string
+	// FaultsFile holds fault injection rules for chaos testing, see
+	// net.LoadFaultRules.
+	FaultsFile string
+}
+
+// ParseMountOptions adds the comma separated mount options of s, each
+// name or name=value, to MountOptions.
+func (flags *FlagStorage) ParseMountOptions(s string) error {
+	if flags.MountOptions == nil {
+		flags.MountOptions = make(map[string]string)
+	}
+	for _, opt := range strings.Split(s, ",") {
+		if opt == "" {
+			continue
+		}
+		name, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			name, value = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch name {
+		case "uid", "gid":
+			_, err = strconv.ParseUint(value, 10, 32)
+		case "umask":
+			_, err = strconv.ParseUint(value, 8, 32)
+		}
+		if err != nil {
+			return fmt.Errorf("mount option %v: %v", opt, err)
+		}
+		flags.MountOptions[name] = value
+	}
+	return nil
+}
+
+// ParseMode reads an octal mode, as given to -dir-mode and -file-mode.
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid mode %v", s)
+	}
+	return os.FileMode(mode), nil
 }
 
 func (flags *FlagStorage) Cleanup() {
@@ -75,3 +182,88 @@ var defaultHTTPTransport = http.Transport{
 func GetHTTPTransport() *http.Transport {
 	return &defaultHTTPTransport
 }
+
+// NewHTTPTransport builds the transport shared by every API and download
+// request from the HTTP settings in flags. Zero values keep the defaults of
+// GetHTTPTransport. HTTPTimeout bounds the wait for response headers only,
+// so long downloads are not cut off.
+func NewHTTPTransport(flags *FlagStorage) (*http.Transport, error) {
+	t := defaultHTTPTransport.Clone()
+
+	if flags.ProxyURL != "" {
+		proxy, err := url.Parse(flags.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %v: %v", flags.ProxyURL, err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %v", proxy.Scheme)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+
+	if flags.CABundle != "" {
+		pem, err := ioutil.ReadFile(flags.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", flags.CABundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if flags.DialTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   flags.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if flags.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = flags.TLSHandshakeTimeout
+	}
+	if flags.HTTPTimeout > 0 {
+		t.ResponseHeaderTimeout = flags.HTTPTimeout
+	}
+	if flags.MaxIdleConns > 0 {
+		t.MaxIdleConns = flags.MaxIdleConns
+		t.MaxIdleConnsPerHost = flags.MaxIdleConns
+	}
+	// a custom dialer or TLS config turns off HTTP/2 unless asked for
+	t.ForceAttemptHTTP2 = flags.HTTP2
+
+	return t, nil
+}
+
+// FlagSetter is satisfied by both flag.FlagSet and pflag.FlagSet.
+type FlagSetter interface {
+	Set(name, value string) error
+}
+
+// ApplyConfigFile reads a JSON object whose keys are command line flag
+// names and sets each of them on flags, e.g. {"proxy": "socks5://h:1080"}.
+// Callers parse the command line again afterwards so explicit flags win.
+func ApplyConfigFile(path string, flags FlagSetter) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	// numbers as written, a float64 would print 1000000 as 1e+06
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&values); err != nil {
+		return fmt.Errorf("parse %v: %v", path, err)
+	}
+	for name, v := range values {
+		if err = flags.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%v: %v: %v", path, name, err)
+		}
+	}
+	return nil
+}
@@ -4,20 +4,21 @@
 package fs
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
-	"goaldfuse/aliyun"
-	"goaldfuse/aliyun/model"
 	. "goaldfuse/common"
-	"io/ioutil"
+	"os"
 	"os/user"
-	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -27,9 +28,24 @@ var fuseLog = GetLogger("fuse")
 var TOTAL uint64
 var USED uint64
 
-func NewAliYunDriveFsServer(config model.Config) (fuse.Server, error) {
+func NewAliYunDriveFsServer(backend Backend, flags *FlagStorage) (fuse.Server, error) {
+	fs := NewAliYunDriveFs(backend, flags)
+	go fs.watchHandles()
+	if flags.PollInterval > 0 {
+		go fs.watchChanges()
+	}
+	if len(flags.Prefetch) != 0 {
+		fs.crawler = NewCrawler(fs, strings.Split(flags.Prefetch, ","), flags.PrefetchWorkers)
+		go fs.crawler.Run(context.Background())
+	}
+	return fuseutil.NewFileSystemServer(FusePanicLogger{Fs: fs}), nil
+}
+
+// NewAliYunDriveFs returns the file system without the fuse.Server wrapper,
+// so its operations can be called directly, see fs/fstest.
+func NewAliYunDriveFs(backend Backend, flags *FlagStorage) *AliYunDriveFs {
 	fs := &AliYunDriveFs{
-		Config: config,
+		backend: backend,
 	}
 	TOTAL = 0
 	USED = 0
@@ -40,15 +56,16 @@ func NewAliYunDriveFsServer(config model.Config) (fuse.Server, error) {
 	}
 	fs.umask = 0122
 	fs.bufferPool = BufferPool{}.Init()
-	fs.nextInodeID = fuseops.RootInodeID + 1
 	fs.inodes = make(map[fuseops.InodeID]*Inode)
 	fs.pnCache = make(map[string]*Inode)
+	fs.listings = list.New()
+	fs.deletes = newDeleter(fs)
 	root := NewInode(fs, nil, "")
 	root.Id = fuseops.RootInodeID
 	root.ToDir()
 	root.Attributes.Mtime = fs.rootAttrs.Mtime
-	root.FileId = "root"
-	root.ParentFileId = "root"
+	root.FileId = RootFileId
+	root.ParentFileId = RootFileId
 	fs.inodes[fuseops.RootInodeID] = root
 	fs.addDotAndDotDot(root)
 	fs.nextHandleID = 1
@@ -56,35 +73,38 @@ func NewAliYunDriveFsServer(config model.Config) (fuse.Server, error) {
 	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
 	//fs.replicators = Ticket{Total: 16}.Init()
 	//fs.restorers = Ticket{Total: 20}.Init()
-	fs.flags = &FlagStorage{
-		DirMode:          0755,
-		FileMode:         0644,
-		Uid:              currentUid(),
-		Gid:              currentGid(),
-		DebugAliYunDrive: true,
-		DebugFuse:        true,
-	}
-	go func(driveFs *AliYunDriveFs) {
-		for {
-			aliLog.Log("Refresh Token")
-			time.Sleep(120 * time.Second)
-			refreshResult := aliyun.RefreshToken(driveFs.Config.RefreshToken)
-			if !reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) {
-				driveFs.Config = model.Config{
-					DriveId:      refreshResult.DefaultDriveId,
-					RefreshToken: refreshResult.RefreshToken,
-					Token:        refreshResult.AccessToken,
-					ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
-				}
-				err := ioutil.WriteFile(".refresh_token", []byte(refreshResult.RefreshToken), 0600)
-				if err != nil {
-					fmt.Println("Can't write token file, token will not be able to persist")
-				}
-			}
-		}
-
-	}(fs)
-	return fuseutil.NewFileSystemServer(FusePanicLogger{Fs: fs}), nil
+	if flags == nil {
+		flags = &FlagStorage{OpTimeout: 2 * time.Minute}
+	}
+	if flags.DirMode == 0 {
+		flags.DirMode = 0755
+	}
+	if flags.FileMode == 0 {
+		flags.FileMode = 0644
+	}
+	flags.Uid = currentUid()
+	flags.Gid = currentGid()
+	// the uid, gid and umask mount options, for the entries without their
+	// own in user_meta
+	if v, ok := flags.MountOptions["uid"]; ok {
+		uid, _ := strconv.ParseUint(v, 10, 32)
+		flags.Uid = uint32(uid)
+	}
+	if v, ok := flags.MountOptions["gid"]; ok {
+		gid, _ := strconv.ParseUint(v, 10, 32)
+		flags.Gid = uint32(gid)
+	}
+	if v, ok := flags.MountOptions["umask"]; ok {
+		umask, _ := strconv.ParseUint(v, 8, 32)
+		flags.DirMode = 0777 &^ os.FileMode(umask)
+		flags.FileMode = 0666 &^ os.FileMode(umask)
+	}
+	flags.DebugAliYunDrive = true
+	flags.DebugFuse = true
+	fs.flags = flags
+	fs.ids = newInodeIds(flags.InodeMapFile)
+	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
+	return fs
 }
 
 func currentUid() uint32 {
@@ -117,15 +137,15 @@ func currentGid() uint32 {
 
 type AliYunDriveFs struct {
 	fuseutil.NotImplementedFileSystem
-	Config model.Config
-	flags  *FlagStorage
+	flags   *FlagStorage
+	backend Backend
 
-	umask       uint32
-	rootAttrs   InodeAttributes
-	mu          syncutil.InvariantMutex
-	nextInodeID fuseops.InodeID
-	bufferPool  *BufferPool
-	inodes      map[fuseops.InodeID]*Inode
+	umask      uint32
+	rootAttrs  InodeAttributes
+	mu         syncutil.InvariantMutex
+	ids        *inodeIds
+	bufferPool *BufferPool
+	inodes     map[fuseops.InodeID]*Inode
 
 	nextHandleID fuseops.HandleID
 	dirHandles   map[fuseops.HandleID]*DirHandle
@@ -135,14 +155,44 @@ type AliYunDriveFs struct {
 	//replicators *Ticket
 	//restorers   *Ticket
 
-	forgotCnt uint32
-	pnCache   map[string]*Inode
+	forgotCnt uint64
+	evictCnt  uint64
+	pollCnt   uint64
+
+	// listings holds the directories whose complete listing is cached,
+	// most recently used first. lruMu is a leaf lock.
+	lruMu    sync.Mutex
+	listings *list.List
+
+	// pnCache finds a child inode by parent FileId, name and type. pnMu
+	// is a leaf lock, nothing else is acquired while holding it.
+	pnMu    sync.Mutex
+	pnCache map[string]*Inode
+
+	// crawler is the prefetch crawler, nil unless flags.Prefetch is set.
+	crawler *Crawler
+	// deletes sends the remote deletes of unlink and rmdir in batches.
+	deletes *deleter
+
+	// trashMu serializes the listings of the recycle bin, trashListed is
+	// when the last one was.
+	trashMu     sync.Mutex
+	trashListed time.Time
+	// starredMu and starredListed do the same for starredName.
+	starredMu     sync.Mutex
+	starredListed time.Time
+
+	// xattrMu serializes the changes to user_meta.
+	xattrMu sync.Mutex
 }
 
-func (fs *AliYunDriveFs) allocateInodeId() (id fuseops.InodeID) {
-	id = fs.nextInodeID
-	fs.nextInodeID++
-	return
+// withOpTimeout derives the context used for the API calls of a single
+// metadata operation, bounded by flags.OpTimeout.
+func (fs *AliYunDriveFs) withOpTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if fs.flags.OpTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, fs.flags.OpTimeout)
 }
 
 // LOCKS_REQUIRED(fs.mu)
@@ -160,15 +210,14 @@ func (fs *AliYunDriveFs) insertInode(parent *Inode, inode *Inode) {
 		if inode.Id != 0 {
 			panic(fmt.Sprintf("inode id is set: %v %v", inode.Name, inode.Id))
 		}
-		inode.Id = fs.allocateInodeId()
+		fs.mu.Lock()
+		inode.Id, inode.Generation = fs.ids.assign(inode.FileId, fs.inodes)
+		fs.inodes[inode.Id] = inode
+		fs.mu.Unlock()
 		addInode = true
 	}
 	parent.insertChildUnlocked(inode)
 	if addInode {
-		fs.mu.Lock()
-		fs.inodes[inode.Id] = inode
-		fs.pnCache[parent.FileId+inode.Name+inode.Type] = inode
-		fs.mu.Unlock()
 		// if we are inserting a new directory, also create
 		// the child . and ..
 		if inode.isDir() {
@@ -201,12 +250,15 @@ func (h *AliYunDriveFs) GetInodeAttributes(ctx context.Context, op *fuseops.GetI
 		op.AttributesExpiration = time.Now().Add(h.flags.StatCacheTTL)
 	}
 
-	return nil
+	return err
 }
+
+// the callers hold fs.mu, read-locking it again here would deadlock
+// with a writer waiting in between
+//
+// LOCKS_REQUIRED(fs.mu)
 func (fs *AliYunDriveFs) getInodeOrDie(id fuseops.InodeID) (inode *Inode) {
-	fs.mu.RLock()
 	inode = fs.inodes[id]
-	fs.mu.RUnlock()
 	if inode == nil {
 		panic(fmt.Sprintf("Unknown inode: %v", id))
 	}
@@ -218,6 +270,18 @@ func (fs *AliYunDriveFs) SetInodeAttributes(ctx context.Context, op *fuseops.Set
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
+	// this version of the fuse library drops the uid and gid of a
+	// setattr, one that changes nothing else is a chown we can't do
+	if op.Size == nil && op.Mode == nil && op.Atime == nil && op.Mtime == nil && op.Handle == nil {
+		return syscall.ENOSYS
+	}
+	if op.Mode != nil {
+		ctx, cancel := fs.withOpTimeout(ctx)
+		defer cancel()
+		if err = fs.chmod(ctx, inode, *op.Mode); err != nil {
+			return
+		}
+	}
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
@@ -232,22 +296,26 @@ func (fs *AliYunDriveFs) ForgetInode(ctx context.Context, op *fuseops.ForgetInod
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
-	if inode.Parent != nil {
-		inode.Parent.mu.Lock()
-		defer inode.Parent.mu.Unlock()
+	parent := inode.Parent
+	if parent != nil {
+		parent.mu.Lock()
+		defer parent.mu.Unlock()
 	}
 	stale := inode.DeRef(op.N)
 
 	if stale {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
+		atomic.AddUint64(&fs.forgotCnt, 1)
 
-		delete(fs.inodes, op.Inode)
-		fs.forgotCnt += 1
-
-		if inode.Parent != nil {
-			inode.Parent.removeChildUnlocked(inode)
+		// still part of a cached listing, the inode stays until
+		// that listing is evicted
+		if parent != nil && fs.listed(parent) {
+			return
 		}
+		if parent != nil {
+			parent.removeChildUnlocked(inode)
+			inode.Parent = nil
+		}
+		fs.removeInode(inode)
 	}
 
 	return
@@ -255,15 +323,11 @@ func (fs *AliYunDriveFs) ForgetInode(ctx context.Context, op *fuseops.ForgetInod
 
 func (h *AliYunDriveFs) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
 	if TOTAL == 0 && USED == 0 {
-		total, used := aliyun.GetBoxSize(h.Config.Token)
-
-		TOTAL, err = strconv.ParseUint(total, 10, 64)
-		if err != nil {
-			return
-		}
-		USED, err = strconv.ParseUint(used, 10, 64)
+		ctx, cancel := h.withOpTimeout(ctx)
+		defer cancel()
+		TOTAL, USED, err = h.backend.Quota(ctx)
 		if err != nil {
-			return
+			return backendErr(ctx, err)
 		}
 	}
 
@@ -289,17 +353,51 @@ func (fs *AliYunDriveFs) LookUpInode(ctx context.Context, op *fuseops.LookUpInod
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	if op.Parent == fuseops.RootInodeID && op.Name == trashName {
+		fs.trashRoot()
+	} else if op.Parent == fuseops.RootInodeID && op.Name == starredName {
+		fs.starredRoot()
+	} else if parent.isVirtual() {
+		ctx, cancel := fs.withOpTimeout(ctx)
+		if parent.inStarred {
+			err = fs.refreshStarred(ctx, false)
+		} else {
+			err = fs.refreshTrash(ctx, false)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
 	parent.mu.Lock()
 	inode = parent.findChildUnlocked(op.Name, "")
+	loaded := false
+	if inode == nil && !parent.isVirtual() && !fs.listed(parent) {
+		// the listing was never fetched or has been evicted
+		parent.mu.Unlock()
+		ctx, cancel := fs.withOpTimeout(ctx)
+		defer cancel()
+		if err = parent.loadListing(ctx); err != nil {
+			return err
+		}
+		loaded = true
+		parent.mu.Lock()
+		inode = parent.findChildUnlocked(op.Name, "")
+	}
 	if inode != nil {
 		inode.Ref()
-	} else {
-		parent.mu.Unlock()
-		return fuse.ENOENT
 	}
 	parent.mu.Unlock()
+	if loaded {
+		fs.cachedListing(parent)
+	}
+	if inode == nil {
+		return fuse.ENOENT
+	}
 
 	op.Entry.Child = inode.Id
+	op.Entry.Generation = inode.Generation
 	op.Entry.Attributes = inode.InflateAttributes()
 	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
 	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
@@ -311,14 +409,25 @@ func (fs *AliYunDriveFs) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
-	dir, err := parent.MkDir(op.Name)
+	if parent.isVirtual() {
+		return syscall.EROFS
+	}
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	// rm -rf x && mkdir x, the old x must be gone first
+	fs.deletes.Sync()
+	dir, err := parent.MkDir(ctx, op.Name)
 	if err != nil {
 		return err
 	}
 	parent.mu.Lock()
 	fs.insertInode(parent, dir)
 	parent.mu.Unlock()
+	if err = fs.chmod(ctx, dir, op.Mode); err != nil {
+		dir.errFuse("keeping the mode", op.Mode, err)
+	}
 	op.Entry.Child = dir.Id
+	op.Entry.Generation = dir.Generation
 	op.Entry.Attributes = dir.InflateAttributes()
 	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
 	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
@@ -329,29 +438,28 @@ func (fs *AliYunDriveFs) CreateFile(ctx context.Context, op *fuseops.CreateFileO
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
+	if parent.isVirtual() {
+		return syscall.EROFS
+	}
 
 	inode, fh := parent.Create(op.Name, op.OpContext)
 
 	parent.mu.Lock()
-
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
 	fs.insertInode(parent, inode)
-
 	parent.mu.Unlock()
+	// not uploaded yet, kept with the inode until then
+	if err = fs.chmod(ctx, inode, op.Mode); err != nil {
+		inode.errFuse("keeping the mode", op.Mode, err)
+		err = nil
+	}
 
 	op.Entry.Child = inode.Id
+	op.Entry.Generation = inode.Generation
 	op.Entry.Attributes = inode.InflateAttributes()
 	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
 	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
 
-	// Allocate a handle.
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
-	fs.mu.Lock()
-	fs.fileHandles[handleID] = fh
-	fs.mu.Unlock()
-	op.Handle = handleID
+	op.Handle = fs.addFileHandle(fh)
 
 	inode.logFuse("<-- CreateFile")
 
@@ -368,61 +476,61 @@ func (fs *AliYunDriveFs) Rename(ctx context.Context, op *fuseops.RenameOp) (err
 	newParent := fs.getInodeOrDie(op.NewParent)
 	fs.mu.RUnlock()
 
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	if parent.inStarred || newParent.inStarred || (op.OldParent == fuseops.RootInodeID && op.OldName == starredName) {
+		return syscall.EPERM
+	}
+	if parent.inTrash || newParent.inTrash || (op.OldParent == fuseops.RootInodeID && op.OldName == trashName) {
+		err = fs.restore(ctx, parent, op.OldName, newParent, op.NewName)
+		parent.logFuse("<-- Rename", op.OldName, newParent.FullName(), op.NewName, err)
+		return
+	}
+	fs.deletes.Sync()
+	// the target has to be known to be replaced
+	for _, dir := range []*Inode{parent, newParent} {
+		if err = fs.ensureListed(ctx, dir); err != nil {
+			return
+		}
+	}
+
+	// a folder replaced has to be listed to be known empty
+	for {
+		if err = newParent.listChild(ctx, op.NewName); err != nil {
+			return
+		}
+		if err = fs.rename(ctx, op, parent, newParent); err != errNotListed {
+			break
+		}
+	}
+	parent.logFuse("<-- Rename", op.OldName, newParent.FullName(), op.NewName, err)
+	return
+}
+
+// LOCKS_EXCLUDED(parent.mu)
+// LOCKS_EXCLUDED(newParent.mu)
+func (fs *AliYunDriveFs) rename(ctx context.Context, op *fuseops.RenameOp, parent *Inode, newParent *Inode) error {
 	// XXX don't hold the lock the entire time
-	if op.OldParent == op.NewParent {
+	if parent == newParent {
 		parent.mu.Lock()
 		defer parent.mu.Unlock()
 	} else {
-		// lock ordering to prevent deadlock
-		if op.OldParent < op.NewParent {
-			parent.mu.Lock()
-			newParent.mu.Lock()
-		} else {
-			newParent.mu.Lock()
-			parent.mu.Lock()
+		// ancestors first like everywhere else, otherwise by inode
+		// number to prevent deadlock
+		first, second := parent, newParent
+		if newParent.isParentOf(parent) || (!parent.isParentOf(newParent) && op.NewParent < op.OldParent) {
+			first, second = newParent, parent
 		}
-		defer parent.mu.Unlock()
-		defer newParent.mu.Unlock()
+		first.mu.Lock()
+		second.mu.Lock()
+		defer first.mu.Unlock()
+		defer second.mu.Unlock()
 	}
 	oldnode := parent.findChildUnlocked(op.OldName, "")
-	err = parent.Rename(op.OldName, newParent, op.NewName, oldnode)
-	if err != nil {
-		if err == fuse.ENOENT {
-			// if the source doesn't exist, it could be
-			// because this is a new file and we haven't
-			// flushed it yet, pretend that's ok because
-			// when we flush we will handle the rename
-			inode := parent.findChildUnlocked(op.OldName, "")
-			if inode != nil && atomic.LoadUint64(&inode.fileHandles) != 0 {
-				err = nil
-			}
-		}
-	}
-	if err == nil {
-		inode := parent.findChildUnlocked(op.OldName, "")
-		if inode != nil {
-			inode.mu.Lock()
-			defer inode.mu.Unlock()
-
-			parent.removeChildUnlocked(inode)
-
-			newNode := newParent.findChildUnlocked(op.NewName, "")
-			if newNode != nil {
-				// this file's been overwritten, it's
-				// been detached but we can't delete
-				// it just yet, because the kernel
-				// will still send forget ops to us
-				newParent.removeChildUnlocked(newNode)
-				newNode.Parent = nil
-			}
-
-			inode.Name = op.NewName
-			inode.Parent = newParent
-			newParent.insertChildUnlocked(inode)
-		}
+	if oldnode == nil {
+		return fuse.ENOENT
 	}
-
-	return nil
+	return parent.Rename(ctx, op.OldName, newParent, op.NewName, oldnode)
 }
 
 func (fs *AliYunDriveFs) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err error) {
@@ -430,7 +538,20 @@ func (fs *AliYunDriveFs) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err er
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
-	err = parent.RmDir(op.Name)
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == trashName:
+		err = fs.emptyTrash(ctx)
+	case op.Parent == fuseops.RootInodeID && op.Name == starredName:
+		err = syscall.EPERM
+	case parent.inStarred:
+		err = fs.unstar(ctx, parent, op.Name, "folder")
+	case parent.inTrash:
+		err = fs.deleteForever(ctx, parent, op.Name, "folder")
+	default:
+		err = parent.RmDir(ctx, op.Name)
+	}
 	parent.logFuse("<-- RmDir", op.Name, err)
 	return
 }
@@ -440,55 +561,65 @@ func (fs *AliYunDriveFs) Unlink(ctx context.Context, op *fuseops.UnlinkOp) (err
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
-	err = parent.Unlink(op.Name)
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	if parent.isVirtual() {
+		if parent.inStarred {
+			err = fs.unstar(ctx, parent, op.Name, "file")
+		} else {
+			err = fs.deleteForever(ctx, parent, op.Name, "file")
+		}
+	} else {
+		err = parent.Unlink(ctx, op.Name)
+	}
+	parent.logFuse("<-- Unlink", op.Name, err)
 	return
 }
 
+// Destroy sends the deletes still queued before the mount goes away.
+func (fs *AliYunDriveFs) Destroy() {
+	fs.SyncDeletes()
+}
+
 func (h *AliYunDriveFs) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
 	//TODO implement me
 	h.mu.RLock()
 	inode := h.getInodeOrDie(op.Inode)
 	h.mu.RUnlock()
-	inode.OpenDir()
+	op.Handle = h.addDirHandle(inode.OpenDir())
 	return nil
 }
 
 func (h *AliYunDriveFs) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
 	//TODO implement me
 
-	// Find the handle.
-	h.mu.RLock()
-	dh := h.dirHandles[op.Handle]
-	h.mu.RUnlock()
-
-	if dh == nil {
-		panic(fmt.Sprintf("can't find dh=%v", op.Handle))
-	}
-	dh.mu.Lock()
-	defer dh.mu.Unlock()
-	entries, err := dh.ReadDir()
+	dh, err := h.dirHandle(op.Handle)
 	if err != nil {
 		return err
 	}
-	dh.inode.logFuse("ReadDir", len(entries), "Offset:", op.Offset)
-	if op.Offset >= fuseops.DirOffset(uint64(len(entries)-1)) {
-		op.BytesRead = 0
-		return nil
-	} else {
-		for i := op.Offset; ; i++ {
-			if i == fuseops.DirOffset(uint64(len(entries))) {
-				break
-			}
-			entry := entries[i]
-			n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], makeDirEntry(entry))
-			if n == 0 {
-				break
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+	ctx, cancel := h.withOpTimeout(ctx)
+	defer cancel()
+	dh.inode.logFuse("ReadDir", "Offset:", op.Offset)
+	for i := int(op.Offset); ; i++ {
+		entry, err := dh.Entry(ctx, i)
+		if err != nil {
+			if op.BytesRead != 0 {
+				// hand out what we have, the next call fails
+				return nil
 			}
-			dh.inode.logFuse("Entry", "Written:", n)
-			dh.inode.logFuse("<-- ReadDir", entry.Name, entry.Offset)
-			op.BytesRead += n
-
+			return err
 		}
+		if entry == nil {
+			break
+		}
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], makeDirEntry(entry))
+		if n == 0 {
+			break
+		}
+		dh.inode.logFuse("<-- ReadDir", entry.Name, entry.Offset)
+		op.BytesRead += n
 	}
 
 	return nil
@@ -502,20 +633,12 @@ func makeDirEntry(en *DirHandleEntry) fuseutil.Dirent {
 	}
 }
 func (fs *AliYunDriveFs) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	dh := fs.dirHandles[op.Handle]
-	err = dh.CloseDir()
+	dh, err := fs.removeDirHandle(op.Handle)
 	if err != nil {
 		return err
 	}
-
-	fuseLog.Debugln("ReleaseDirHandle", dh.inode.FullName())
-
-	delete(fs.dirHandles, op.Handle)
-
-	return
+	fuseLog.Debugln("ReleaseDirHandle", dh.inode.FullName(), op.Handle)
+	return dh.CloseDir()
 }
 
 func (fs *AliYunDriveFs) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
@@ -528,15 +651,7 @@ func (fs *AliYunDriveFs) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (
 		return
 	}
 
-	fs.mu.Lock()
-
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
-
-	fs.fileHandles[handleID] = fh
-	fs.mu.Unlock()
-
-	op.Handle = handleID
+	op.Handle = fs.addFileHandle(fh)
 
 	in.mu.Lock()
 	defer in.mu.Unlock()
@@ -563,30 +678,35 @@ func (fs *AliYunDriveFs) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (
 
 func (fs *AliYunDriveFs) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
 
-	fs.mu.RLock()
-	fh := fs.fileHandles[op.Handle]
-	fs.mu.RUnlock()
+	fh, err := fs.fileHandle(op.Handle)
+	if err != nil {
+		return
+	}
 
-	op.BytesRead, err = fh.ReadFile(op.Offset, op.Dst)
+	op.BytesRead, err = fh.ReadFile(ctx, op.Offset, op.Dst)
 
 	return
 }
 
 func (fs *AliYunDriveFs) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) (err error) {
-	fs.mu.RLock()
-
-	fh, ok := fs.fileHandles[op.Handle]
-	if !ok {
-		panic(fmt.Sprintf("WriteFile: can't find handle %v", op.Handle))
+	fh, err := fs.fileHandle(op.Handle)
+	if err != nil {
+		return
 	}
-	fs.mu.RUnlock()
 
 	err = fh.WriteFile(op.Offset, op.Data)
 	return
 }
 
+// SyncFile serves fsync and fsyncdir, which waits for the queued deletes
+// and reports one from the folder that failed.
 func (h *AliYunDriveFs) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
-
+	h.mu.RLock()
+	inode := h.getInodeOrDie(op.Inode)
+	h.mu.RUnlock()
+	if inode.isDir() {
+		return h.deletes.SyncDir(inode)
+	}
 	return h.FlushFile(ctx, &fuseops.FlushFileOp{Inode: op.Inode,
 		Handle:    op.Handle,
 		OpContext: op.OpContext})
@@ -594,7 +714,11 @@ func (h *AliYunDriveFs) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) er
 
 func (h *AliYunDriveFs) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
 
-	err := h.fileHandles[op.Handle].FlushFile()
+	fh, err := h.fileHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+	err = fh.FlushFile(ctx)
 	if err != nil {
 		return err
 	}
@@ -603,15 +727,14 @@ func (h *AliYunDriveFs) FlushFile(ctx context.Context, op *fuseops.FlushFileOp)
 }
 
 func (fs *AliYunDriveFs) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	fh := fs.fileHandles[op.Handle]
+	fh, err := fs.removeFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
 	fh.Release()
 
 	fuseLog.Debugln("ReleaseFileHandle", fh.inode.FullName(), op.Handle, fh.inode.Id)
 
-	delete(fs.fileHandles, op.Handle)
-
 	// try to compact heap
 	//fs.bufferPool.MaybeGC()
 	return
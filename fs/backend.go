@@ -0,0 +1,184 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"goaldfuse/aliyun/cache"
+	"goaldfuse/aliyun/model"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// RootFileId is the FileId of the top folder of every Backend.
+const RootFileId = "root"
+
+// Backend is the storage the file system is layered on. Entries are
+// described with the Aliyun Drive model, Type is "folder" or "file".
+//
+// Errors that are a syscall.Errno (ENOENT, EEXIST, ENOTDIR, ...) are passed
+// to the kernel as is, anything else is reported as EIO.
+type Backend interface {
+	// List returns the children of the folder parentId.
+	List(ctx context.Context, parentId string) ([]model.ListModel, error)
+	Stat(ctx context.Context, fileId string) (model.ListModel, error)
+	MkDir(ctx context.Context, parentId string, name string) (model.ListModel, error)
+	// Rename changes the name of fileId within its folder.
+	Rename(ctx context.Context, fileId string, newName string) error
+	// Move puts fileId into the folder newParentId as newName, an entry
+	// there with its old name is left alone.
+	Move(ctx context.Context, fileId string, newParentId string, newName string) error
+	// Delete removes fileId, which sits in parentId, moving it to the
+	// trash where the backend has one.
+	Delete(ctx context.Context, fileId string, parentId string) error
+	// OpenRange reads length bytes of fileId starting at offset, a
+	// negative length reads to the end.
+	OpenRange(ctx context.Context, fileId string, offset int64, length int64) (io.ReadCloser, error)
+	// Upload stores size bytes of f as name in parentId, replacing any
+	// file of that name, and returns the new FileId. f is closed.
+	Upload(ctx context.Context, parentId string, name string, f *os.File, size int64) (string, error)
+	Quota(ctx context.Context) (total uint64, used uint64, err error)
+}
+
+// batchDeleter is implemented by backends that delete many entries in one
+// request. DeleteBatch returns the error of every entry.
+type batchDeleter interface {
+	DeleteBatch(ctx context.Context, entries []deletion) []error
+}
+
+// deletion names an entry to delete and the folder it sits in.
+type deletion struct {
+	FileId   string
+	ParentId string
+}
+
+// revalidator is implemented by backends that may answer a listing from a
+// saved copy. Revalidate lists parentId again in the background if its last
+// listing was such a copy and hands the fresh items to apply.
+type revalidator interface {
+	Revalidate(parentId string, apply func(items []model.ListModel))
+}
+
+// deleteAccepter is implemented by backends that can turn a delete down
+// before it is sent, a read-only one for example. Unlink and rmdir ask
+// first so the error reaches the caller rather than the delete queue.
+type deleteAccepter interface {
+	AcceptDelete(ctx context.Context, fileId string, parentId string) error
+}
+
+// maxBatch is the most requests /v3/batch takes at once.
+const maxBatch = 100
+
+// deleteAll deletes entries in batches where the backend can, one at a
+// time otherwise.
+func deleteAll(ctx context.Context, backend Backend, entries []deletion) []error {
+	if d, ok := backend.(batchDeleter); ok {
+		return d.DeleteBatch(ctx, entries)
+	}
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		errs[i] = backend.Delete(ctx, e.FileId, e.ParentId)
+	}
+	return errs
+}
+
+// recycleBin is implemented by backends whose Delete moves entries to a
+// recycle bin, shown in the mount as trashName.
+type recycleBin interface {
+	// ListTrash returns what is in the recycle bin, the entries inside a
+	// trashed folder are not listed on their own.
+	ListTrash(ctx context.Context) ([]model.ListModel, error)
+	// Restore puts fileId back into parentId, where it was deleted from.
+	Restore(ctx context.Context, fileId string, parentId string) error
+	// DeleteForever removes fileId from the recycle bin.
+	DeleteForever(ctx context.Context, fileId string) error
+	EmptyTrash(ctx context.Context) error
+}
+
+// userMetaStore is implemented by backends that keep the user_meta of an
+// entry, where user extended attributes are stored.
+type userMetaStore interface {
+	SetUserMeta(ctx context.Context, fileId string, userMeta string) error
+}
+
+// symlinker is implemented by backends that can mark an uploaded file as
+// a symlink, through its user_meta, and hide it from the web UI.
+type symlinker interface {
+	MarkSymlink(ctx context.Context, fileId string, userMeta string, hidden bool) error
+}
+
+// starrer is implemented by backends that can star entries, the starred
+// ones are shown in the mount as starredName.
+type starrer interface {
+	// ListStarred returns the starred entries of the whole drive.
+	ListStarred(ctx context.Context) ([]model.ListModel, error)
+	SetStarred(ctx context.Context, fileId string, starred bool) error
+}
+
+// pagedLister is implemented by backends that can list a folder one page
+// at a time. ListPage returns the page starting at marker, the first one
+// for "", and the marker of the next page, "" after the last.
+type pagedLister interface {
+	ListPage(ctx context.Context, parentId string, marker string) ([]model.ListModel, string, error)
+}
+
+// pageCollector puts listings read one page at a time back together, so
+// the complete listing can be cached.
+type pageCollector struct {
+	mu    sync.Mutex
+	pages map[string]*collectedPages
+}
+
+type collectedPages struct {
+	next  string
+	items []model.ListModel
+}
+
+// add records the page of parentId read at marker and returns the complete
+// listing after the last page. A page out of order, from two readers of
+// the same folder, drops what was collected.
+func (pc *pageCollector) add(parentId string, marker string, items []model.ListModel, next string) ([]model.ListModel, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.pages == nil {
+		pc.pages = make(map[string]*collectedPages)
+	}
+	c := pc.pages[parentId]
+	if marker == "" {
+		c = &collectedPages{}
+		pc.pages[parentId] = c
+	} else if c == nil || c.next != marker {
+		delete(pc.pages, parentId)
+		return nil, false
+	}
+	c.items = append(c.items, items...)
+	c.next = next
+	if next != "" {
+		return nil, false
+	}
+	delete(pc.pages, parentId)
+	return c.items, true
+}
+
+// cacheReporter is implemented by backends that cache metadata, the
+// counters are printed next to fs.Stats.
+type cacheReporter interface {
+	CacheStats() []cache.Stats
+}
+
+// backendErr maps an error returned by a Backend to the one handed to the
+// kernel.
+func backendErr(ctx context.Context, err error) error {
+	if e := interruptedErr(ctx); e != nil {
+		return e
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,314 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goaldfuse/aliyun"
+	"goaldfuse/aliyun/cache"
+	"goaldfuse/aliyun/model"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AliyunBackend is the Backend talking to Aliyun Drive through an
+// aliyun.Client. It keeps the access token fresh in the background.
+type AliyunBackend struct {
+	client *aliyun.Client
+	pages  pageCollector
+	// Permanent deletes for good instead of moving to the recycle bin.
+	Permanent bool
+
+	mu     sync.RWMutex
+	config model.Config
+}
+
+func NewAliyunBackend(client *aliyun.Client, config model.Config) *AliyunBackend {
+	b := &AliyunBackend{client: client, config: config}
+	if !client.Replaying {
+		go b.refreshToken()
+	}
+	return b
+}
+
+// Refresh drops the listing of parentId from the client cache.
+func (b *AliyunBackend) Refresh(parentId string) {
+	b.client.Cache.InvalidateDir(parentId)
+}
+
+func (b *AliyunBackend) CacheStats() []cache.Stats {
+	return b.client.Cache.Stats()
+}
+
+func (b *AliyunBackend) Config() model.Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.config
+}
+
+func (b *AliyunBackend) refreshToken() {
+	for {
+		aliLog.Log("Refresh Token")
+		time.Sleep(120 * time.Second)
+		b.Reconnect(context.Background())
+	}
+}
+
+// Reconnect refreshes the access token now, a mount started offline uses
+// it to find out that the API is reachable again.
+func (b *AliyunBackend) Reconnect(ctx context.Context) error {
+	refreshResult := b.client.RefreshToken(ctx, b.Config().RefreshToken)
+	if reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) || refreshResult.AccessToken == "" {
+		return errors.New("refresh token failed")
+	}
+	b.mu.Lock()
+	b.config = model.Config{
+		DriveId:      refreshResult.DefaultDriveId,
+		RefreshToken: refreshResult.RefreshToken,
+		Token:        refreshResult.AccessToken,
+		ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
+	}
+	b.mu.Unlock()
+	err := b.client.SaveRefreshToken(".refresh_token", refreshResult.RefreshToken)
+	if err != nil {
+		fmt.Println("Can't write token file, token will not be able to persist")
+	}
+	return nil
+}
+
+func (b *AliyunBackend) List(ctx context.Context, parentId string) ([]model.ListModel, error) {
+	config := b.Config()
+	list, err := b.client.GetList(ctx, config.Token, config.DriveId, parentId)
+	return list.Items, err
+}
+
+// ListPage reads one page of up to 200 children, the complete listing is
+// cached by the client once the last page has been read.
+func (b *AliyunBackend) ListPage(ctx context.Context, parentId string, marker string) ([]model.ListModel, string, error) {
+	if marker == "" {
+		if cached, ok := b.client.Cache.List(parentId); ok {
+			return cached.Items, "", nil
+		}
+	}
+	config := b.Config()
+	page, err := b.client.GetListPage(ctx, config.Token, config.DriveId, parentId, false, marker)
+	if err != nil {
+		return nil, "", err
+	}
+	if items, ok := b.pages.add(parentId, marker, page.Items, page.NextMarker); ok {
+		b.client.Cache.SetList(parentId, model.FileListModel{Items: items})
+	}
+	return page.Items, page.NextMarker, nil
+}
+
+func (b *AliyunBackend) Stat(ctx context.Context, fileId string) (model.ListModel, error) {
+	config := b.Config()
+	file := b.client.GetFileDetail(ctx, config.Token, config.DriveId, fileId)
+	if file.FileId == "" {
+		if err := ctx.Err(); err != nil {
+			return file, err
+		}
+		return file, syscall.ENOENT
+	}
+	return file, nil
+}
+
+func (b *AliyunBackend) MkDir(ctx context.Context, parentId string, name string) (model.ListModel, error) {
+	config := b.Config()
+	item := b.client.MakeDir(ctx, config.Token, config.DriveId, name, parentId)
+	if item.FileId == "" {
+		return model.ListModel{}, errors.New("mkdir " + name + " failed")
+	}
+	return model.ListModel{
+		DriveId:      item.DriveId,
+		FileId:       item.FileId,
+		Name:         name,
+		Type:         "folder",
+		ParentFileId: item.ParentFileId,
+		UpdatedAt:    time.Now(),
+	}, nil
+}
+
+func (b *AliyunBackend) Rename(ctx context.Context, fileId string, newName string) error {
+	config := b.Config()
+	if !b.client.ReName(ctx, config.Token, config.DriveId, newName, fileId) {
+		return errors.New("rename " + fileId + " failed")
+	}
+	return ctx.Err()
+}
+
+func (b *AliyunBackend) SetUserMeta(ctx context.Context, fileId string, userMeta string) error {
+	config := b.Config()
+	if !b.client.UpdateUserMeta(ctx, config.Token, config.DriveId, fileId, userMeta) {
+		return errors.New("updating user_meta of " + fileId + " failed")
+	}
+	return ctx.Err()
+}
+
+func (b *AliyunBackend) MarkSymlink(ctx context.Context, fileId string, userMeta string, hidden bool) error {
+	config := b.Config()
+	if !b.client.MarkSymlink(ctx, config.Token, config.DriveId, fileId, userMeta, hidden) {
+		return errors.New("marking " + fileId + " as a symlink failed")
+	}
+	return ctx.Err()
+}
+
+func (b *AliyunBackend) Move(ctx context.Context, fileId string, newParentId string, newName string) error {
+	config := b.Config()
+	if !b.client.BatchFile(ctx, config.Token, config.DriveId, fileId, newParentId, newName) {
+		return errors.New("move " + fileId + " failed")
+	}
+	return nil
+}
+
+func (b *AliyunBackend) Delete(ctx context.Context, fileId string, parentId string) error {
+	return b.DeleteBatch(ctx, []deletion{{FileId: fileId, ParentId: parentId}})[0]
+}
+
+// DeleteBatch sends maxBatch entries per request.
+func (b *AliyunBackend) DeleteBatch(ctx context.Context, entries []deletion) []error {
+	config := b.Config()
+	errs := make([]error, len(entries))
+	for start := 0; start < len(entries); start += maxBatch {
+		end := start + maxBatch
+		if end > len(entries) {
+			end = len(entries)
+		}
+		ids := make([]string, 0, end-start)
+		for _, e := range entries[start:end] {
+			ids = append(ids, e.FileId)
+		}
+		done := b.client.BatchDelete(ctx, config.Token, config.DriveId, ids, b.Permanent)
+		for i, ok := range done {
+			e := entries[start+i]
+			b.client.Cache.InvalidateDir(e.ParentId)
+			if !ok {
+				errs[start+i] = errors.New("delete " + e.FileId + " failed")
+				if err := ctx.Err(); err != nil {
+					errs[start+i] = err
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func (b *AliyunBackend) ListTrash(ctx context.Context) ([]model.ListModel, error) {
+	config := b.Config()
+	var items []model.ListModel
+	marker := ""
+	for {
+		list, err := b.client.RecycleBinList(ctx, config.Token, config.DriveId, marker)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+		if list.NextMarker == "" {
+			return items, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (b *AliyunBackend) ListStarred(ctx context.Context) ([]model.ListModel, error) {
+	config := b.Config()
+	var items []model.ListModel
+	marker := ""
+	for {
+		list, err := b.client.SearchStarred(ctx, config.Token, config.DriveId, marker)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+		if list.NextMarker == "" {
+			return items, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (b *AliyunBackend) SetStarred(ctx context.Context, fileId string, starred bool) error {
+	config := b.Config()
+	if !b.client.SetStarred(ctx, config.Token, config.DriveId, fileId, starred) {
+		return errors.New("starring " + fileId + " failed")
+	}
+	return ctx.Err()
+}
+
+func (b *AliyunBackend) Restore(ctx context.Context, fileId string, parentId string) error {
+	config := b.Config()
+	if !b.client.BatchRestore(ctx, config.Token, config.DriveId, []string{fileId})[0] {
+		return errors.New("restore " + fileId + " failed")
+	}
+	b.client.Cache.InvalidateFile(fileId)
+	b.client.Cache.InvalidateDir(parentId)
+	return nil
+}
+
+func (b *AliyunBackend) DeleteForever(ctx context.Context, fileId string) error {
+	config := b.Config()
+	if !b.client.BatchDelete(ctx, config.Token, config.DriveId, []string{fileId}, true)[0] {
+		return errors.New("delete " + fileId + " failed")
+	}
+	return nil
+}
+
+func (b *AliyunBackend) EmptyTrash(ctx context.Context) error {
+	config := b.Config()
+	if !b.client.ClearRecycleBin(ctx, config.Token, config.DriveId) {
+		return errors.New("emptying the recycle bin failed")
+	}
+	return nil
+}
+
+func (b *AliyunBackend) OpenRange(ctx context.Context, fileId string, offset int64, length int64) (io.ReadCloser, error) {
+	config := b.Config()
+	downloadUrl := b.client.GetDownloadUrl(ctx, config.Token, config.DriveId, fileId)
+	if downloadUrl == "" {
+		return nil, errors.New("no download url for " + fileId)
+	}
+	rangeString := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length >= 0 {
+		rangeString += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp := b.client.GetFile(ctx, downloadUrl, config.Token, rangeString)
+	if resp == nil {
+		return nil, errors.New("download " + fileId + " failed")
+	}
+	if resp.StatusCode >= 300 {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("download %v: %v", fileId, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (b *AliyunBackend) Upload(ctx context.Context, parentId string, name string, f *os.File, size int64) (string, error) {
+	config := b.Config()
+	// ContentHandle closes f except for empty files
+	defer f.Close()
+	fileId := b.client.ContentHandle(ctx, f, config.Token, config.DriveId, parentId, name, uint64(size))
+	if fileId == "" {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("upload " + name + " failed")
+	}
+	return fileId, nil
+}
+
+func (b *AliyunBackend) Quota(ctx context.Context) (total uint64, used uint64, err error) {
+	t, u := b.client.GetBoxSize(ctx, b.Config().Token)
+	if total, err = strconv.ParseUint(t, 10, 64); err != nil {
+		return
+	}
+	used, err = strconv.ParseUint(u, 10, 64)
+	return
+}
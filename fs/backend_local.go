@@ -0,0 +1,265 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"goaldfuse/aliyun/model"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// LocalBackend is a Backend serving a directory of the local file system.
+// FileIds are the host inode numbers so they survive renames, the path of
+// every id handed out is remembered as a (parent, name) pair.
+type LocalBackend struct {
+	root string
+
+	mu    sync.Mutex
+	nodes map[string]*localNode
+}
+
+type localNode struct {
+	parent string
+	name   string
+}
+
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	return &LocalBackend{root: root, nodes: make(map[string]*localNode)}, nil
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *LocalBackend) pathUnlocked(id string) (string, error) {
+	var parts []string
+	for id != RootFileId {
+		n, ok := b.nodes[id]
+		if !ok {
+			return "", syscall.ENOENT
+		}
+		parts = append(parts, n.name)
+		id = n.parent
+	}
+	path := b.root
+	for i := len(parts) - 1; i >= 0; i-- {
+		path = filepath.Join(path, parts[i])
+	}
+	return path, nil
+}
+
+func (b *LocalBackend) path(id string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pathUnlocked(id)
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *LocalBackend) entryUnlocked(parentId string, fi os.FileInfo) model.ListModel {
+	id := strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Ino), 10)
+	b.nodes[id] = &localNode{parent: parentId, name: fi.Name()}
+	m := model.ListModel{
+		FileId:       id,
+		Name:         fi.Name(),
+		Type:         "file",
+		ParentFileId: parentId,
+		Size:         fi.Size(),
+		UpdatedAt:    fi.ModTime(),
+		CreatedAt:    fi.ModTime(),
+	}
+	if fi.IsDir() {
+		m.Type = "folder"
+		m.Size = 0
+	}
+	return m
+}
+
+func (b *LocalBackend) List(ctx context.Context, parentId string) ([]model.ListModel, error) {
+	dir, err := b.path(parentId)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := make([]model.ListModel, 0, len(infos))
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() || fi.IsDir() {
+			items = append(items, b.entryUnlocked(parentId, fi))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (b *LocalBackend) Stat(ctx context.Context, fileId string) (model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path, err := b.pathUnlocked(fileId)
+	if err != nil {
+		return model.ListModel{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return model.ListModel{}, err
+	}
+	if fileId == RootFileId {
+		return model.ListModel{FileId: RootFileId, Name: "root", Type: "folder", UpdatedAt: fi.ModTime()}, nil
+	}
+	return b.entryUnlocked(b.nodes[fileId].parent, fi), nil
+}
+
+func (b *LocalBackend) MkDir(ctx context.Context, parentId string, name string) (model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dir, err := b.pathUnlocked(parentId)
+	if err != nil {
+		return model.ListModel{}, err
+	}
+	path := filepath.Join(dir, name)
+	if err = os.Mkdir(path, 0755); err != nil {
+		return model.ListModel{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return model.ListModel{}, err
+	}
+	return b.entryUnlocked(parentId, fi), nil
+}
+
+func (b *LocalBackend) Rename(ctx context.Context, fileId string, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path, err := b.pathUnlocked(fileId)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path, filepath.Join(filepath.Dir(path), newName)); err != nil {
+		return err
+	}
+	b.nodes[fileId].name = newName
+	return nil
+}
+
+func (b *LocalBackend) Move(ctx context.Context, fileId string, newParentId string, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path, err := b.pathUnlocked(fileId)
+	if err != nil {
+		return err
+	}
+	dir, err := b.pathUnlocked(newParentId)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, newName)
+	if _, err = os.Lstat(target); err == nil {
+		return syscall.EEXIST
+	}
+	if err = os.Rename(path, target); err != nil {
+		return err
+	}
+	b.nodes[fileId].parent = newParentId
+	b.nodes[fileId].name = newName
+	return nil
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, fileId string, parentId string) error {
+	if fileId == RootFileId {
+		return syscall.EPERM
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path, err := b.pathUnlocked(fileId)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(path); err != nil {
+		return err
+	}
+	delete(b.nodes, fileId)
+	return nil
+}
+
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.f.Close()
+}
+
+func (b *LocalBackend) OpenRange(ctx context.Context, fileId string, offset int64, length int64) (io.ReadCloser, error) {
+	path, err := b.path(fileId)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(f, length), f: f}, nil
+}
+
+func (b *LocalBackend) Upload(ctx context.Context, parentId string, name string, f *os.File, size int64) (string, error) {
+	defer f.Close()
+	dir, err := b.path(parentId)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(f, 0, size))
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	fi, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.entryUnlocked(parentId, fi).FileId, nil
+}
+
+func (b *LocalBackend) Quota(ctx context.Context) (total uint64, used uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(b.root, &st); err != nil {
+		return
+	}
+	total = st.Blocks * uint64(st.Bsize)
+	used = total - st.Bfree*uint64(st.Bsize)
+	return
+}
@@ -0,0 +1,360 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"goaldfuse/aliyun/model"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemoryBackend is a Backend keeping everything in memory, for tests and for
+// trying out the FUSE layer without an account.
+type MemoryBackend struct {
+	// Total is the quota reported by Quota.
+	Total uint64
+	// PageSize makes ListPage return pages of that many children, zero
+	// for the whole listing at once.
+	PageSize int
+
+	mu     sync.Mutex
+	nextId uint64
+	files  map[string]*memFile
+}
+
+type memFile struct {
+	model.ListModel
+	data []byte
+	// trashed entries are in the recycle bin, along with what they hold.
+	trashed bool
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{Total: 1 << 40, files: make(map[string]*memFile)}
+	b.files[RootFileId] = &memFile{ListModel: model.ListModel{
+		FileId:    RootFileId,
+		Name:      "root",
+		Type:      "folder",
+		UpdatedAt: time.Now(),
+	}}
+	return b
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *MemoryBackend) childUnlocked(parentId string, name string) *memFile {
+	for _, f := range b.files {
+		if f.ParentFileId == parentId && f.Name == name && f.FileId != RootFileId && !f.trashed {
+			return f
+		}
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *MemoryBackend) folderUnlocked(id string) (*memFile, error) {
+	f, ok := b.files[id]
+	if !ok || f.trashed {
+		return nil, syscall.ENOENT
+	}
+	if f.Type != "folder" {
+		return nil, syscall.ENOTDIR
+	}
+	return f, nil
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *MemoryBackend) addUnlocked(parentId string, name string, typ string, data []byte) *memFile {
+	b.nextId++
+	f := &memFile{ListModel: model.ListModel{
+		FileId:       "mem-" + strconv.FormatUint(b.nextId, 10),
+		Name:         name,
+		Type:         typ,
+		ParentFileId: parentId,
+		Size:         int64(len(data)),
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}, data: data}
+	if typ == "file" {
+		sum := sha1.Sum(data)
+		f.ContentHash = strings.ToUpper(hex.EncodeToString(sum[:]))
+		f.ContentHashName = "sha1"
+	}
+	b.files[f.FileId] = f
+	return f
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *MemoryBackend) removeUnlocked(id string) {
+	for _, f := range b.files {
+		if f.ParentFileId == id && f.FileId != RootFileId {
+			b.removeUnlocked(f.FileId)
+		}
+	}
+	delete(b.files, id)
+}
+
+func (b *MemoryBackend) List(ctx context.Context, parentId string) ([]model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.folderUnlocked(parentId); err != nil {
+		return nil, err
+	}
+	items := make([]model.ListModel, 0)
+	for _, f := range b.files {
+		if f.ParentFileId == parentId && f.FileId != RootFileId && !f.trashed {
+			items = append(items, f.ListModel)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (b *MemoryBackend) ListPage(ctx context.Context, parentId string, marker string) ([]model.ListModel, string, error) {
+	items, err := b.List(ctx, parentId)
+	if err != nil || b.PageSize <= 0 {
+		return items, "", err
+	}
+	start, _ := strconv.Atoi(marker)
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + b.PageSize
+	if end >= len(items) {
+		return items[start:], "", nil
+	}
+	return items[start:end], strconv.Itoa(end), nil
+}
+
+func (b *MemoryBackend) Stat(ctx context.Context, fileId string) (model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok {
+		return model.ListModel{}, syscall.ENOENT
+	}
+	return f.ListModel, nil
+}
+
+func (b *MemoryBackend) MkDir(ctx context.Context, parentId string, name string) (model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.folderUnlocked(parentId); err != nil {
+		return model.ListModel{}, err
+	}
+	if b.childUnlocked(parentId, name) != nil {
+		return model.ListModel{}, syscall.EEXIST
+	}
+	return b.addUnlocked(parentId, name, "folder", nil).ListModel, nil
+}
+
+func (b *MemoryBackend) Rename(ctx context.Context, fileId string, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if other := b.childUnlocked(f.ParentFileId, newName); other != nil && other != f {
+		return syscall.EEXIST
+	}
+	f.Name = newName
+	f.UpdatedAt = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) SetUserMeta(ctx context.Context, fileId string, userMeta string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok || fileId == RootFileId {
+		return syscall.ENOENT
+	}
+	f.UserMeta = userMeta
+	f.UpdatedAt = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) MarkSymlink(ctx context.Context, fileId string, userMeta string, hidden bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok || f.Type == "folder" {
+		return syscall.ENOENT
+	}
+	f.UserMeta = userMeta
+	f.Hidden = hidden
+	f.UpdatedAt = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) ListStarred(ctx context.Context) ([]model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := make([]model.ListModel, 0)
+	for _, f := range b.files {
+		if f.Starred && !f.trashed {
+			items = append(items, f.ListModel)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (b *MemoryBackend) SetStarred(ctx context.Context, fileId string, starred bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok || fileId == RootFileId {
+		return syscall.ENOENT
+	}
+	f.Starred = starred
+	f.UpdatedAt = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) Move(ctx context.Context, fileId string, newParentId string, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if _, err := b.folderUnlocked(newParentId); err != nil {
+		return err
+	}
+	for p := newParentId; p != RootFileId; p = b.files[p].ParentFileId {
+		if p == fileId {
+			return syscall.EINVAL
+		}
+	}
+	if other := b.childUnlocked(newParentId, newName); other != nil && other != f {
+		return syscall.EEXIST
+	}
+	f.ParentFileId = newParentId
+	f.Name = newName
+	f.UpdatedAt = time.Now()
+	return nil
+}
+
+// Delete moves fileId to the recycle bin.
+func (b *MemoryBackend) Delete(ctx context.Context, fileId string, parentId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok || f.trashed || fileId == RootFileId {
+		return syscall.ENOENT
+	}
+	f.trashed = true
+	return nil
+}
+
+func (b *MemoryBackend) ListTrash(ctx context.Context) ([]model.ListModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := make([]model.ListModel, 0)
+	for _, f := range b.files {
+		if f.trashed {
+			items = append(items, f.ListModel)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].FileId < items[j].FileId })
+	return items, nil
+}
+
+func (b *MemoryBackend) Restore(ctx context.Context, fileId string, parentId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok || !f.trashed {
+		return syscall.ENOENT
+	}
+	if b.childUnlocked(f.ParentFileId, f.Name) != nil {
+		return syscall.EEXIST
+	}
+	f.trashed = false
+	return nil
+}
+
+func (b *MemoryBackend) DeleteForever(ctx context.Context, fileId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[fileId]; !ok || fileId == RootFileId {
+		return syscall.ENOENT
+	}
+	b.removeUnlocked(fileId)
+	return nil
+}
+
+func (b *MemoryBackend) EmptyTrash(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, f := range b.files {
+		if f.trashed {
+			b.removeUnlocked(id)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) OpenRange(ctx context.Context, fileId string, offset int64, length int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[fileId]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if f.Type == "folder" {
+		return nil, syscall.EISDIR
+	}
+	data := f.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *MemoryBackend) Upload(ctx context.Context, parentId string, name string, f *os.File, size int64) (string, error) {
+	defer f.Close()
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.folderUnlocked(parentId); err != nil {
+		return "", err
+	}
+	if old := b.childUnlocked(parentId, name); old != nil {
+		if old.Type == "folder" {
+			return "", syscall.EISDIR
+		}
+		b.removeUnlocked(old.FileId)
+	}
+	return b.addUnlocked(parentId, name, "file", data).FileId, nil
+}
+
+func (b *MemoryBackend) Quota(ctx context.Context) (total uint64, used uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.files {
+		used += uint64(len(f.data))
+	}
+	return b.Total, used, nil
+}
@@ -0,0 +1,574 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"goaldfuse/aliyun/model"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PersistentBackend keeps the listings and file details of another Backend
+// in a MetaDB so a restarted mount can show the tree right away. Anything
+// found in the db is served at once the first time it is asked for after
+// the start. File details are revalidated in the background right away,
+// listings once the file system asks for it through Revalidate, so the
+// fresh listing can be merged into the cached one.
+//
+// While the backend is unreachable the mount is read-only and served from
+// the db alone, a background probe switches it back once the backend
+// answers again.
+type PersistentBackend struct {
+	Backend
+	db *MetaDB
+	// prefix separates the drives sharing one db.
+	prefix string
+
+	mu sync.Mutex
+	// fresh holds the keys already revalidated since the start.
+	fresh map[string]bool
+	// stale holds the folders whose listing was served from the db and
+	// not fetched again since.
+	stale map[string]bool
+	// revalidations bounds the background refreshes.
+	revalidations chan struct{}
+
+	offline int32
+	probing int32
+
+	// ctx is cancelled by Close, which waits on wg for the background
+	// revalidations and probes before closing the db.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	pages pageCollector
+}
+
+const (
+	// lastDriveKey names the drive the db was last used with, so a mount
+	// started without network knows which records to serve.
+	lastDriveKey    = "drive"
+	quotaKey        = "quota"
+	probeInterval   = 30 * time.Second
+	probeTimeout    = 20 * time.Second
+	maxRevalidating = 4
+)
+
+// reconnecter is implemented by backends that need more than a successful
+// request to come back online, such as a fresh access token.
+type reconnecter interface {
+	Reconnect(ctx context.Context) error
+}
+
+// NewPersistentBackend serves the records of driveId from db on top of
+// inner. A backend created offline starts probing right away.
+func NewPersistentBackend(inner Backend, db *MetaDB, driveId string, offline bool) *PersistentBackend {
+	b := &PersistentBackend{
+		Backend:       inner,
+		db:            db,
+		prefix:        driveId + "/",
+		fresh:         make(map[string]bool),
+		stale:         make(map[string]bool),
+		revalidations: make(chan struct{}, maxRevalidating),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	if offline {
+		b.goOffline()
+	} else if err := db.Put(lastDriveKey, []byte(driveId)); err != nil {
+		aliLog.Errorln("saving metadata", err)
+	}
+	return b
+}
+
+// LastDriveId returns the drive db was last used with.
+func LastDriveId(db *MetaDB) string {
+	v, _ := db.Get(lastDriveKey)
+	return string(v)
+}
+
+// Close stops the background work and closes the db.
+func (b *PersistentBackend) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return b.db.Close()
+}
+
+func (b *PersistentBackend) Offline() bool {
+	return atomic.LoadInt32(&b.offline) != 0
+}
+
+func (b *PersistentBackend) goOffline() {
+	if atomic.CompareAndSwapInt32(&b.offline, 0, 1) {
+		aliLog.Warnln("backend unreachable, serving the saved metadata read-only")
+	}
+	if atomic.CompareAndSwapInt32(&b.probing, 0, 1) {
+		b.wg.Add(1)
+		go b.probe()
+	}
+}
+
+func (b *PersistentBackend) probe() {
+	defer b.wg.Done()
+	defer atomic.StoreInt32(&b.probing, 0)
+	for {
+		ctx, cancel := context.WithTimeout(b.ctx, probeTimeout)
+		var err error
+		if r, ok := b.Backend.(reconnecter); ok {
+			err = r.Reconnect(ctx)
+		} else {
+			_, _, err = b.Backend.Quota(ctx)
+		}
+		cancel()
+		if err == nil {
+			atomic.StoreInt32(&b.offline, 0)
+			aliLog.Infoln("backend reachable again")
+			return
+		}
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// failed decides, after a request to the backend failed, whether that is
+// because it is unreachable.
+func (b *PersistentBackend) failed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if _, ok := err.(syscall.Errno); ok {
+		return
+	}
+	pctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if _, _, e := b.Backend.Quota(pctx); e != nil {
+		b.goOffline()
+	}
+}
+
+func (b *PersistentBackend) listKey(parentId string) string {
+	return b.prefix + "l/" + parentId
+}
+
+func (b *PersistentBackend) fileKey(fileId string) string {
+	return b.prefix + "f/" + fileId
+}
+
+// firstUse reports whether key is asked for the first time since the start
+// and marks it revalidated.
+func (b *PersistentBackend) firstUse(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fresh[key] {
+		return false
+	}
+	b.fresh[key] = true
+	return true
+}
+
+// revalidate runs f in the background unless too many refreshes are
+// already going on, the saved record is served and revalidated again on
+// the next use then, as it is when f fails.
+func (b *PersistentBackend) revalidate(key string, f func(ctx context.Context) error) {
+	select {
+	case b.revalidations <- struct{}{}:
+	default:
+		b.mu.Lock()
+		delete(b.fresh, key)
+		b.mu.Unlock()
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.revalidations }()
+		ctx, cancel := context.WithTimeout(b.ctx, 2*time.Minute)
+		defer cancel()
+		if err := f(ctx); err != nil {
+			b.mu.Lock()
+			delete(b.fresh, key)
+			b.mu.Unlock()
+		}
+	}()
+}
+
+func (b *PersistentBackend) savedFile(fileId string) (model.ListModel, bool) {
+	var item model.ListModel
+	v, ok := b.db.Get(b.fileKey(fileId))
+	if !ok || json.Unmarshal(v, &item) != nil {
+		return item, false
+	}
+	return item, true
+}
+
+func (b *PersistentBackend) saveFile(item model.ListModel) {
+	// the urls expire long before the next start
+	item.DownloadUrl, item.Url, item.Thumbnail = "", "", ""
+	v, err := json.Marshal(item)
+	if err == nil {
+		err = b.db.Put(b.fileKey(item.FileId), v)
+	}
+	if err != nil {
+		aliLog.Errorln("saving metadata", err)
+	}
+}
+
+func (b *PersistentBackend) savedList(parentId string) ([]model.ListModel, bool) {
+	var ids []string
+	v, ok := b.db.Get(b.listKey(parentId))
+	if !ok || json.Unmarshal(v, &ids) != nil {
+		return nil, false
+	}
+	items := make([]model.ListModel, 0, len(ids))
+	for _, id := range ids {
+		// a child whose record went missing is dropped, not the listing
+		if item, ok := b.savedFile(id); ok {
+			items = append(items, item)
+		}
+	}
+	return items, true
+}
+
+func (b *PersistentBackend) saveList(parentId string, items []model.ListModel) {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.FileId
+		b.saveFile(item)
+	}
+	v, err := json.Marshal(ids)
+	if err == nil {
+		err = b.db.Put(b.listKey(parentId), v)
+	}
+	if err != nil {
+		aliLog.Errorln("saving metadata", err)
+	}
+}
+
+// forget drops the saved records a change to fileId makes stale.
+func (b *PersistentBackend) forget(fileId string) {
+	if item, ok := b.savedFile(fileId); ok {
+		b.db.Delete(b.listKey(item.ParentFileId))
+	}
+	b.db.Delete(b.fileKey(fileId))
+	b.db.Delete(b.listKey(fileId))
+}
+
+func (b *PersistentBackend) List(ctx context.Context, parentId string) ([]model.ListModel, error) {
+	if b.Offline() {
+		if items, ok := b.savedList(parentId); ok {
+			return items, nil
+		}
+		return nil, syscall.EIO
+	}
+	if items, ok := b.savedFirst(parentId); ok {
+		return items, nil
+	}
+	items, err := b.fetchList(ctx, parentId)
+	if err != nil {
+		b.failed(ctx, err)
+		if saved, ok := b.savedList(parentId); ok && b.Offline() {
+			return saved, nil
+		}
+	}
+	return items, err
+}
+
+// ListPage pages through the backend once the saved listing has been
+// served, saving the listing after its last page.
+func (b *PersistentBackend) ListPage(ctx context.Context, parentId string, marker string) ([]model.ListModel, string, error) {
+	p, ok := b.Backend.(pagedLister)
+	if !ok || b.Offline() {
+		items, err := b.List(ctx, parentId)
+		return items, "", err
+	}
+	if marker == "" {
+		if items, ok := b.savedFirst(parentId); ok {
+			return items, "", nil
+		}
+	}
+	items, next, err := p.ListPage(ctx, parentId, marker)
+	if err != nil {
+		b.failed(ctx, err)
+		if saved, ok := b.savedList(parentId); ok && b.Offline() && marker == "" {
+			return saved, "", nil
+		}
+		return nil, "", err
+	}
+	if full, ok := b.pages.add(parentId, marker, items, next); ok {
+		b.saveList(parentId, full)
+	}
+	return items, next, nil
+}
+
+func (b *PersistentBackend) Refresh(parentId string) {
+	if r, ok := b.Backend.(refresher); ok {
+		r.Refresh(parentId)
+	}
+}
+
+// savedFirst serves the saved listing of parentId the first time it is
+// asked for since the start, marking it stale until it is fetched again.
+func (b *PersistentBackend) savedFirst(parentId string) ([]model.ListModel, bool) {
+	if !b.firstUse(b.listKey(parentId)) {
+		return nil, false
+	}
+	items, ok := b.savedList(parentId)
+	if ok {
+		b.mu.Lock()
+		b.stale[parentId] = true
+		b.mu.Unlock()
+	}
+	return items, ok
+}
+
+// Revalidate fetches the listing of parentId again in the background if it
+// was last served from the db, handing the fresh items to apply.
+func (b *PersistentBackend) Revalidate(parentId string, apply func(items []model.ListModel)) {
+	b.mu.Lock()
+	stale := b.stale[parentId]
+	delete(b.stale, parentId)
+	b.mu.Unlock()
+	if !stale {
+		return
+	}
+	b.revalidate(b.listKey(parentId), func(ctx context.Context) error {
+		items, err := b.fetchList(ctx, parentId)
+		if err == nil {
+			apply(items)
+		}
+		return err
+	})
+}
+
+func (b *PersistentBackend) fetchList(ctx context.Context, parentId string) ([]model.ListModel, error) {
+	items, err := b.Backend.List(ctx, parentId)
+	if err == nil {
+		b.mu.Lock()
+		delete(b.stale, parentId)
+		b.mu.Unlock()
+		b.saveList(parentId, items)
+	}
+	return items, err
+}
+
+func (b *PersistentBackend) Stat(ctx context.Context, fileId string) (model.ListModel, error) {
+	if b.Offline() {
+		if item, ok := b.savedFile(fileId); ok {
+			return item, nil
+		}
+		return model.ListModel{}, syscall.EIO
+	}
+	key := b.fileKey(fileId)
+	if b.firstUse(key) {
+		if item, ok := b.savedFile(fileId); ok {
+			b.revalidate(key, func(ctx context.Context) error {
+				_, err := b.fetchFile(ctx, fileId)
+				return err
+			})
+			return item, nil
+		}
+	}
+	item, err := b.fetchFile(ctx, fileId)
+	if err != nil {
+		b.failed(ctx, err)
+		if saved, ok := b.savedFile(fileId); ok && b.Offline() {
+			return saved, nil
+		}
+	}
+	return item, err
+}
+
+func (b *PersistentBackend) fetchFile(ctx context.Context, fileId string) (model.ListModel, error) {
+	item, err := b.Backend.Stat(ctx, fileId)
+	if err == nil {
+		b.saveFile(item)
+	} else if err == syscall.ENOENT {
+		b.forget(fileId)
+	}
+	return item, err
+}
+
+func (b *PersistentBackend) MkDir(ctx context.Context, parentId string, name string) (model.ListModel, error) {
+	if b.Offline() {
+		return model.ListModel{}, syscall.EROFS
+	}
+	item, err := b.Backend.MkDir(ctx, parentId, name)
+	b.db.Delete(b.listKey(parentId))
+	if err == nil {
+		b.saveFile(item)
+	}
+	return item, err
+}
+
+func (b *PersistentBackend) Rename(ctx context.Context, fileId string, newName string) error {
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	return b.Backend.Rename(ctx, fileId, newName)
+}
+
+func (b *PersistentBackend) SetUserMeta(ctx context.Context, fileId string, userMeta string) error {
+	s, ok := b.Backend.(userMetaStore)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	return s.SetUserMeta(ctx, fileId, userMeta)
+}
+
+func (b *PersistentBackend) MarkSymlink(ctx context.Context, fileId string, userMeta string, hidden bool) error {
+	s, ok := b.Backend.(symlinker)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	return s.MarkSymlink(ctx, fileId, userMeta, hidden)
+}
+
+func (b *PersistentBackend) ListStarred(ctx context.Context) ([]model.ListModel, error) {
+	s, ok := b.Backend.(starrer)
+	if !ok || b.Offline() {
+		return nil, syscall.EIO
+	}
+	return s.ListStarred(ctx)
+}
+
+func (b *PersistentBackend) SetStarred(ctx context.Context, fileId string, starred bool) error {
+	s, ok := b.Backend.(starrer)
+	if !ok || b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	return s.SetStarred(ctx, fileId, starred)
+}
+
+func (b *PersistentBackend) Move(ctx context.Context, fileId string, newParentId string, newName string) error {
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	b.db.Delete(b.listKey(newParentId))
+	return b.Backend.Move(ctx, fileId, newParentId, newName)
+}
+
+func (b *PersistentBackend) Delete(ctx context.Context, fileId string, parentId string) error {
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	b.db.Delete(b.listKey(parentId))
+	return b.Backend.Delete(ctx, fileId, parentId)
+}
+
+func (b *PersistentBackend) AcceptDelete(ctx context.Context, fileId string, parentId string) error {
+	if b.Offline() {
+		return syscall.EROFS
+	}
+	if a, ok := b.Backend.(deleteAccepter); ok {
+		return a.AcceptDelete(ctx, fileId, parentId)
+	}
+	return nil
+}
+
+func (b *PersistentBackend) DeleteBatch(ctx context.Context, entries []deletion) []error {
+	if b.Offline() {
+		errs := make([]error, len(entries))
+		for i := range errs {
+			errs[i] = syscall.EROFS
+		}
+		return errs
+	}
+	for _, e := range entries {
+		b.forget(e.FileId)
+		b.db.Delete(b.listKey(e.ParentId))
+	}
+	return deleteAll(ctx, b.Backend, entries)
+}
+
+func (b *PersistentBackend) ListTrash(ctx context.Context) ([]model.ListModel, error) {
+	r, ok := b.Backend.(recycleBin)
+	if !ok || b.Offline() {
+		return nil, syscall.EIO
+	}
+	return r.ListTrash(ctx)
+}
+
+func (b *PersistentBackend) Restore(ctx context.Context, fileId string, parentId string) error {
+	r, ok := b.Backend.(recycleBin)
+	if !ok || b.Offline() {
+		return syscall.EROFS
+	}
+	b.db.Delete(b.listKey(parentId))
+	return r.Restore(ctx, fileId, parentId)
+}
+
+func (b *PersistentBackend) DeleteForever(ctx context.Context, fileId string) error {
+	r, ok := b.Backend.(recycleBin)
+	if !ok || b.Offline() {
+		return syscall.EROFS
+	}
+	b.forget(fileId)
+	return r.DeleteForever(ctx, fileId)
+}
+
+func (b *PersistentBackend) EmptyTrash(ctx context.Context) error {
+	r, ok := b.Backend.(recycleBin)
+	if !ok || b.Offline() {
+		return syscall.EROFS
+	}
+	return r.EmptyTrash(ctx)
+}
+
+func (b *PersistentBackend) OpenRange(ctx context.Context, fileId string, offset int64, length int64) (io.ReadCloser, error) {
+	if b.Offline() {
+		return nil, syscall.EIO
+	}
+	return b.Backend.OpenRange(ctx, fileId, offset, length)
+}
+
+func (b *PersistentBackend) Upload(ctx context.Context, parentId string, name string, f *os.File, size int64) (string, error) {
+	if b.Offline() {
+		f.Close()
+		return "", syscall.EROFS
+	}
+	b.db.Delete(b.listKey(parentId))
+	return b.Backend.Upload(ctx, parentId, name, f, size)
+}
+
+// Quota answers with the last known numbers while offline, df keeps
+// working.
+func (b *PersistentBackend) Quota(ctx context.Context) (total uint64, used uint64, err error) {
+	var saved [2]uint64
+	if b.Offline() {
+		v, ok := b.db.Get(b.prefix + quotaKey)
+		if !ok || json.Unmarshal(v, &saved) != nil {
+			return 0, 0, syscall.EIO
+		}
+		return saved[0], saved[1], nil
+	}
+	total, used, err = b.Backend.Quota(ctx)
+	if err == nil {
+		saved[0], saved[1] = total, used
+		if v, e := json.Marshal(saved); e == nil {
+			b.db.Put(b.prefix+quotaKey, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// TestPersistentRevalidation restarts on a db whose listing of the root
+// misses a folder made remotely since. The saved listing is served first,
+// the folder shows up once it has been revalidated, without polling.
+func TestPersistentRevalidation(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMetaDB(filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := NewMemoryBackend()
+	if _, err = inner.MkDir(ctx, RootFileId, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewPersistentBackend(inner, db, "mem", false).List(ctx, RootFileId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = inner.MkDir(ctx, RootFileId, "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewPersistentBackend(inner, db, "mem", false)
+	defer b.Close()
+	fs := NewAliYunDriveFs(b, nil)
+	if err = fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err = fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "new"})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lookup of the remotely made folder: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
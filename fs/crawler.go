@@ -0,0 +1,272 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"goaldfuse/aliyun/net"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Crawler walks the drive breadth-first in the background so that find,
+// du and search tools don't wait for every directory to be listed. The
+// listings fill the backend's caches and, while the directories are
+// cached and there is room, the inode table, without pushing out the
+// listings the user works with. Once a directory has been evicted from
+// the inode table its subtree is still listed, warming only the backend.
+// Its requests are background work under the API rate limit, see
+// net.Background.
+type Crawler struct {
+	fs      *AliYunDriveFs
+	roots   []string
+	workers int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []crawlDir
+	inflight int
+	paused   bool
+	progress CrawlProgress
+}
+
+type crawlDir struct {
+	fileId string
+	path   string
+	// inode is the cached directory, nil once it left the inode table.
+	inode *Inode
+}
+
+// CrawlProgress is a snapshot of what the crawler has done.
+type CrawlProgress struct {
+	Dirs     uint64
+	Files    uint64
+	Queued   int
+	Errors   uint64
+	Paused   bool
+	Started  time.Time
+	Finished time.Time
+}
+
+// NewCrawler crawls the subtrees at roots, slash separated paths from the
+// top of the mount, listing over workers goroutines.
+func NewCrawler(fs *AliYunDriveFs, roots []string, workers int) *Crawler {
+	c := &Crawler{fs: fs, roots: roots, workers: workers}
+	if c.workers <= 0 {
+		c.workers = 1
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Run crawls until everything is listed or ctx is done.
+func (c *Crawler) Run(ctx context.Context) {
+	ctx = net.Background(ctx)
+	c.mu.Lock()
+	c.progress.Started = time.Now()
+	c.mu.Unlock()
+	for _, root := range c.roots {
+		dir, err := c.fs.resolveDir(ctx, root)
+		if err != nil {
+			fuseLog.Warnln("prefetch", root, err)
+			c.mu.Lock()
+			c.progress.Errors++
+			c.mu.Unlock()
+			continue
+		}
+		c.push(crawlDir{fileId: dir.FileId, path: dir.FullName(), inode: dir})
+	}
+
+	// wake up the workers waiting for work or a resume
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	c.progress.Finished = time.Now()
+	p := c.progress
+	c.mu.Unlock()
+	fuseLog.Infof("prefetch done, %v dirs and %v files in %v", p.Dirs, p.Files, p.Finished.Sub(p.Started))
+}
+
+func (c *Crawler) push(d crawlDir) {
+	c.mu.Lock()
+	c.queue = append(c.queue, d)
+	c.cond.Signal()
+	c.mu.Unlock()
+}
+
+// next waits for a directory to list, false once the crawl is over.
+func (c *Crawler) next(ctx context.Context) (crawlDir, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ctx.Err() == nil && (c.paused || (len(c.queue) == 0 && c.inflight != 0)) {
+		c.cond.Wait()
+	}
+	if ctx.Err() != nil || len(c.queue) == 0 {
+		// wake the others up to finish too
+		c.cond.Broadcast()
+		return crawlDir{}, false
+	}
+	d := c.queue[0]
+	c.queue[0] = crawlDir{}
+	c.queue = c.queue[1:]
+	c.inflight++
+	return d, true
+}
+
+func (c *Crawler) work(ctx context.Context) {
+	for {
+		d, ok := c.next(ctx)
+		if !ok {
+			return
+		}
+		subdirs, files, err := c.list(ctx, d)
+
+		c.mu.Lock()
+		c.inflight--
+		if err != nil {
+			if ctx.Err() == nil {
+				fuseLog.Warnln("prefetch", d.path, err)
+			}
+			c.progress.Errors++
+		} else {
+			c.progress.Dirs++
+			c.progress.Files += files
+			c.queue = append(c.queue, subdirs...)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// list fetches one directory and returns its subdirectories.
+func (c *Crawler) list(ctx context.Context, d crawlDir) (subdirs []crawlDir, files uint64, err error) {
+	items, err := c.fs.backend.List(ctx, d.fileId)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, item := range items {
+		if item.Type != "folder" {
+			files++
+		}
+	}
+
+	var children []*Inode
+	live := false
+	if dir := d.inode; dir != nil {
+		dir.mu.Lock()
+		// an evicted directory would keep the merged inodes forever, as
+		// would one whose listing doesn't fit in the cache any more
+		if live = c.fs.live(dir) && c.fs.warmListing(dir); live {
+			children = dir.mergeListingUnlocked(items)
+		}
+		dir.mu.Unlock()
+	}
+	if live {
+		c.fs.revalidate(d.inode)
+		for _, child := range children {
+			if child.isDir() {
+				subdirs = append(subdirs, crawlDir{fileId: child.FileId, path: d.path + "/" + child.Name, inode: child})
+			}
+		}
+		return
+	}
+	for _, item := range items {
+		if item.Type == "folder" {
+			subdirs = append(subdirs, crawlDir{fileId: item.FileId, path: d.path + "/" + item.Name})
+		}
+	}
+	return
+}
+
+func (c *Crawler) Pause() {
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+	fuseLog.Infoln("prefetch paused")
+}
+
+func (c *Crawler) Resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	fuseLog.Infoln("prefetch resumed")
+}
+
+// TogglePause pauses a running crawl or resumes a paused one.
+func (c *Crawler) TogglePause() {
+	c.mu.Lock()
+	paused := c.paused
+	c.mu.Unlock()
+	if paused {
+		c.Resume()
+	} else {
+		c.Pause()
+	}
+}
+
+func (c *Crawler) Progress() CrawlProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.progress
+	p.Queued = len(c.queue) + c.inflight
+	p.Paused = c.paused
+	return p
+}
+
+// live reports whether inode is still in the inode table.
+func (fs *AliYunDriveFs) live(inode *Inode) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.inodes[inode.Id] == inode
+}
+
+// resolveDir finds the directory at p, listing the directories on the way
+// that aren't cached.
+func (fs *AliYunDriveFs) resolveDir(ctx context.Context, p string) (*Inode, error) {
+	fs.mu.RLock()
+	dir := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if err := fs.ensureListed(ctx, dir); err != nil {
+			return nil, err
+		}
+		dir.mu.Lock()
+		child := dir.findChildUnlocked(name, "folder")
+		dir.mu.Unlock()
+		if child == nil {
+			return nil, fuse.ENOENT
+		}
+		dir = child
+	}
+	return dir, nil
+}
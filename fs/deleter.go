@@ -0,0 +1,248 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"goaldfuse/aliyun/model"
+)
+
+// Deletes are written behind: once the backend accepted it, unlink and
+// rmdir take the entry out of the inode tree right away and queue the
+// remote delete, which goes out in batches of up to maxBatch entries.
+// rm -rf of a big tree costs a request per hundred entries instead of one
+// per entry. Listings leave out the entries still queued, and operations
+// that could run into a name still taken remotely wait for the queue to
+// drain first.
+//
+// So unlink and rmdir succeed before the remote delete has been sent. A
+// delete that fails anyway is logged, counted in Stats and has the listing
+// of its folder read again, which brings the entry back. The error is
+// returned by the next fsync of that folder, which waits for the queue to
+// drain: a program that has to know the deletes went through fsyncs the
+// directory, as it would for a local file system.
+
+// deleteDelay is how long a batch that isn't full waits for more entries,
+// enough for rm -rf to queue the next ones.
+const deleteDelay = 100 * time.Millisecond
+
+// deletedGrace is how long a sent delete is still left out of listings,
+// one fetched before it went out may be merged after.
+const deletedGrace = time.Minute
+
+type deleter struct {
+	fs   *AliYunDriveFs
+	once sync.Once
+	// kick sends out the current batch without waiting for deleteDelay.
+	kick chan struct{}
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []deletion
+	// pending holds the FileIds queued or being deleted.
+	pending map[string]bool
+	// parents holds the folder inode of every pending delete.
+	parents map[string]*Inode
+	// done holds when the deletes sent within deletedGrace went out.
+	done map[string]time.Time
+	// failed holds the first error of a failed delete per folder, until
+	// an fsync of the folder reports it.
+	failed    map[*Inode]error
+	failedCnt uint64
+	syncing   int
+}
+
+func newDeleter(fs *AliYunDriveFs) *deleter {
+	d := &deleter{
+		fs:      fs,
+		kick:    make(chan struct{}, 1),
+		pending: make(map[string]bool),
+		parents: make(map[string]*Inode),
+		done:    make(map[string]time.Time),
+		failed:  make(map[*Inode]error),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// accept asks the backend whether fileId may be deleted from parent.
+func (d *deleter) accept(ctx context.Context, fileId string, parent *Inode) error {
+	if a, ok := d.fs.backend.(deleteAccepter); ok {
+		if err := a.AcceptDelete(ctx, fileId, parent.FileId); err != nil {
+			return backendErr(ctx, err)
+		}
+	}
+	return nil
+}
+
+// add queues the delete of fileId, which sits in parent.
+func (d *deleter) add(fileId string, parent *Inode) {
+	d.once.Do(func() { go d.run() })
+	d.mu.Lock()
+	d.queue = append(d.queue, deletion{FileId: fileId, ParentId: parent.FileId})
+	d.pending[fileId] = true
+	d.parents[fileId] = parent
+	if len(d.queue) >= maxBatch {
+		d.kickLocked()
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// LOCKS_REQUIRED(d.mu)
+func (d *deleter) kickLocked() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (d *deleter) isPending(fileId string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending[fileId]
+}
+
+// withoutPending drops the items whose delete is still queued or just
+// went out.
+func (d *deleter) withoutPending(items []model.ListModel) []model.ListModel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 && len(d.done) == 0 {
+		return items
+	}
+	kept := make([]model.ListModel, 0, len(items))
+	for _, item := range items {
+		if _, ok := d.done[item.FileId]; !ok && !d.pending[item.FileId] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// restored forgets the delete of fileId, which is back from the trash.
+func (d *deleter) restored(fileId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.done, fileId)
+}
+
+// Sync waits until every queued delete has been sent.
+func (d *deleter) Sync() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 {
+		return
+	}
+	d.syncing++
+	d.kickLocked()
+	for len(d.pending) != 0 {
+		d.cond.Wait()
+	}
+	d.syncing--
+}
+
+func (d *deleter) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+func (d *deleter) Failed() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failedCnt
+}
+
+// SyncDir waits until every queued delete has been sent and returns the
+// error of a delete from dir that failed since the last call.
+func (d *deleter) SyncDir(dir *Inode) error {
+	d.Sync()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.failed[dir]
+	delete(d.failed, dir)
+	if err != nil {
+		return backendErr(context.Background(), err)
+	}
+	return nil
+}
+
+// SyncDeletes waits until the remote deletes queued by unlink and rmdir
+// have been sent.
+func (fs *AliYunDriveFs) SyncDeletes() {
+	fs.deletes.Sync()
+}
+
+func (d *deleter) run() {
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 {
+			d.cond.Wait()
+		}
+		if len(d.queue) < maxBatch && d.syncing == 0 {
+			d.mu.Unlock()
+			timer := time.NewTimer(deleteDelay)
+			select {
+			case <-timer.C:
+			case <-d.kick:
+				timer.Stop()
+			}
+			d.mu.Lock()
+		}
+		n := len(d.queue)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		batch := make([]deletion, n)
+		copy(batch, d.queue)
+		d.queue = d.queue[n:]
+		d.mu.Unlock()
+
+		ctx, cancel := d.fs.withOpTimeout(context.Background())
+		errs := deleteAll(ctx, d.fs.backend, batch)
+		cancel()
+
+		var failed []*Inode
+		now := time.Now()
+		d.mu.Lock()
+		for id, t := range d.done {
+			if now.Sub(t) > deletedGrace {
+				delete(d.done, id)
+			}
+		}
+		for i, e := range batch {
+			if errs[i] != nil {
+				fuseLog.Errorln("deleting", e.FileId, errs[i])
+				parent := d.parents[e.FileId]
+				failed = append(failed, parent)
+				if d.failed[parent] == nil {
+					d.failed[parent] = errs[i]
+				}
+				d.failedCnt++
+			} else {
+				d.done[e.FileId] = now
+			}
+			delete(d.pending, e.FileId)
+			delete(d.parents, e.FileId)
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+		for _, parent := range failed {
+			d.fs.relist(parent)
+		}
+	}
+}
+
+// relist makes the next lookup in dir list it again, to bring back an
+// entry whose delete failed.
+func (fs *AliYunDriveFs) relist(dir *Inode) {
+	if r, ok := fs.backend.(refresher); ok {
+		r.Refresh(dir.FileId)
+	}
+	fs.unlist(dir)
+}
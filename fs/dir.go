@@ -17,19 +17,19 @@
 package fs
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/jacobsa/fuse"
-	"goaldfuse/aliyun"
-	"goaldfuse/aliyun/model"
-	"reflect"
-	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
+	"goaldfuse/aliyun/model"
 )
 
 type DirInodeData struct {
@@ -42,6 +42,10 @@ type DirInodeData struct {
 	DirTime         time.Time
 
 	Children []*Inode
+
+	// listing is the entry in fs.listings while the complete listing of
+	// this directory is cached, guarded by fs.lruMu.
+	listing *list.Element
 }
 
 type DirHandleEntry struct {
@@ -56,12 +60,17 @@ type DirHandle struct {
 
 	mu sync.Mutex // everything below is protected by mu
 
+	// entries is the snapshot read so far, a readdir offset indexes it.
+	entries []*DirHandleEntry
+	// Marker is where the next page starts, nil before the first one.
 	Marker        *string
 	lastFromCloud *string
 	done          bool
 	// Time at which we started fetching child entries
 	// from cloud for this handle.
 	refreshStartTime time.Time
+
+	opened time.Time
 }
 
 func NewDirHandle(inode *Inode) (dh *DirHandle) {
@@ -72,9 +81,6 @@ func NewDirHandle(inode *Inode) (dh *DirHandle) {
 func (inode *Inode) OpenDir() (dh *DirHandle) {
 	inode.logFuse("OpenDir")
 	dh = NewDirHandle(inode)
-	inode.fs.mu.Lock()
-	inode.fs.dirHandles[fuseops.HandleID(dh.inode.fileHandles)] = dh
-	inode.fs.mu.Unlock()
 	return
 }
 
@@ -98,70 +104,171 @@ func (inode *Inode) OpenDir() (dh *DirHandle) {
 // is nothing left to list or the last listed entry has all characters > "/"
 // Relavant test case: TestReadDirDash
 
+// Entry returns the entry at offset i of the handle's snapshot, fetching
+// pages from the backend until it has been read, or nil after the last
+// one. Offsets stay the same for the lifetime of the handle, the complete
+// listing is marked cached once the last page has been merged.
+//
 // LOCKS_REQUIRED(dh.mu)
 // LOCKS_EXCLUDED(dh.inode.mu)
 // LOCKS_EXCLUDED(dh.inode.fs)
-func (dh *DirHandle) ReadDir() (en []*DirHandleEntry, err error) {
+func (dh *DirHandle) Entry(ctx context.Context, i int) (*DirHandleEntry, error) {
+	if dh.entries == nil {
+		dh.addDots()
+	}
+	for i >= len(dh.entries) && !dh.done {
+		if err := dh.fetchPage(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if i >= len(dh.entries) {
+		return nil, nil
+	}
+	return dh.entries[i], nil
+}
+
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) addDots() {
+	parent := dh.inode
+	parent.mu.Lock()
+	dotdot := fuseops.InodeID(0)
+	if parent.Parent != nil {
+		dotdot = parent.Parent.Id
+	}
+	parent.mu.Unlock()
+	dh.entries = []*DirHandleEntry{
+		{Name: ".", Type: fuseutil.DT_Directory, Inode: parent.Id, Offset: 1},
+		{Name: "..", Type: fuseutil.DT_Directory, Inode: dotdot, Offset: 2},
+	}
+	if parent.Id == fuseops.RootInodeID {
+		for _, dir := range []*Inode{parent.fs.trashRoot(), parent.fs.starredRoot()} {
+			if dir != nil {
+				dh.entries = append(dh.entries, &DirHandleEntry{Name: dir.Name, Type: fuseutil.DT_Directory, Inode: dir.Id,
+					Offset: fuseops.DirOffset(len(dh.entries) + 1)})
+			}
+		}
+	}
+}
+
+func direntType(inode *Inode) fuseutil.DirentType {
+	if inode.Type == "folder" {
+		return fuseutil.DT_Directory
+	}
+	if inode.SymlinkTarget != "" {
+		return fuseutil.DT_Link
+	}
+	return fuseutil.DT_File
+}
+
+// fetchPage merges the next page of the listing and appends its entries,
+// the whole listing at once if the backend can't page.
+//
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) fetchPage(ctx context.Context) (err error) {
 	parent := dh.inode
 	fs := parent.fs
-	dirList, err := aliyun.GetList(fs.Config.Token, fs.Config.DriveId, parent.FileId)
+	if parent.isVirtual() {
+		return dh.fetchVirtual(ctx)
+	}
+	var items []model.ListModel
+	next := ""
+	if p, ok := fs.backend.(pagedLister); ok {
+		marker := ""
+		if dh.Marker != nil {
+			marker = *dh.Marker
+		}
+		items, next, err = p.ListPage(ctx, parent.FileId, marker)
+	} else {
+		items, err = fs.backend.List(ctx, parent.FileId)
+	}
 	if err != nil {
-		return nil, err
+		return backendErr(ctx, err)
 	}
-	if len(dirList.Items) == 0 {
-		return nil, err
+
+	// two handles on the same directory merge their pages one at a
+	// time, otherwise both would insert the same new child
+	parent.mu.Lock()
+	children := parent.mergeListingUnlocked(items)
+	for _, child := range children {
+		dh.entries = append(dh.entries, &DirHandleEntry{Name: child.Name, Inode: child.Id, Type: direntType(child),
+			Offset: fuseops.DirOffset(len(dh.entries) + 1)})
 	}
-	en = make([]*DirHandleEntry, 0)
-	//add dot
-	c := &DirHandleEntry{Name: ".", Type: fuseutil.DT_Directory, Inode: parent.Id, Offset: 0}
-	en = append(en, c)
-	//add dotdot
-	if parent.Parent != nil {
-		p := &DirHandleEntry{Name: "..", Type: fuseutil.DT_Directory, Inode: parent.Parent.Id, Offset: 1}
-		en = append(en, p)
-	} else {
-		p := &DirHandleEntry{Name: "..", Type: fuseutil.DT_Directory, Inode: 0, Offset: 1}
-		en = append(en, p)
+	parent.mu.Unlock()
+
+	dh.Marker = &next
+	if next == "" {
+		dh.done = true
+		fs.cachedListing(parent)
 	}
+	return nil
+}
 
-	for i, item := range dirList.Items {
-		var ety *Inode
-		var typ fuseutil.DirentType
+// mergeListingUnlocked adds the listed items that are not cached yet as
+// children of parent and returns the child for every item. The new
+// inodes are not referenced by the kernel until it looks them up.
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) mergeListingUnlocked(items []model.ListModel) []*Inode {
+	fs := parent.fs
+	// what was just deleted is still listed until the delete went out
+	items = fs.deletes.withoutPending(items)
+	_, hasTrash := fs.backend.(recycleBin)
+	_, hasStarred := fs.backend.(starrer)
+	children := make([]*Inode, 0, len(items))
+	for _, item := range items {
+		if parent.Id == fuseops.RootInodeID && ((hasTrash && item.Name == trashName) || (hasStarred && item.Name == starredName)) {
+			// shadowed by the made up directories
+			continue
+		}
+		meta := item
 		if inode := parent.findChildUnlocked(item.Name, item.Type); inode != nil {
+			inode.mu.Lock()
+			if inode.FileId == item.FileId {
+				inode.setMetaUnlocked(&meta)
+			}
+			inode.mu.Unlock()
 			now := time.Now()
 			// don't want to update time if this
 			// inode is setup to never expire
 			if inode.AttrTime.Before(now) {
 				inode.AttrTime = now
 			}
-			ety = inode
-			if ety.Type == "folder" {
-				typ = fuseutil.DT_Directory
-			} else {
-				typ = fuseutil.DT_File
-			}
+			children = append(children, inode)
+			continue
+		}
+		entry := NewInode(fs, parent, item.Name)
+		entry.refcnt = 0
+		if item.Type == "folder" {
+			entry.ToDir()
+			entry.Type = "folder"
 		} else {
-			entry := NewInode(dh.inode.fs, dh.inode, item.Name)
-			if item.Type == "folder" {
-				entry.ToDir()
-				entry.Type = "folder"
-				typ = fuseutil.DT_Directory
-			} else {
-				entry.Attributes = InodeAttributes{Size: uint64(item.Size),
-					Mtime: item.UpdatedAt}
-				entry.Type = "file"
-				typ = fuseutil.DT_File
-			}
-			entry.ParentFileId = item.ParentFileId
-			entry.FileId = item.FileId
-			fs.insertInode(parent, entry)
-			ety = entry
+			entry.Attributes = InodeAttributes{Size: uint64(item.Size),
+				Mtime: item.UpdatedAt}
+			entry.Type = "file"
+			entry.SymlinkTarget, _ = meta.SymlinkTarget()
 		}
-		e := &DirHandleEntry{Name: ety.Name, Inode: ety.Id, Type: typ, Offset: fuseops.DirOffset(uint64(i + 2))}
-		en = append(en, e)
+		entry.ParentFileId = item.ParentFileId
+		entry.FileId = item.FileId
+		entry.setMetaUnlocked(&meta)
+		fs.insertInode(parent, entry)
+		children = append(children, entry)
 	}
-	return en, nil
+	return children
+}
 
+// loadListing fetches the children of parent from the backend, used when
+// a lookup misses in a directory whose listing is not cached.
+//
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) loadListing(ctx context.Context) error {
+	items, err := parent.fs.backend.List(ctx, parent.FileId)
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+	parent.mu.Lock()
+	parent.mergeListingUnlocked(items)
+	parent.mu.Unlock()
+	return nil
 }
 
 func (dh *DirHandle) CloseDir() error {
@@ -250,39 +357,35 @@ func (parent *Inode) findInodeFunc(name string) func(i int) bool {
 	}
 }
 
+func (fs *AliYunDriveFs) cachedChild(parentFileId string, name string, typ string) *Inode {
+	fs.pnMu.Lock()
+	defer fs.pnMu.Unlock()
+	return fs.pnCache[parentFileId+name+typ]
+}
+
 func (parent *Inode) findChildUnlocked(name string, typ string) (inode *Inode) {
 	l := len(parent.dir.Children)
 	if l == 0 {
 		return
 	}
 	if typ == "" {
-		typ = "folder"
-		if val, ok := parent.fs.pnCache[parent.FileId+name+typ]; ok {
-			// found
-			inode = val
-		} else {
-			typ = "file"
-			if val, ok := parent.fs.pnCache[parent.FileId+name+typ]; ok {
-				inode = val
-			}
-		}
-	} else {
-		if val, ok := parent.fs.pnCache[parent.FileId+name+typ]; ok {
-			// found
-			inode = val
+		if inode = parent.fs.cachedChild(parent.FileId, name, "folder"); inode == nil {
+			inode = parent.fs.cachedChild(parent.FileId, name, "file")
 		}
+		return
 	}
-
-	return inode
+	return parent.fs.cachedChild(parent.FileId, name, typ)
 }
 
+// removeChildUnlocked unlinks inode from parent and from the name cache.
+// Children are kept in insertion order so this is a linear scan.
 func (parent *Inode) removeChildUnlocked(inode *Inode) {
 	l := len(parent.dir.Children)
-	if l == 0 {
-		return
+	i := 0
+	for i < l && parent.dir.Children[i] != inode {
+		i++
 	}
-	i := sort.Search(l, parent.findInodeFunc(inode.Name))
-	if i >= l || parent.dir.Children[i].Name != inode.Name {
+	if i == l {
 		panic(fmt.Sprintf("%v.removeName(%v) but child not found: %v",
 			parent.FullName(), inode.Name, i))
 	}
@@ -296,6 +399,14 @@ func (parent *Inode) removeChildUnlocked(inode *Inode) {
 		copy(tmp, parent.dir.Children)
 		parent.dir.Children = tmp
 	}
+
+	fs := parent.fs
+	key := parent.FileId + inode.Name + inode.Type
+	fs.pnMu.Lock()
+	if fs.pnCache[key] == inode {
+		delete(fs.pnCache, key)
+	}
+	fs.pnMu.Unlock()
 }
 
 func (parent *Inode) removeChild(inode *Inode) {
@@ -314,16 +425,19 @@ func (parent *Inode) insertChild(inode *Inode) {
 }
 
 func (parent *Inode) insertChildUnlocked(inode *Inode) {
-	l := len(parent.dir.Children)
-	if l == 0 {
-		parent.dir.Children = []*Inode{inode}
+	if inode.Name == "." || inode.Name == ".." {
+		parent.dir.Children = append(parent.dir.Children, inode)
 		return
 	}
 
-	//i := sort.Search(l, parent.findInodeFunc(inode.Name))
-	if _, ok := parent.fs.pnCache[parent.FileId+inode.Name+inode.Type]; !ok {
+	fs := parent.fs
+	key := parent.FileId + inode.Name + inode.Type
+	fs.pnMu.Lock()
+	defer fs.pnMu.Unlock()
+	if _, ok := fs.pnCache[key]; !ok {
 		// not found = new value is the biggest
 		parent.dir.Children = append(parent.dir.Children, inode)
+		fs.pnCache[key] = inode
 	} else {
 		parent.errFuse("Duplicate insert", parent.Name, inode.Name, inode.Type)
 	}
@@ -343,24 +457,26 @@ func (parent *Inode) getChildName(name string) string {
 	}
 }
 
-func (parent *Inode) Unlink(name string) (err error) {
+// Unlink takes the file out of the tree and queues its remote delete,
+// once the backend accepted it. A file not uploaded yet has nothing to
+// delete, its flush finds it detached.
+func (parent *Inode) Unlink(ctx context.Context, name string) (err error) {
 	parent.logFuse("Unlink", name)
 
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
 	inode := parent.findChildUnlocked(name, "file")
 	if inode == nil {
 		return fuse.ENOENT
 	}
-
-	aliyun.RemoveTrash(parent.fs.Config.Token, parent.fs.Config.DriveId, inode.FileId, inode.ParentFileId)
-
-	parent.mu.Lock()
-	defer parent.mu.Unlock()
-
-	if inode != nil {
-		parent.removeChildUnlocked(inode)
-		inode.Parent = nil
+	if inode.FileId != "" {
+		if err = parent.fs.deletes.accept(ctx, inode.FileId, parent); err != nil {
+			return
+		}
+		parent.fs.deletes.add(inode.FileId, parent)
 	}
-
+	parent.detachChildUnlocked(inode)
 	return
 }
 
@@ -376,6 +492,7 @@ func (parent *Inode) Create(
 
 	now := time.Now()
 	inode = NewInode(fs, parent, name)
+	inode.Type = "file"
 	inode.Attributes = InodeAttributes{
 		Size:  0,
 		Mtime: now,
@@ -390,20 +507,21 @@ func (parent *Inode) Create(
 	return
 }
 
-func (parent *Inode) MkDir(
+func (parent *Inode) MkDir(ctx context.Context,
 	name string) (inode *Inode, err error) {
 
 	fs := parent.fs
 
-	item := aliyun.MakeDir(fs.Config.Token, fs.Config.DriveId, name, parent.FileId)
-	if reflect.DeepEqual(item, model.CreateModel{}) {
-		return nil, fuse.EIO
+	item, err := fs.backend.MkDir(ctx, parent.FileId, name)
+	if err != nil {
+		return nil, backendErr(ctx, err)
 	}
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
 	inode = NewInode(fs, parent, name)
 	inode.ToDir()
+	inode.Type = "folder"
 	inode.FileId = item.FileId
 	inode.ParentFileId = item.ParentFileId
 	inode.touch()
@@ -421,42 +539,47 @@ func appendChildName(parent, child string) string {
 	return parent + child
 }
 
-func (parent *Inode) isEmptyDir() (isDir bool, err error) {
-	file := aliyun.GetFileDetail(parent.fs.Config.Token, parent.fs.Config.DriveId, parent.FileId)
-	if !reflect.DeepEqual(file, model.ListModel{}) && file.Type == "folder" {
-		isDir = true
-	} else {
-		err = errors.New("Not a dir")
+// RmDir removes an empty folder, queueing the remote delete like Unlink.
+// The folder is listed before parent is locked, to tell whether it's
+// empty without asking the backend under the lock.
+//
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) RmDir(ctx context.Context, name string) (err error) {
+	parent.logFuse("Rmdir", name)
+
+	for {
+		if err = parent.listChild(ctx, name); err != nil {
+			return
+		}
+		if err = parent.rmDir(ctx, name); err != errNotListed {
+			return
+		}
 	}
-	return isDir, err
 }
 
-func (parent *Inode) RmDir(name string) (err error) {
-	parent.logFuse("Rmdir", name)
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) rmDir(ctx context.Context, name string) (err error) {
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
 	inode := parent.findChildUnlocked(name, "folder")
 	if inode == nil {
+		if parent.findChildUnlocked(name, "file") != nil {
+			return syscall.ENOTDIR
+		}
 		return fuse.ENOENT
 	}
-	isDir, err := inode.isEmptyDir()
-	if err != nil {
+	if err = inode.checkEmpty(); err != nil {
 		return
 	}
-	// if this was an implicit dir, isEmptyDir would have returned
-	// isDir = false
-	if isDir {
-		aliyun.RemoveTrash(parent.fs.Config.Token, parent.fs.Config.DriveId, inode.FileId, inode.ParentFileId)
-	}
-
-	// we know this entry is gone
-	parent.mu.Lock()
-	defer parent.mu.Unlock()
-
-	inode = parent.findChildUnlocked(name, "folder")
-	if inode != nil {
-		parent.removeChildUnlocked(inode)
-		inode.Parent = nil
+	if err = parent.fs.deletes.accept(ctx, inode.FileId, parent); err != nil {
+		return
 	}
-
+	inode.mu.Lock()
+	inode.Invalid = true
+	inode.mu.Unlock()
+	parent.fs.deletes.add(inode.FileId, parent)
+	parent.detachChildUnlocked(inode)
 	return
 }
 
@@ -468,28 +591,202 @@ func (parent *Inode) RmDir(name string) (err error) {
 // rename("nonempty_dir1", "nonempty_dir2") = ENOTEMPTY
 // rename("file", "dir") = EISDIR
 // rename("dir", "file") = ENOTDIR
-func (parent *Inode) Rename(from string, newParent *Inode, to string, oldNode *Inode) (err error) {
-	config := parent.fs.Config
-	fileId := oldNode.FileId
-	if parent.Id == newParent.Id {
-		aliyun.ReName(config.Token, config.DriveId, to, oldNode.FileId)
+// rename("dir", "dir/sub") = EINVAL
+//
+// The remote side is changed first, the inode tree only once that
+// succeeded. A file not uploaded yet only moves in the tree, its flush
+// uploads it under the new name, overwriting the target.
+//
+// A replaced target is parked under a temporary name while the source
+// moves in and trashed only after that worked, so an editor saving
+// through a temporary file never loses the old copy on an error. Every
+// remote step done before a failure is undone in reverse.
+//
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_REQUIRED(newParent.mu)
+func (parent *Inode) Rename(ctx context.Context, from string, newParent *Inode, to string, oldNode *Inode) (err error) {
+	if oldNode.isDir() && (oldNode == newParent || oldNode.isParentOf(newParent)) {
+		return syscall.EINVAL
+	}
+	target := newParent.findChildUnlocked(to, "")
+	if target == oldNode {
+		return
+	}
+	if target != nil {
+		if err = oldNode.canReplace(target); err != nil {
+			return
+		}
+	}
 
-	} else {
-		aliyun.BatchFile(config.Token, config.DriveId, oldNode.FileId, newParent.FileId)
-		if from != to {
-			aliyun.ReName(config.Token, config.DriveId, to, oldNode.FileId)
+	fs := parent.fs
+	backend := fs.backend
+	if fileId := oldNode.FileId; fileId != "" {
+		parked := ""
+		if target != nil && target.FileId != "" {
+			parked = parkedName(to, target.FileId)
+			if err = backend.Rename(ctx, target.FileId, parked); err != nil {
+				return backendErr(ctx, err)
+			}
+		}
+		// moving renames in the same step, an entry called from in
+		// newParent is no obstacle
+		moved := false
+		if parent != newParent {
+			err = backend.Move(ctx, fileId, newParent.FileId, to)
+			moved = err == nil
+		} else if from != to {
+			err = backend.Rename(ctx, fileId, to)
+		}
+		if err != nil {
+			// ctx may be what failed, undo regardless
+			bg, cancel := fs.withOpTimeout(context.Background())
+			defer cancel()
+			if moved {
+				if e := backend.Move(bg, fileId, parent.FileId, from); e != nil {
+					parent.errFuse("moving back", from, e)
+				}
+			}
+			if parked != "" {
+				// the rename may have gone through after all
+				if nameTaken(bg, backend, newParent.FileId, to) {
+					newParent.errFuse("not restoring replaced, name taken", parked)
+				} else if e := backend.Rename(bg, target.FileId, to); e != nil {
+					newParent.errFuse("restoring replaced", parked, e)
+				}
+			}
+			return backendErr(ctx, err)
+		}
+		if parked != "" {
+			if e := backend.Delete(ctx, target.FileId, newParent.FileId); e != nil {
+				// the rename is done, only the old copy is left behind
+				newParent.errFuse("trashing replaced", parked, e)
+			}
 		}
 	}
-	parent.removeChildUnlocked(oldNode)
-	newNode := &Inode{Parent: newParent,
-		Name:         to,
-		FileId:       fileId,
-		ParentFileId: newParent.FileId}
 
-	newParent.insertChildUnlocked(newNode)
+	if target != nil {
+		// the kernel still sends forget ops for the replaced inode
+		target.mu.Lock()
+		target.Invalid = true
+		target.mu.Unlock()
+		newParent.detachChildUnlocked(target)
+	}
+	parent.moveChildUnlocked(oldNode, newParent, to)
 	return
 }
 
+// nameTaken reports whether the folder parentId has an entry called name.
+// A failed listing counts as taken, so nothing gets overwritten.
+func nameTaken(ctx context.Context, backend Backend, parentId string, name string) bool {
+	items, err := backend.List(ctx, parentId)
+	if err != nil {
+		return true
+	}
+	for _, item := range items {
+		if item.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parkedName is where a replaced target waits for the rename to finish.
+func parkedName(name string, fileId string) string {
+	return "." + name + ".replaced-" + fileId
+}
+
+// canReplace checks that inode may be renamed over target.
+//
+// LOCKS_REQUIRED(target.Parent.mu)
+// LOCKS_EXCLUDED(target.mu)
+func (inode *Inode) canReplace(target *Inode) error {
+	switch {
+	case inode.isDir() && !target.isDir():
+		return syscall.ENOTDIR
+	case !inode.isDir() && target.isDir():
+		return syscall.EISDIR
+	case !target.isDir():
+		return nil
+	}
+	return target.checkEmpty()
+}
+
+// errNotListed is returned under the locks when the listing of a folder
+// that has to be empty is not cached, after it was evicted or the folder
+// was merged in since listChild. The caller unlocks and tries again.
+var errNotListed = errors.New("listing not cached")
+
+// listChild caches the listing of the folder name in dir, if there is
+// one, so that checkEmpty can tell it's empty under the locks.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (dir *Inode) listChild(ctx context.Context, name string) error {
+	dir.mu.Lock()
+	child := dir.findChildUnlocked(name, "folder")
+	dir.mu.Unlock()
+	if child == nil {
+		return nil
+	}
+	return dir.fs.ensureListed(ctx, child)
+}
+
+// checkEmpty returns ENOTEMPTY unless the folder dir has no children. It
+// only looks at the cached listing, errNotListed means there is none.
+//
+// LOCKS_REQUIRED(dir.Parent.mu)
+// LOCKS_EXCLUDED(dir.mu)
+func (dir *Inode) checkEmpty() error {
+	if !dir.fs.listed(dir) {
+		return errNotListed
+	}
+	dir.mu.Lock()
+	empty := len(dir.dir.Children) <= 2
+	dir.mu.Unlock()
+	if !empty {
+		return syscall.ENOTEMPTY
+	}
+	return nil
+}
+
+// moveChildUnlocked relinks inode from parent into newParent under name.
+// The children of a directory are keyed by its FileId, which doesn't
+// change, so the subtree comes along as it is.
+//
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_REQUIRED(newParent.mu)
+// LOCKS_EXCLUDED(inode.mu)
+func (parent *Inode) moveChildUnlocked(inode *Inode, newParent *Inode, name string) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	parent.removeChildUnlocked(inode)
+	inode.Name = name
+	inode.Parent = newParent
+	inode.ParentFileId = newParent.FileId
+	newParent.insertChildUnlocked(inode)
+	if inode.isDir() && parent != newParent {
+		for _, child := range inode.dir.Children {
+			if child.Name == ".." {
+				child.Id = newParent.Id
+			}
+		}
+	}
+}
+
+// ensureListed fetches the listing of dir unless it is cached.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *AliYunDriveFs) ensureListed(ctx context.Context, dir *Inode) error {
+	if fs.listed(dir) {
+		return nil
+	}
+	if err := dir.loadListing(ctx); err != nil {
+		return err
+	}
+	fs.cachedListing(dir)
+	return nil
+}
+
 // if I had seen a/ and a/b, and now I get a/c, that means a/b is
 // done, but not a/
 func (parent *Inode) isParentOf(inode *Inode) bool {
@@ -17,13 +17,16 @@
 package fs
 
 import (
+	"context"
 	"github.com/jacobsa/fuse"
-	"goaldfuse/aliyun"
+	"goaldfuse/aliyun/model"
+	"goaldfuse/aliyun/net"
 	"io"
 	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -47,6 +50,14 @@ type FileHandle struct {
 	reader        io.ReadCloser
 	readBufOffset int64
 
+	// streamCancel aborts the in-flight download backing reader. It has
+	// its own lock because it is called from the goroutine watching an
+	// interrupted ReadFile while fh.mu is held by that read.
+	streamMu     sync.Mutex
+	streamCancel context.CancelFunc
+
+	opened time.Time
+
 	keepPageCache  bool // the same value we returned to OpenFile
 	intermediaFile string
 }
@@ -85,6 +96,7 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 	if err != nil {
 		return err
 	}
+	fh.dirty = true
 	fh.nextWriteOffset = fh.nextWriteOffset + int64(len(data))
 	fh.inode.Attributes.Size = uint64(fh.nextWriteOffset)
 	fh.inode.Attributes.Mtime = time.Now()
@@ -92,7 +104,22 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 	return
 }
 
-func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err error) {
+func (fh *FileHandle) setStreamCancel(cancel context.CancelFunc) {
+	fh.streamMu.Lock()
+	defer fh.streamMu.Unlock()
+	fh.streamCancel = cancel
+}
+
+func (fh *FileHandle) cancelStream() {
+	fh.streamMu.Lock()
+	defer fh.streamMu.Unlock()
+	if fh.streamCancel != nil {
+		fh.streamCancel()
+		fh.streamCancel = nil
+	}
+}
+
+func (fh *FileHandle) ReadFile(ctx context.Context, offset int64, buf []byte) (bytesRead int, err error) {
 	fh.inode.logFuse("ReadFile", offset, len(buf))
 	defer func() {
 		fh.inode.logFuse("< ReadFile", bytesRead, err)
@@ -107,15 +134,32 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	// the download stream outlives a single read so it can't be bound
+	// to ctx, tear it down instead if the kernel interrupts this read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fh.cancelStream()
+		case <-done:
+		}
+	}()
+
 	noWant := len(buf)
 	var noRead int
 
-	for bytesRead < noWant && err == nil {
+	for bytesRead < noWant && err == nil && ctx.Err() == nil {
 		noRead, err = fh.readFile(offset+int64(bytesRead), buf[bytesRead:])
 		if noRead > 0 {
 			bytesRead += noRead
 		}
 	}
+	if bytesRead == 0 {
+		if e := interruptedErr(ctx); e != nil {
+			err = e
+		}
+	}
 
 	return
 }
@@ -154,10 +198,11 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 		fh.readBufOffset = offset
 		if fh.reader != nil {
 			err := fh.reader.Close()
+			fh.reader = nil
+			fh.cancelStream()
 			if err != nil {
 				return 0, err
 			}
-			fh.reader = nil
 		}
 	}
 
@@ -168,19 +213,19 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 
 func (fh *FileHandle) Release() {
 
+	fh.cancelStream()
 	if fh.reader != nil {
-		err := fh.reader.Close()
-		if err != nil {
-			return
-		}
+		_ = fh.reader.Close()
+		fh.reader = nil
+	}
+	if fh.intermediaFile != "" {
+		_ = os.Remove(fh.intermediaFile)
 	}
-
-	// write buffers
 
 	fh.inode.mu.Lock()
 	defer fh.inode.mu.Unlock()
 
-	if atomic.AddUint64(&fh.inode.fileHandles, 1) == 1 {
+	if atomic.AddUint64(&fh.inode.fileHandles, ^uint64(0)) == ^uint64(0) {
 		panic(fh.inode.fileHandles)
 	}
 }
@@ -191,29 +236,33 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 			fh.inode.logFuse("< readFromStream", bytesRead)
 		}
 	}()
-	config := fh.inode.fs.Config
 	if uint64(offset) >= fh.inode.Attributes.Size {
 		// nothing to read
 		return
 	}
 
 	if fh.reader == nil {
-		downloadUrl := aliyun.GetDownloadUrl(config.Token, config.DriveId, fh.inode.FileId)
-		var rangeString string
-		if uint64(offset+int64(len(buf))+1) >= fh.inode.Attributes.Size {
-			rangeString = "bytes=" + strconv.FormatUint(uint64(offset), 10) + "-"
-		} else {
-			rangeString = "bytes=" + strconv.FormatUint(uint64(offset), 10) + "-" + strconv.FormatUint(uint64(offset+int64(len(buf))), 10)
+		streamCtx, cancel := context.WithCancel(context.Background())
+		fh.setStreamCancel(cancel)
+		var length int64 = -1
+		if uint64(offset+int64(len(buf))+1) < fh.inode.Attributes.Size {
+			length = int64(len(buf)) + 1
 		}
 		for i := 0; i < 5; i++ {
-			resp := aliyun.GetFile(downloadUrl, config.Token, rangeString)
-			if resp == nil {
-				time.Sleep(5 * time.Second)
+			reader, err := fh.inode.fs.backend.OpenRange(streamCtx, fh.inode.FileId, offset, length)
+			if err != nil {
+				fh.inode.logFuse("OpenRange", err)
+				if net.SleepContext(streamCtx, 5*time.Second) != nil {
+					break
+				}
 				continue
-			} else {
-				fh.reader = resp.Body
-				break
 			}
+			fh.reader = reader
+			break
+		}
+		if fh.reader == nil {
+			fh.cancelStream()
+			return 0, fuse.EIO
 		}
 
 	}
@@ -225,26 +274,75 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 		}
 		// always retry error on read
 		err := fh.reader.Close()
+		fh.reader = nil
+		fh.cancelStream()
 		if err != nil {
 			return 0, err
 		}
-		fh.reader = nil
 		err = nil
 	}
 
 	return
 }
 
-func (fh *FileHandle) FlushFile() (err error) {
+func (fh *FileHandle) FlushFile(ctx context.Context) (err error) {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
-	intermediateFile, err := os.OpenFile(fh.intermediaFile, os.O_RDWR, 600)
+	if !fh.dirty {
+		return nil
+	}
+	if fh.inode.Parent == nil {
+		// unlinked or replaced meanwhile, there is nowhere to upload to
+		fh.dirty = false
+		return nil
+	}
+	if fh.inode.isVirtual() {
+		return syscall.EROFS
+	}
+	if fh.intermediaFile == "" {
+		// created but never written, upload it empty
+		fh.intermediaFile = fh.inode.Name + strconv.FormatUint(uint64(fh.inode.Id), 10)
+	}
+	intermediateFile, err := os.OpenFile(fh.intermediaFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
 	fs := fh.inode.fs
+	// a folder of the same name may still be waiting to be deleted
+	fs.deletes.Sync()
 	stat, err := intermediateFile.Stat()
 	if err != nil {
+		intermediateFile.Close()
 		return err
 	}
-	aliyun.ContentHandle(intermediateFile, fs.Config.Token, fs.Config.DriveId, fh.inode.Parent.FileId, fh.inode.Name, uint64(stat.Size()))
+	// the extended attributes in user_meta go with the content
+	store, keepMeta := fs.backend.(userMetaStore)
+	var meta *model.ListModel
+	if keepMeta {
+		var e error
+		if meta, e = fh.inode.currentMeta(ctx); e != nil {
+			fuseLog.Errorln("user_meta of", fh.inode.FullName(), e)
+		}
+	}
+	fileId, err := fs.backend.Upload(ctx, fh.inode.Parent.FileId, fh.inode.Name, intermediateFile, stat.Size())
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+	fh.inode.mu.Lock()
+	fh.inode.FileId = fileId
+	fh.inode.ParentFileId = fh.inode.Parent.FileId
+	if fh.inode.meta != nil {
+		// set meanwhile
+		meta = fh.inode.meta
+	}
+	fh.inode.meta = nil
+	fh.inode.mu.Unlock()
+	fh.dirty = false
+	if meta != nil && meta.UserMeta != "" {
+		if e := store.SetUserMeta(ctx, fileId, meta.UserMeta); e != nil {
+			fuseLog.Errorln("keeping the xattrs of", fh.inode.FullName(), e)
+		}
+	}
 
 	return
 }
@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package fstest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"goaldfuse/aliyun"
+	"goaldfuse/aliyun/fakedrive"
+	"goaldfuse/aliyun/model"
+	"goaldfuse/fs"
+	"goaldfuse/utils"
+)
+
+// BackendFactory makes a fresh backend for one scenario, along with the
+// function that releases it.
+type BackendFactory struct {
+	Name string
+	New  func() (fs.Backend, func())
+}
+
+// Backends are what the scenarios run against: the in-memory backend, the
+// Aliyun backend talking to a fake drive server and the in-memory backend
+// behind a metadata db.
+var Backends = []BackendFactory{
+	{"memory", func() (fs.Backend, func()) {
+		b := fs.NewMemoryBackend()
+		// small pages so that every readdir spans several
+		b.PageSize = 2
+		return b, func() {}
+	}},
+	{"fake", func() (fs.Backend, func()) {
+		srv := fakedrive.NewServer()
+		client := aliyun.NewClient(srv.Endpoints())
+		rr := client.RefreshToken(context.Background(), srv.RefreshToken())
+		config := model.Config{DriveId: rr.DefaultDriveId, Token: rr.AccessToken, RefreshToken: rr.RefreshToken}
+		utils.AccessToken = rr.AccessToken
+		utils.DriveId = rr.DefaultDriveId
+		return fs.NewAliyunBackend(client, config), srv.Close
+	}},
+	{"persistent", func() (fs.Backend, func()) {
+		dir, err := ioutil.TempDir("", "fscheck")
+		if err != nil {
+			panic(err)
+		}
+		db, err := fs.OpenMetaDB(filepath.Join(dir, "meta.db"))
+		if err != nil {
+			panic(err)
+		}
+		inner := fs.NewMemoryBackend()
+		inner.PageSize = 2
+		b := fs.NewPersistentBackend(inner, db, "mem", false)
+		return b, func() {
+			b.Close()
+			os.RemoveAll(dir)
+		}
+	}},
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+// fscheck runs the fstest scenarios against the in-memory backend and
+// against the Aliyun backend talking to a fake drive server, and the
+// in-memory backend behind a metadata db, no kernel needed. It exits with status 1 if any scenario fails.
+//
+//	go run -race ./fs/fstest/fscheck -v
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/jacobsa/syncutil"
+	"goaldfuse/fs/fstest"
+)
+
+func main() {
+	run := flag.String("run", "", "only run scenarios matching this regexp")
+	only := flag.String("backend", "", "only run against this backend, memory, fake or persistent")
+	verbose := flag.Bool("v", false, "print every scenario")
+	flag.Parse()
+
+	re, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	syncutil.EnableInvariantChecking()
+
+	failed := 0
+	for _, b := range fstest.Backends {
+		if *only != "" && *only != b.Name {
+			continue
+		}
+		for _, s := range fstest.Scenarios {
+			if !re.MatchString(s.Name) {
+				continue
+			}
+			backend, closeBackend := b.New()
+			err := fstest.RunScenario(s, fstest.New(backend))
+			closeBackend()
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL %v/%v: %v\n", b.Name, s.Name, err)
+			} else if *verbose {
+				fmt.Printf("ok   %v/%v\n", b.Name, s.Name)
+			}
+		}
+	}
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,552 @@
+//go:build !windows
+// +build !windows
+
+// Package fstest drives the fuseops handlers of fs.AliYunDriveFs directly,
+// without a kernel or /dev/fuse, and checks the file system invariants and
+// the resulting remote tree after each step. The scenarios in this package
+// are run by go test and by fscheck:
+//
+//	go test -race ./fs/fstest
+//	go run -race ./fs/fstest/fscheck
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"goaldfuse/aliyun/model"
+	"goaldfuse/common"
+	"goaldfuse/fs"
+)
+
+// Harness plays the kernel's part for one file system. It remembers how
+// many lookup references the kernel would hold for every inode and which
+// handles it has open so that Check can compare them with the tables of
+// the file system.
+type Harness struct {
+	FS      *fs.AliYunDriveFs
+	Backend fs.Backend
+
+	mu      sync.Mutex
+	lookups map[fuseops.InodeID]uint64
+	handles map[fuseops.HandleID]bool
+}
+
+func New(backend fs.Backend) *Harness {
+	return NewWithFlags(backend, &common.FlagStorage{})
+}
+
+func NewWithFlags(backend fs.Backend, flags *common.FlagStorage) *Harness {
+	return &Harness{
+		FS:      fs.NewAliYunDriveFs(backend, flags),
+		Backend: backend,
+		lookups: map[fuseops.InodeID]uint64{fuseops.RootInodeID: 1},
+		handles: map[fuseops.HandleID]bool{},
+	}
+}
+
+// call runs one operation, turning a panic into an error that carries the
+// stack.
+func call(name string, f func() error) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v panicked: %v\n%s", name, e, debug.Stack())
+		}
+	}()
+	return f()
+}
+
+func (h *Harness) ref(id fuseops.InodeID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lookups[id]++
+}
+
+// opened records a handle returned by the file system, which must not
+// hand out an id that is still open.
+func (h *Harness) opened(id fuseops.HandleID) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handles[id] {
+		return fmt.Errorf("handle %v handed out twice", id)
+	}
+	h.handles[id] = true
+	return nil
+}
+
+func (h *Harness) closed(id fuseops.HandleID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.handles, id)
+}
+
+func (h *Harness) LookUp(parent fuseops.InodeID, name string) (fuseops.ChildInodeEntry, error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err := call("LookUpInode", func() error { return h.FS.LookUpInode(context.Background(), op) })
+	if err == nil {
+		h.ref(op.Entry.Child)
+	}
+	return op.Entry, err
+}
+
+// Resolve looks up every component of p, relative to the root.
+func (h *Harness) Resolve(p string) (fuseops.InodeID, error) {
+	id := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		// the kernel lists a directory before it looks into it
+		if _, err := h.ReadDir(id); err != nil {
+			return 0, fmt.Errorf("readdir %v: %v", p, err)
+		}
+		entry, err := h.LookUp(id, name)
+		if err != nil {
+			return 0, fmt.Errorf("lookup %v in %v: %v", name, p, err)
+		}
+		id = entry.Child
+	}
+	return id, nil
+}
+
+func (h *Harness) GetAttributes(inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	op := &fuseops.GetInodeAttributesOp{Inode: inode}
+	err := call("GetInodeAttributes", func() error { return h.FS.GetInodeAttributes(context.Background(), op) })
+	return op.Attributes, err
+}
+
+func (h *Harness) Chmod(inode fuseops.InodeID, mode os.FileMode) (fuseops.InodeAttributes, error) {
+	op := &fuseops.SetInodeAttributesOp{Inode: inode, Mode: &mode}
+	err := call("SetInodeAttributes", func() error { return h.FS.SetInodeAttributes(context.Background(), op) })
+	return op.Attributes, err
+}
+
+// GetXattr reads the extended attribute name of inode, asking for its
+// size first the way getfattr does.
+func (h *Harness) GetXattr(inode fuseops.InodeID, name string) ([]byte, error) {
+	op := &fuseops.GetXattrOp{Inode: inode, Name: name}
+	if err := call("GetXattr", func() error { return h.FS.GetXattr(context.Background(), op) }); err != nil {
+		return nil, err
+	}
+	op.Dst = make([]byte, op.BytesRead)
+	err := call("GetXattr", func() error { return h.FS.GetXattr(context.Background(), op) })
+	return op.Dst[:op.BytesRead], err
+}
+
+// ListXattr returns the names of the extended attributes of inode.
+func (h *Harness) ListXattr(inode fuseops.InodeID) ([]string, error) {
+	op := &fuseops.ListXattrOp{Inode: inode}
+	if err := call("ListXattr", func() error { return h.FS.ListXattr(context.Background(), op) }); err != nil {
+		return nil, err
+	}
+	op.Dst = make([]byte, op.BytesRead)
+	if err := call("ListXattr", func() error { return h.FS.ListXattr(context.Background(), op) }); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(op.Dst[:op.BytesRead], []byte{0}) {
+		if len(name) != 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func (h *Harness) SetXattr(inode fuseops.InodeID, name string, value []byte, flags uint32) error {
+	op := &fuseops.SetXattrOp{Inode: inode, Name: name, Value: value, Flags: flags}
+	return call("SetXattr", func() error { return h.FS.SetXattr(context.Background(), op) })
+}
+
+func (h *Harness) RemoveXattr(inode fuseops.InodeID, name string) error {
+	op := &fuseops.RemoveXattrOp{Inode: inode, Name: name}
+	return call("RemoveXattr", func() error { return h.FS.RemoveXattr(context.Background(), op) })
+}
+
+// Remote finds the backend entry at p, for changing it behind the file
+// system's back.
+func (h *Harness) Remote(p string) (model.ListModel, error) {
+	h.FS.SyncDeletes()
+	item := model.ListModel{FileId: fs.RootFileId, Type: "folder"}
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		items, err := h.Backend.List(context.Background(), item.FileId)
+		if err != nil {
+			return item, err
+		}
+		found := false
+		for _, it := range items {
+			if it.Name == name {
+				item, found = it, true
+				break
+			}
+		}
+		if !found {
+			return item, fmt.Errorf("%v: %v", p, syscall.ENOENT)
+		}
+	}
+	return item, nil
+}
+
+func (h *Harness) MkDir(parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+	op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: 0755}
+	err := call("MkDir", func() error { return h.FS.MkDir(context.Background(), op) })
+	if err == nil {
+		h.ref(op.Entry.Child)
+	}
+	return op.Entry.Child, err
+}
+
+func (h *Harness) Create(parent fuseops.InodeID, name string) (fuseops.InodeID, fuseops.HandleID, error) {
+	return h.CreateMode(parent, name, 0644)
+}
+
+// CreateMode creates name with the mode left after the umask.
+func (h *Harness) CreateMode(parent fuseops.InodeID, name string, mode os.FileMode) (fuseops.InodeID, fuseops.HandleID, error) {
+	op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: mode}
+	err := call("CreateFile", func() error { return h.FS.CreateFile(context.Background(), op) })
+	if err == nil {
+		h.ref(op.Entry.Child)
+		err = h.opened(op.Handle)
+	}
+	return op.Entry.Child, op.Handle, err
+}
+
+func (h *Harness) Symlink(parent fuseops.InodeID, name string, target string) (fuseops.InodeID, error) {
+	op := &fuseops.CreateSymlinkOp{Parent: parent, Name: name, Target: target}
+	err := call("CreateSymlink", func() error { return h.FS.CreateSymlink(context.Background(), op) })
+	if err == nil {
+		h.ref(op.Entry.Child)
+	}
+	return op.Entry.Child, err
+}
+
+func (h *Harness) ReadSymlink(inode fuseops.InodeID) (string, error) {
+	op := &fuseops.ReadSymlinkOp{Inode: inode}
+	err := call("ReadSymlink", func() error { return h.FS.ReadSymlink(context.Background(), op) })
+	return op.Target, err
+}
+
+func (h *Harness) Open(inode fuseops.InodeID) (fuseops.HandleID, error) {
+	op := &fuseops.OpenFileOp{Inode: inode}
+	err := call("OpenFile", func() error { return h.FS.OpenFile(context.Background(), op) })
+	if err == nil {
+		err = h.opened(op.Handle)
+	}
+	return op.Handle, err
+}
+
+func (h *Harness) Write(inode fuseops.InodeID, handle fuseops.HandleID, offset int64, data []byte) error {
+	op := &fuseops.WriteFileOp{Inode: inode, Handle: handle, Offset: offset, Data: data}
+	return call("WriteFile", func() error { return h.FS.WriteFile(context.Background(), op) })
+}
+
+func (h *Harness) Flush(inode fuseops.InodeID, handle fuseops.HandleID) error {
+	op := &fuseops.FlushFileOp{Inode: inode, Handle: handle}
+	return call("FlushFile", func() error { return h.FS.FlushFile(context.Background(), op) })
+}
+
+func (h *Harness) Release(handle fuseops.HandleID) error {
+	op := &fuseops.ReleaseFileHandleOp{Handle: handle}
+	err := call("ReleaseFileHandle", func() error { return h.FS.ReleaseFileHandle(context.Background(), op) })
+	if err == nil {
+		h.closed(handle)
+	}
+	return err
+}
+
+// Read reads up to n bytes at offset, calling ReadFile in pieces of at
+// most 128KiB like the kernel does.
+func (h *Harness) Read(inode fuseops.InodeID, handle fuseops.HandleID, offset int64, n int) ([]byte, error) {
+	var out []byte
+	for len(out) < n {
+		size := n - len(out)
+		if size > 128*1024 {
+			size = 128 * 1024
+		}
+		op := &fuseops.ReadFileOp{Inode: inode, Handle: handle, Offset: offset + int64(len(out)), Dst: make([]byte, size)}
+		if err := call("ReadFile", func() error { return h.FS.ReadFile(context.Background(), op) }); err != nil {
+			return out, err
+		}
+		if op.BytesRead == 0 {
+			break
+		}
+		out = append(out, op.Dst[:op.BytesRead]...)
+	}
+	return out, nil
+}
+
+// ReadDir opens the directory, reads all of it and releases the handle.
+func (h *Harness) ReadDir(inode fuseops.InodeID) ([]fuseutil.Dirent, error) {
+	handle, err := h.OpenDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuseutil.Dirent
+	var offset fuseops.DirOffset
+	for {
+		var batch []fuseutil.Dirent
+		if batch, err = h.ReadDirAt(inode, handle, offset, 4096); err != nil || len(batch) == 0 {
+			break
+		}
+		entries = append(entries, batch...)
+		offset = batch[len(batch)-1].Offset
+	}
+	if e := h.ReleaseDir(handle); err == nil {
+		err = e
+	}
+	return entries, err
+}
+
+func (h *Harness) OpenDir(inode fuseops.InodeID) (fuseops.HandleID, error) {
+	op := &fuseops.OpenDirOp{Inode: inode}
+	if err := call("OpenDir", func() error { return h.FS.OpenDir(context.Background(), op) }); err != nil {
+		return 0, err
+	}
+	return op.Handle, h.opened(op.Handle)
+}
+
+// ReadDirAt reads the entries from offset on that fit in size bytes, like
+// one getdents call.
+func (h *Harness) ReadDirAt(inode fuseops.InodeID, handle fuseops.HandleID, offset fuseops.DirOffset, size int) ([]fuseutil.Dirent, error) {
+	op := &fuseops.ReadDirOp{Inode: inode, Handle: handle, Offset: offset, Dst: make([]byte, size)}
+	if err := call("ReadDir", func() error { return h.FS.ReadDir(context.Background(), op) }); err != nil {
+		return nil, err
+	}
+	return parseDirents(op.Dst[:op.BytesRead]), nil
+}
+
+func (h *Harness) ReleaseDir(handle fuseops.HandleID) error {
+	op := &fuseops.ReleaseDirHandleOp{Handle: handle}
+	err := call("ReleaseDirHandle", func() error { return h.FS.ReleaseDirHandle(context.Background(), op) })
+	if err == nil {
+		h.closed(handle)
+	}
+	return err
+}
+
+// FsyncDir opens the directory inode, fsyncs and closes it.
+func (h *Harness) FsyncDir(inode fuseops.InodeID) error {
+	handle, err := h.OpenDir(inode)
+	if err != nil {
+		return err
+	}
+	op := &fuseops.SyncFileOp{Inode: inode, Handle: handle}
+	err = call("SyncFile", func() error { return h.FS.SyncFile(context.Background(), op) })
+	if e := h.ReleaseDir(handle); err == nil {
+		err = e
+	}
+	return err
+}
+
+// parseDirents decodes the buffer filled by fuseutil.WriteDirent.
+func parseDirents(buf []byte) (entries []fuseutil.Dirent) {
+	for len(buf) >= 24 {
+		d := fuseutil.Dirent{
+			Inode:  fuseops.InodeID(binary.LittleEndian.Uint64(buf[0:])),
+			Offset: fuseops.DirOffset(binary.LittleEndian.Uint64(buf[8:])),
+			Type:   fuseutil.DirentType(binary.LittleEndian.Uint32(buf[20:])),
+		}
+		nameLen := int(binary.LittleEndian.Uint32(buf[16:]))
+		d.Name = string(buf[24 : 24+nameLen])
+		entries = append(entries, d)
+		size := (24 + nameLen + 7) &^ 7
+		if size > len(buf) {
+			break
+		}
+		buf = buf[size:]
+	}
+	return
+}
+
+// Names returns the entry names other than . and .., sorted.
+func Names(entries []fuseutil.Dirent) []string {
+	var names []string
+	for _, e := range entries {
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *Harness) Rename(oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string) error {
+	op := &fuseops.RenameOp{OldParent: oldParent, OldName: oldName, NewParent: newParent, NewName: newName}
+	return call("Rename", func() error { return h.FS.Rename(context.Background(), op) })
+}
+
+func (h *Harness) Unlink(parent fuseops.InodeID, name string) error {
+	op := &fuseops.UnlinkOp{Parent: parent, Name: name}
+	return call("Unlink", func() error { return h.FS.Unlink(context.Background(), op) })
+}
+
+func (h *Harness) RmDir(parent fuseops.InodeID, name string) error {
+	op := &fuseops.RmDirOp{Parent: parent, Name: name}
+	return call("RmDir", func() error { return h.FS.RmDir(context.Background(), op) })
+}
+
+// Forget drops n of the kernel's references to inode.
+func (h *Harness) Forget(inode fuseops.InodeID, n uint64) error {
+	h.mu.Lock()
+	if h.lookups[inode] < n {
+		h.mu.Unlock()
+		return fmt.Errorf("forget %v of inode %v which has %v references", n, inode, h.lookups[inode])
+	}
+	h.lookups[inode] -= n
+	if h.lookups[inode] == 0 {
+		delete(h.lookups, inode)
+	}
+	h.mu.Unlock()
+	op := &fuseops.ForgetInodeOp{Inode: inode, N: n}
+	return call("ForgetInode", func() error { return h.FS.ForgetInode(context.Background(), op) })
+}
+
+// ForgetAll forgets every inode but the root, as the kernel does when it
+// drops its caches.
+func (h *Harness) ForgetAll() error {
+	h.mu.Lock()
+	lookups := make(map[fuseops.InodeID]uint64)
+	for id, n := range h.lookups {
+		if id != fuseops.RootInodeID {
+			lookups[id] = n
+		}
+	}
+	h.mu.Unlock()
+	for id, n := range lookups {
+		if err := h.Forget(id, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check verifies the inode and handle tables against the references the
+// kernel holds.
+func (h *Harness) Check() error {
+	h.mu.Lock()
+	lookups := make(map[fuseops.InodeID]uint64, len(h.lookups))
+	for id, n := range h.lookups {
+		lookups[id] = n
+	}
+	handles := len(h.handles)
+	h.mu.Unlock()
+	open := h.FS.OpenHandles()
+	for _, handle := range open {
+		h.mu.Lock()
+		known := h.handles[handle.Id]
+		h.mu.Unlock()
+		if !known {
+			return fmt.Errorf("handle %v on %v was never returned or is already released", handle.Id, handle.Path)
+		}
+	}
+	if len(open) != handles {
+		return fmt.Errorf("%v handles open but the file system lists %v", handles, len(open))
+	}
+	return h.FS.CheckInvariants(lookups)
+}
+
+// Folder is the size RemoteTree reports for folders.
+const Folder = -1
+
+// RemoteTree lists the backend from the root, mapping every path to its
+// size or Folder, once the queued deletes went out.
+func (h *Harness) RemoteTree() (map[string]int64, error) {
+	h.FS.SyncDeletes()
+	tree := make(map[string]int64)
+	var walk func(id string, dir string) error
+	walk = func(id string, dir string) error {
+		items, err := h.Backend.List(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			p := path.Join(dir, item.Name)
+			if item.Type == "folder" {
+				tree[p] = Folder
+				if err = walk(item.FileId, p); err != nil {
+					return err
+				}
+			} else {
+				tree[p] = item.Size
+			}
+		}
+		return nil
+	}
+	return tree, walk(fs.RootFileId, "")
+}
+
+// ExpectTree compares the remote tree with want.
+func (h *Harness) ExpectTree(want map[string]int64) error {
+	got, err := h.RemoteTree()
+	if err != nil {
+		return err
+	}
+	var diff []string
+	for p, size := range want {
+		if s, ok := got[p]; !ok {
+			diff = append(diff, "missing "+p)
+		} else if s != size {
+			diff = append(diff, fmt.Sprintf("%v has size %v, want %v", p, s, size))
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			diff = append(diff, "unexpected "+p)
+		}
+	}
+	if len(diff) != 0 {
+		sort.Strings(diff)
+		return fmt.Errorf("remote tree: %v", strings.Join(diff, ", "))
+	}
+	return nil
+}
+
+// WriteFile creates name in parent with data, flushes and releases it, the
+// way `cp` would.
+func (h *Harness) WriteFile(parent fuseops.InodeID, name string, data []byte) (fuseops.InodeID, error) {
+	inode, handle, err := h.Create(parent, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 0 {
+		if err = h.Write(inode, handle, 0, data); err != nil {
+			return inode, err
+		}
+	}
+	if err = h.Flush(inode, handle); err != nil {
+		return inode, err
+	}
+	return inode, h.Release(handle)
+}
+
+// ReadFile opens inode and reads all of it.
+func (h *Harness) ReadFile(inode fuseops.InodeID, size int) ([]byte, error) {
+	handle, err := h.Open(inode)
+	if err != nil {
+		return nil, err
+	}
+	data, err := h.Read(inode, handle, 0, size+1)
+	if e := h.Release(handle); err == nil {
+		err = e
+	}
+	return data, err
+}
+
+// IsErrno reports whether err is the given errno.
+func IsErrno(err error, errno syscall.Errno) bool {
+	e, ok := err.(syscall.Errno)
+	return ok && e == errno
+}
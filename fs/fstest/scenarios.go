@@ -0,0 +1,1684 @@
+//go:build !windows
+// +build !windows
+
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"goaldfuse/common"
+	"goaldfuse/fs"
+)
+
+// Scenario is a sequence of operations run against a fresh file system.
+type Scenario struct {
+	Name string
+	Run  func(h *Harness) error
+}
+
+// Scenarios are the sequences run by TestScenarios and fscheck.
+var Scenarios = []Scenario{
+	{"mkdir-write-read", mkdirWriteRead},
+	{"nested-readdir", nestedReadDir},
+	{"rename-file", renameFile},
+	{"move-file", moveFile},
+	{"move-rename", moveRename},
+	{"rename-dir", renameDir},
+	{"rename-over", renameOver},
+	{"unlink", unlink},
+	{"rmdir", rmdir},
+	{"rm-rf", rmRf},
+	{"failed-delete", failedDelete},
+	{"forget", forget},
+	{"concurrent", concurrent},
+	{"parallel-opendir", parallelOpenDir},
+	{"stable-inode", stableInode},
+	{"evict-listings", evictListings},
+	{"remote-change", remoteChange},
+	{"prefetch", prefetch},
+	{"huge-folder", hugeFolder},
+	{"trash", trash},
+	{"xattr", xattr},
+	{"user-xattr", userXattr},
+	{"starred", starred},
+	{"symlink", symlink},
+	{"posix", posix},
+}
+
+// RunScenario runs s on h and checks the invariants afterwards.
+func RunScenario(s Scenario, h *Harness) error {
+	if err := s.Run(h); err != nil {
+		return err
+	}
+	return h.Check()
+}
+
+const root = fuseops.RootInodeID
+
+func expectNames(h *Harness, dir fuseops.InodeID, want ...string) error {
+	entries, err := h.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	got := Names(entries)
+	if dir == root {
+		// the recycle bin and the starred entries are always there
+		got = without(without(got, ".trash"), ".starred")
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("readdir %v = %v, want %v", dir, got, want)
+	}
+	return nil
+}
+
+func without(names []string, name string) []string {
+	kept := names[:0]
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+func expectContent(h *Harness, p string, want []byte) error {
+	inode, err := h.Resolve(p)
+	if err != nil {
+		return err
+	}
+	got, err := h.ReadFile(inode, len(want))
+	if err != nil {
+		return fmt.Errorf("read %v: %v", p, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read %v = %q, want %q", p, got, want)
+	}
+	return nil
+}
+
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+func mkdirWriteRead(h *Harness) error {
+	dir, err := h.MkDir(root, "docs")
+	if err != nil {
+		return err
+	}
+	data := pattern(300 * 1024)
+	if _, err = h.WriteFile(dir, "big.bin", data); err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(dir, "empty", nil); err != nil {
+		return err
+	}
+	if err = h.Check(); err != nil {
+		return err
+	}
+	if err = expectNames(h, dir, "big.bin", "empty"); err != nil {
+		return err
+	}
+	if err = expectContent(h, "docs/big.bin", data); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"docs": Folder, "docs/big.bin": int64(len(data)), "docs/empty": 0})
+}
+
+func nestedReadDir(h *Harness) error {
+	want := map[string]int64{}
+	parent := fuseops.InodeID(root)
+	p := ""
+	for _, name := range []string{"a", "b", "c"} {
+		dir, err := h.MkDir(parent, name)
+		if err != nil {
+			return err
+		}
+		p += name
+		want[p] = Folder
+		for i := 0; i < 3; i++ {
+			f := "f" + strconv.Itoa(i)
+			if _, err = h.WriteFile(dir, f, []byte(p)); err != nil {
+				return err
+			}
+			want[p+"/"+f] = int64(len(p))
+		}
+		parent = dir
+		p += "/"
+	}
+	if err := h.ForgetAll(); err != nil {
+		return err
+	}
+	if err := expectContent(h, "a/b/c/f2", []byte("a/b/c")); err != nil {
+		return err
+	}
+	// the old inode ids are gone after the forget
+	dir, err := h.Resolve("a/b/c")
+	if err != nil {
+		return err
+	}
+	if err = expectNames(h, dir, "f0", "f1", "f2"); err != nil {
+		return err
+	}
+	return h.ExpectTree(want)
+}
+
+func renameFile(h *Harness) error {
+	if _, err := h.WriteFile(root, "old", []byte("content")); err != nil {
+		return err
+	}
+	if err := h.Rename(root, "old", root, "new"); err != nil {
+		return err
+	}
+	if _, err := h.LookUp(root, "old"); !IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("lookup of renamed file: %v", err)
+	}
+	if err := expectContent(h, "new", []byte("content")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"new": 7})
+}
+
+func moveFile(h *Harness) error {
+	src, err := h.MkDir(root, "src")
+	if err != nil {
+		return err
+	}
+	dst, err := h.MkDir(root, "dst")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(src, "f", []byte("moved")); err != nil {
+		return err
+	}
+	if err = h.Rename(src, "f", dst, "f"); err != nil {
+		return err
+	}
+	if err = expectNames(h, src); err != nil {
+		return err
+	}
+	if err = expectContent(h, "dst/f", []byte("moved")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"src": Folder, "dst": Folder, "dst/f": 5})
+}
+
+// moveRename moves a file into a folder that has an entry with its old
+// name, which must be left alone, then over that entry.
+func moveRename(h *Harness) error {
+	a, err := h.MkDir(root, "a")
+	if err != nil {
+		return err
+	}
+	b, err := h.MkDir(root, "b")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(a, "x", []byte("from a")); err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(b, "x", []byte("b")); err != nil {
+		return err
+	}
+	if err = h.Rename(a, "x", b, "y"); err != nil {
+		return err
+	}
+	if err = expectContent(h, "b/x", []byte("b")); err != nil {
+		return err
+	}
+	if err = expectContent(h, "b/y", []byte("from a")); err != nil {
+		return err
+	}
+	if err = h.ExpectTree(map[string]int64{"a": Folder, "b": Folder, "b/x": 1, "b/y": 6}); err != nil {
+		return err
+	}
+
+	if _, err = h.WriteFile(a, "z", []byte("over")); err != nil {
+		return err
+	}
+	if err = h.Rename(a, "z", b, "x"); err != nil {
+		return err
+	}
+	if err = expectNames(h, b, "x", "y"); err != nil {
+		return err
+	}
+	if err = expectContent(h, "b/x", []byte("over")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"a": Folder, "b": Folder, "b/x": 4, "b/y": 6})
+}
+
+// renameDir renames and moves folders with content, checks what can't be
+// replaced and moves a file still being written.
+func renameDir(h *Harness) error {
+	a, err := h.MkDir(root, "a")
+	if err != nil {
+		return err
+	}
+	b, err := h.MkDir(a, "b")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(b, "f", []byte("deep")); err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(root, "x", []byte("x")); err != nil {
+		return err
+	}
+	if _, err = h.MkDir(root, "empty"); err != nil {
+		return err
+	}
+	full, err := h.MkDir(root, "full")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(full, "g", []byte("g")); err != nil {
+		return err
+	}
+
+	if err = h.Rename(root, "a", root, "c"); err != nil {
+		return err
+	}
+	if _, err = h.LookUp(root, "a"); !IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("lookup of renamed folder: %v", err)
+	}
+	if err = expectContent(h, "c/b/f", []byte("deep")); err != nil {
+		return err
+	}
+	// b is still the same inode, now under c
+	if _, err = h.LookUp(b, "f"); err != nil {
+		return err
+	}
+	if err = h.Rename(a, "b", root, "b2"); err != nil {
+		return err
+	}
+	if err = expectContent(h, "b2/f", []byte("deep")); err != nil {
+		return err
+	}
+	if _, err = h.MkDir(a, "sub"); err != nil {
+		return err
+	}
+	sub, err := h.Resolve("c/sub")
+	if err != nil {
+		return err
+	}
+	if err = h.Rename(root, "c", sub, "c"); !IsErrno(err, syscall.EINVAL) {
+		return fmt.Errorf("moving a folder into itself: %v", err)
+	}
+
+	for _, c := range []struct {
+		from, to string
+		want     syscall.Errno
+	}{
+		{"x", "empty", syscall.EISDIR},
+		{"c", "x", syscall.ENOTDIR},
+		{"b2", "full", syscall.ENOTEMPTY},
+	} {
+		if err = h.Rename(root, c.from, root, c.to); !IsErrno(err, c.want) {
+			return fmt.Errorf("rename %v over %v: %v, want %v", c.from, c.to, err, c.want)
+		}
+	}
+	if err = h.Rename(root, "b2", root, "empty"); err != nil {
+		return fmt.Errorf("rename over an empty folder: %v", err)
+	}
+
+	// a file not uploaded yet is uploaded where it was moved to
+	inode, handle, err := h.Create(root, "late")
+	if err != nil {
+		return err
+	}
+	if err = h.Write(inode, handle, 0, []byte("late")); err != nil {
+		return err
+	}
+	if err = h.Rename(root, "late", a, "late"); err != nil {
+		return err
+	}
+	if err = h.Flush(inode, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	if err = expectContent(h, "empty/f", []byte("deep")); err != nil {
+		return err
+	}
+	if err = expectContent(h, "c/late", []byte("late")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{
+		"c": Folder, "c/sub": Folder, "c/late": 4,
+		"empty": Folder, "empty/f": 4,
+		"full": Folder, "full/g": 1,
+		"x": 1,
+	})
+}
+
+// renameOver saves the way editors do, writing a temporary file and
+// renaming it over the original, once with the temporary file uploaded
+// and once with it still open.
+func renameOver(h *Harness) error {
+	old, err := h.WriteFile(root, "doc", []byte("v1"))
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(root, "doc.tmp", []byte("v2!")); err != nil {
+		return err
+	}
+	if err = h.Rename(root, "doc.tmp", root, "doc"); err != nil {
+		return err
+	}
+	if err = expectNames(h, root, "doc"); err != nil {
+		return err
+	}
+	if err = expectContent(h, "doc", []byte("v2!")); err != nil {
+		return err
+	}
+	if err = h.ExpectTree(map[string]int64{"doc": 3}); err != nil {
+		return err
+	}
+	if err = h.Forget(old, 1); err != nil {
+		return err
+	}
+
+	inode, handle, err := h.Create(root, "doc.new")
+	if err != nil {
+		return err
+	}
+	if err = h.Write(inode, handle, 0, []byte("v3..")); err != nil {
+		return err
+	}
+	if err = h.Rename(root, "doc.new", root, "doc"); err != nil {
+		return err
+	}
+	if err = h.Flush(inode, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	if err = expectContent(h, "doc", []byte("v3..")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"doc": 4})
+}
+
+func unlink(h *Harness) error {
+	inode, err := h.WriteFile(root, "gone", []byte("x"))
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(root, "kept", []byte("y")); err != nil {
+		return err
+	}
+	if err = h.Unlink(root, "gone"); err != nil {
+		return err
+	}
+	if err = h.Unlink(root, "gone"); !IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("second unlink: %v", err)
+	}
+	if err = h.Forget(inode, 1); err != nil {
+		return err
+	}
+	if err = expectNames(h, root, "kept"); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"kept": 1})
+}
+
+func rmdir(h *Harness) error {
+	if _, err := h.MkDir(root, "empty"); err != nil {
+		return err
+	}
+	if err := h.RmDir(root, "empty"); err != nil {
+		return fmt.Errorf("rmdir: %v", err)
+	}
+	if err := h.RmDir(root, "empty"); !IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("second rmdir: %v", err)
+	}
+	if err := expectNames(h, root); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{})
+}
+
+// failingDeletes is a backend whose deletes all fail.
+type failingDeletes struct {
+	fs.Backend
+}
+
+func (failingDeletes) Delete(ctx context.Context, fileId string, parentId string) error {
+	return syscall.EACCES
+}
+
+// failedDelete unlinks a file whose remote delete fails. The unlink
+// succeeds, the next fsync of the folder reports the error once and the
+// file is listed again.
+func failedDelete(h *Harness) error {
+	dir, err := h.MkDir(root, "d")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(dir, "f", []byte("x")); err != nil {
+		return err
+	}
+
+	mount := New(failingDeletes{h.Backend})
+	d, err := mount.Resolve("d")
+	if err != nil {
+		return err
+	}
+	if err = mount.FsyncDir(d); err != nil {
+		return fmt.Errorf("fsync before the unlink: %v", err)
+	}
+	f, err := mount.LookUp(d, "f")
+	if err != nil {
+		return err
+	}
+	if err = mount.Unlink(d, "f"); err != nil {
+		return err
+	}
+	if err = mount.Forget(f.Child, 1); err != nil {
+		return err
+	}
+	if err = mount.FsyncDir(d); !IsErrno(err, syscall.EACCES) {
+		return fmt.Errorf("fsync after the failed delete = %v, want EACCES", err)
+	}
+	if err = mount.FsyncDir(d); err != nil {
+		return fmt.Errorf("second fsync = %v, the failure was reported already", err)
+	}
+	if n := mount.FS.Stats().FailedDeletes; n != 1 {
+		return fmt.Errorf("%v failed deletes counted", n)
+	}
+	if err = expectNames(mount, d, "f"); err != nil {
+		return err
+	}
+	if err = mount.Check(); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"d": Folder, "d/f": 1})
+}
+
+// rmRf deletes a tree the way rm -rf does, an unlink or rmdir at a time
+// depth first, and recreates it right away.
+func rmRf(h *Harness) error {
+	build, err := h.MkDir(root, "build")
+	if err != nil {
+		return err
+	}
+	obj, err := h.MkDir(build, "obj")
+	if err != nil {
+		return err
+	}
+	remote, err := h.Remote("build/obj")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 150; i++ {
+		if err = upload(h, remote.FileId, fmt.Sprintf("o%03d", i), []byte("o")); err != nil {
+			return err
+		}
+	}
+	if _, err = h.WriteFile(build, "out", []byte("out")); err != nil {
+		return err
+	}
+	if err = h.RmDir(root, "build"); !IsErrno(err, syscall.ENOTEMPTY) {
+		return fmt.Errorf("rmdir of a full folder: %v", err)
+	}
+	if err = h.RmDir(build, "out"); !IsErrno(err, syscall.ENOTDIR) {
+		return fmt.Errorf("rmdir of a file: %v", err)
+	}
+
+	var rm func(dir fuseops.InodeID) error
+	rm = func(dir fuseops.InodeID) error {
+		entries, err := h.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			if e.Type == fuseutil.DT_Directory {
+				child, err := h.LookUp(dir, e.Name)
+				if err != nil {
+					return err
+				}
+				if err = rm(child.Child); err != nil {
+					return err
+				}
+				err = h.RmDir(dir, e.Name)
+			} else {
+				err = h.Unlink(dir, e.Name)
+			}
+			if err != nil {
+				return fmt.Errorf("removing %v: %v", e.Name, err)
+			}
+		}
+		return nil
+	}
+	if err = rm(build); err != nil {
+		return err
+	}
+	if err = h.RmDir(root, "build"); err != nil {
+		return err
+	}
+	if err = expectNames(h, root); err != nil {
+		return err
+	}
+	if _, err = h.LookUp(obj, "o001"); !IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("lookup in a removed folder: %v", err)
+	}
+
+	// the old build must be gone remotely before the new one is made
+	if build, err = h.MkDir(root, "build"); err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(build, "out", []byte("new")); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"build": Folder, "build/out": 3})
+}
+
+func forget(h *Harness) error {
+	dir, err := h.MkDir(root, "d")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(dir, "f", []byte("1")); err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = h.Resolve("d/f"); err != nil {
+			return err
+		}
+		if err = h.Check(); err != nil {
+			return err
+		}
+		if err = h.ForgetAll(); err != nil {
+			return err
+		}
+	}
+	return expectContent(h, "d/f", []byte("1"))
+}
+
+// concurrent runs independent workers side by side, meant for -race.
+func concurrent(h *Harness) error {
+	const workers = 4
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := "w" + strconv.Itoa(w)
+			dir, err := h.MkDir(root, name)
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			for i := 0; i < 3; i++ {
+				if _, err = h.WriteFile(dir, strconv.Itoa(i), []byte(name)); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+			errs[w] = expectNames(h, dir, "0", "1", "2")
+		}(w)
+	}
+	wg.Wait()
+	want := map[string]int64{}
+	for w, err := range errs {
+		if err != nil {
+			return fmt.Errorf("worker %v: %v", w, err)
+		}
+		name := "w" + strconv.Itoa(w)
+		want[name] = Folder
+		for i := 0; i < 3; i++ {
+			want[name+"/"+strconv.Itoa(i)] = int64(len(name))
+		}
+	}
+	return h.ExpectTree(want)
+}
+
+// parallelOpenDir lists one directory from many goroutines at once, like a
+// file manager opening a folder in several views.
+func parallelOpenDir(h *Harness) error {
+	for i := 0; i < 3; i++ {
+		if _, err := h.WriteFile(root, strconv.Itoa(i), nil); err != nil {
+			return err
+		}
+	}
+	const readers = 8
+	errs := make([]error, readers)
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 5 && errs[r] == nil; i++ {
+				errs[r] = expectNames(h, root, "0", "1", "2")
+			}
+		}(r)
+	}
+	wg.Wait()
+	for r, err := range errs {
+		if err != nil {
+			return fmt.Errorf("reader %v: %v", r, err)
+		}
+	}
+	if err := h.Release(12345); !IsErrno(err, syscall.EBADF) {
+		return fmt.Errorf("release of unknown handle: %v", err)
+	}
+	return nil
+}
+
+// stableInode checks that a file keeps its inode number when it is
+// forgotten and looked up again, renamed, and after a remount.
+func stableInode(h *Harness) error {
+	if _, err := h.MkDir(root, "d"); err != nil {
+		return err
+	}
+	if _, err := h.WriteFile(root, "f", []byte("x")); err != nil {
+		return err
+	}
+	if err := h.ForgetAll(); err != nil {
+		return err
+	}
+	f, err := h.Resolve("f")
+	if err != nil {
+		return err
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	if again, err := h.Resolve("f"); err != nil || again != f {
+		return fmt.Errorf("relookup of f = %v, %v, want inode %v", again, err, f)
+	}
+	if err = h.Rename(root, "f", root, "g"); err != nil {
+		return err
+	}
+	if moved, err := h.Resolve("g"); err != nil || moved != f {
+		return fmt.Errorf("lookup of renamed f = %v, %v, want inode %v", moved, err, f)
+	}
+	if err = h.Check(); err != nil {
+		return err
+	}
+	remount := New(h.Backend)
+	if other, err := remount.Resolve("g"); err != nil || other != f {
+		return fmt.Errorf("lookup after remount = %v, %v, want inode %v", other, err, f)
+	}
+	return remount.Check()
+}
+
+// evictListings browses more directories than the listing cache holds and
+// checks that the tables stay bounded while everything remains reachable.
+func evictListings(h *Harness) error {
+	const dirs = 6
+	for d := 0; d < dirs; d++ {
+		dir, err := h.MkDir(root, "d"+strconv.Itoa(d))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 4; i++ {
+			if _, err = h.WriteFile(dir, strconv.Itoa(i), []byte("x")); err != nil {
+				return err
+			}
+		}
+	}
+
+	h = NewWithFlags(h.Backend, &common.FlagStorage{MaxCachedDirs: 2})
+	for d := 0; d < dirs; d++ {
+		dir, err := h.Resolve("d" + strconv.Itoa(d))
+		if err != nil {
+			return err
+		}
+		if err = expectNames(h, dir, "0", "1", "2", "3"); err != nil {
+			return err
+		}
+		if err = h.ForgetAll(); err != nil {
+			return err
+		}
+	}
+	stats := h.FS.Stats()
+	if stats.CachedDirs > 2 || stats.Evictions == 0 {
+		return fmt.Errorf("nothing was evicted: %+v", stats)
+	}
+	// root, its listing and the two cached directories
+	if limit := 1 + dirs + 2*4; stats.Inodes > limit || stats.NameCache > limit {
+		return fmt.Errorf("tables are not bounded: %+v", stats)
+	}
+	if err := expectContent(h, "d0/3", []byte("x")); err != nil {
+		return err
+	}
+
+	// evicted folders are listed again to be known full or empty, the
+	// kernel looks them up first
+	for _, name := range []string{"d1", "d2", "d3"} {
+		if _, err := h.LookUp(root, name); err != nil {
+			return err
+		}
+	}
+	if err := h.RmDir(root, "d1"); !IsErrno(err, syscall.ENOTEMPTY) {
+		return fmt.Errorf("rmdir of an evicted full folder: %v", err)
+	}
+	if err := h.Rename(root, "d2", root, "d3"); !IsErrno(err, syscall.ENOTEMPTY) {
+		return fmt.Errorf("rename over an evicted full folder: %v", err)
+	}
+	if _, err := h.MkDir(root, "empty"); err != nil {
+		return err
+	}
+	if err := h.ForgetAll(); err != nil {
+		return err
+	}
+	h = NewWithFlags(h.Backend, &common.FlagStorage{MaxCachedDirs: 2})
+	for _, name := range []string{"d2", "empty"} {
+		if _, err := h.LookUp(root, name); err != nil {
+			return err
+		}
+	}
+	if err := h.Rename(root, "d2", root, "empty"); err != nil {
+		return fmt.Errorf("rename over an unlisted empty folder: %v", err)
+	}
+	if err := expectContent(h, "empty/3", []byte("x")); err != nil {
+		return err
+	}
+	return h.Check()
+}
+
+// remoteChange changes a directory behind the file system's back, the way
+// the web UI would, and checks that a poll brings the mount in line.
+func remoteChange(h *Harness) error {
+	d, err := h.MkDir(root, "d")
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = h.WriteFile(d, name, []byte("x")); err != nil {
+			return err
+		}
+	}
+	if err = expectNames(h, d, "a", "b", "c"); err != nil {
+		return err
+	}
+	a, err := h.LookUp(d, "a")
+	if err != nil {
+		return err
+	}
+	b, err := h.LookUp(d, "b")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	remoteDir, err := h.Remote("d")
+	if err != nil {
+		return err
+	}
+	remoteA, err := h.Remote("d/a")
+	if err != nil {
+		return err
+	}
+	remoteB, err := h.Remote("d/b")
+	if err != nil {
+		return err
+	}
+	if err = h.Backend.Delete(ctx, remoteA.FileId, remoteDir.FileId); err != nil {
+		return err
+	}
+	if err = h.Backend.Rename(ctx, remoteB.FileId, "b2"); err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{"c": []byte("longer"), "e": []byte("new")} {
+		if err = upload(h, remoteDir.FileId, name, data); err != nil {
+			return err
+		}
+	}
+
+	if n := h.FS.PollChanges(ctx); n == 0 {
+		return fmt.Errorf("poll found no changes")
+	}
+	if err = expectNames(h, d, "b2", "c", "e"); err != nil {
+		return err
+	}
+	if _, err = h.LookUp(d, "a"); err != syscall.ENOENT {
+		return fmt.Errorf("lookup of remotely deleted a = %v, want ENOENT", err)
+	}
+	if _, err = h.GetAttributes(a.Child); err != syscall.ENOENT {
+		return fmt.Errorf("getattr of remotely deleted a = %v, want ENOENT", err)
+	}
+	if _, err = h.LookUp(d, "b"); err != syscall.ENOENT {
+		return fmt.Errorf("lookup of remotely renamed b = %v, want ENOENT", err)
+	}
+	if b2, err := h.LookUp(d, "b2"); err != nil || b2.Child != b.Child {
+		return fmt.Errorf("lookup of b2 = %v, %v, want inode %v", b2.Child, err, b.Child)
+	}
+	if c, err := h.LookUp(d, "c"); err != nil || c.Attributes.Size != 6 {
+		return fmt.Errorf("lookup of rewritten c = size %v, %v, want 6", c.Attributes.Size, err)
+	}
+	if err = expectContent(h, "d/c", []byte("longer")); err != nil {
+		return err
+	}
+	if n := h.FS.PollChanges(ctx); n != 0 {
+		return fmt.Errorf("second poll found %v changes, want none", n)
+	}
+	return nil
+}
+
+// upload stores data as name in parentId directly on the backend.
+func upload(h *Harness, parentId string, name string, data []byte) error {
+	f, err := ioutil.TempFile("", "fstest")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	_, err = h.Backend.Upload(context.Background(), parentId, name, f, int64(len(data)))
+	return err
+}
+
+// prefetch crawls a fresh mount of a small tree, paused at first, then
+// only one subtree of another and last the whole tree of a mount whose
+// listing cache is nearly full, which must not push out what was browsed.
+func prefetch(h *Harness) error {
+	for d := 0; d < 3; d++ {
+		dir, err := h.MkDir(root, "d"+strconv.Itoa(d))
+		if err != nil {
+			return err
+		}
+		sub, err := h.MkDir(dir, "sub")
+		if err != nil {
+			return err
+		}
+		if _, err = h.WriteFile(dir, "f", []byte("x")); err != nil {
+			return err
+		}
+		if _, err = h.WriteFile(sub, "g", []byte("y")); err != nil {
+			return err
+		}
+	}
+
+	mount := New(h.Backend)
+	c := fs.NewCrawler(mount.FS, []string{"/"}, 3)
+	c.Pause()
+	done := make(chan struct{})
+	go func() {
+		c.Run(context.Background())
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if p := c.Progress(); p.Dirs != 0 || !p.Paused {
+		return fmt.Errorf("paused crawler listed %v dirs", p.Dirs)
+	}
+	c.Resume()
+	<-done
+	if p := c.Progress(); p.Dirs != 7 || p.Files != 6 || p.Errors != 0 || p.Queued != 0 {
+		return fmt.Errorf("crawl progress %+v, want 7 dirs and 6 files", p)
+	}
+	if n := mount.FS.Stats().CachedDirs; n != 7 {
+		return fmt.Errorf("%v listings cached after the crawl, want 7", n)
+	}
+	if err := expectContent(mount, "d1/sub/g", []byte("y")); err != nil {
+		return err
+	}
+	if err := mount.Check(); err != nil {
+		return err
+	}
+
+	partial := New(h.Backend)
+	c = fs.NewCrawler(partial.FS, []string{"/d1"}, 1)
+	c.Run(context.Background())
+	if p := c.Progress(); p.Dirs != 2 || p.Files != 2 {
+		return fmt.Errorf("crawl of d1 progress %+v, want 2 dirs and 2 files", p)
+	}
+	if err := partial.Check(); err != nil {
+		return err
+	}
+
+	small := NewWithFlags(h.Backend, &common.FlagStorage{MaxCachedDirs: 3})
+	d2, err := small.Resolve("d2")
+	if err != nil {
+		return err
+	}
+	if err = expectNames(small, d2, "f", "sub"); err != nil {
+		return err
+	}
+	c = fs.NewCrawler(small.FS, []string{"/"}, 2)
+	c.Run(context.Background())
+	if p := c.Progress(); p.Dirs != 7 || p.Errors != 0 {
+		return fmt.Errorf("crawl progress %+v, want 7 dirs", p)
+	}
+	if s := small.FS.Stats(); s.CachedDirs != 3 || s.Evictions != 0 {
+		return fmt.Errorf("crawl into a full listing cache: %+v", s)
+	}
+	return small.Check()
+}
+
+// hugeFolder reads a folder of several pages a few entries at a time, the
+// way getdents does, and checks that the pages are fetched as needed and
+// every entry comes exactly once with increasing offsets.
+func hugeFolder(h *Harness) error {
+	const files = 250
+	big, err := h.MkDir(root, "big")
+	if err != nil {
+		return err
+	}
+	remote, err := h.Remote("big")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < files; i++ {
+		if err = upload(h, remote.FileId, fmt.Sprintf("f%03d", i), []byte("x")); err != nil {
+			return err
+		}
+	}
+
+	handle, err := h.OpenDir(big)
+	if err != nil {
+		return err
+	}
+	cached := h.FS.Stats().CachedDirs
+	seen := make(map[string]bool)
+	var offset fuseops.DirOffset
+	for calls := 0; ; calls++ {
+		batch, err := h.ReadDirAt(big, handle, offset, 256)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if calls == 0 && h.FS.Stats().CachedDirs != cached {
+			return fmt.Errorf("the first getdents read the whole folder")
+		}
+		for _, e := range batch {
+			if e.Offset <= offset {
+				return fmt.Errorf("offset of %v is %v after %v", e.Name, e.Offset, offset)
+			}
+			if seen[e.Name] {
+				return fmt.Errorf("%v listed twice", e.Name)
+			}
+			seen[e.Name] = true
+			offset = e.Offset
+		}
+	}
+	if len(seen) != files+2 {
+		return fmt.Errorf("listed %v entries, want %v", len(seen), files+2)
+	}
+	// reading again from an earlier offset gives the same entries
+	again, err := h.ReadDirAt(big, handle, 100, 256)
+	if err != nil {
+		return err
+	}
+	if len(again) == 0 || again[0].Offset != 101 {
+		return fmt.Errorf("reading again at 100 starts with %+v", again)
+	}
+	if err = h.ReleaseDir(handle); err != nil {
+		return err
+	}
+	if h.FS.Stats().CachedDirs != cached+1 {
+		return fmt.Errorf("the complete listing is not cached")
+	}
+	_, err = h.LookUp(big, "f123")
+	return err
+}
+
+// trash deletes files and a folder, finds them below /.trash where they
+// were deleted from, restores some by moving them out and deletes the
+// rest for good.
+func trash(h *Harness) error {
+	if _, err := h.LookUp(root, ".trash"); IsErrno(err, syscall.ENOENT) {
+		// no recycle bin
+		return nil
+	} else if err != nil {
+		return err
+	}
+	docs, err := h.MkDir(root, "docs")
+	if err != nil {
+		return err
+	}
+	for _, data := range []string{"aaa", "bb"} {
+		if _, err = h.WriteFile(docs, "a", []byte(data)); err != nil {
+			return err
+		}
+		if err = h.Unlink(docs, "a"); err != nil {
+			return err
+		}
+	}
+	if _, err = h.WriteFile(root, "top", []byte("t")); err != nil {
+		return err
+	}
+	if err = h.Unlink(root, "top"); err != nil {
+		return err
+	}
+	if _, err = h.MkDir(root, "old"); err != nil {
+		return err
+	}
+	if err = h.RmDir(root, "old"); err != nil {
+		return err
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+
+	bin, err := h.Resolve(".trash")
+	if err != nil {
+		return err
+	}
+	if docs, err = h.Resolve("docs"); err != nil {
+		return err
+	}
+	if err = expectNames(h, bin, "docs", "old", "top"); err != nil {
+		return err
+	}
+	if err = expectContent(h, ".trash/top", []byte("t")); err != nil {
+		return err
+	}
+	trashedDocs, err := h.LookUp(bin, "docs")
+	if err != nil {
+		return err
+	}
+	entries, err := h.ReadDir(trashedDocs.Child)
+	if err != nil {
+		return err
+	}
+	names := Names(entries)
+	if len(names) != 2 || names[0] != "a" || !strings.HasPrefix(names[1], "a~") {
+		return fmt.Errorf("two deleted a are listed as %v", names)
+	}
+	if _, _, err = h.Create(bin, "new"); !IsErrno(err, syscall.EROFS) {
+		return fmt.Errorf("create in the trash: %v", err)
+	}
+	if err = h.Rename(root, "docs", bin, "docs2"); !IsErrno(err, syscall.EPERM) {
+		return fmt.Errorf("move into the trash: %v", err)
+	}
+
+	// moving out restores, to the same place or elsewhere
+	if err = h.Rename(bin, "top", root, "top"); err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	if err = expectContent(h, "top", []byte("t")); err != nil {
+		return err
+	}
+	if err = h.Rename(trashedDocs.Child, "a", docs, "restored"); err != nil {
+		return fmt.Errorf("restore elsewhere: %v", err)
+	}
+	restored, err := h.Resolve("docs/restored")
+	if err != nil {
+		return err
+	}
+	attrs, err := h.GetAttributes(restored)
+	if err != nil {
+		return err
+	}
+
+	if err = h.Unlink(trashedDocs.Child, names[1]); err != nil {
+		return fmt.Errorf("delete for good: %v", err)
+	}
+	if err = h.RmDir(bin, "docs"); err != nil {
+		return fmt.Errorf("rmdir of an emptied folder: %v", err)
+	}
+	if err = expectNames(h, bin, "old"); err != nil {
+		return err
+	}
+	if err = h.RmDir(root, ".trash"); err != nil {
+		return fmt.Errorf("empty the trash: %v", err)
+	}
+	if err = expectNames(h, bin); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"docs": Folder, "docs/restored": int64(attrs.Size), "top": 1})
+}
+
+// xattr reads the drive's metadata through user.aliyun.* extended
+// attributes, from the listing and after an upload.
+func xattr(h *Harness) error {
+	dir, err := h.MkDir(root, "media")
+	if err != nil {
+		return err
+	}
+	for name, data := range map[string]string{"a.txt": "hello", "b.txt": "hello", "c.txt": "other"} {
+		if _, err = h.WriteFile(dir, name, []byte(data)); err != nil {
+			return err
+		}
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		inode, err := h.Resolve("media/" + name)
+		if err != nil {
+			return err
+		}
+		hash, err := h.GetXattr(inode, "user.aliyun.content_hash")
+		if err != nil {
+			return fmt.Errorf("content_hash of %v: %v", name, err)
+		}
+		hashes[name] = string(hash)
+	}
+	if hashes["a.txt"] != "AAF4C61DDCC5E8A2DABEDE0F3B482CD9AEA9434D" || hashes["b.txt"] != hashes["a.txt"] || hashes["c.txt"] == hashes["a.txt"] {
+		return fmt.Errorf("content hashes %v", hashes)
+	}
+
+	a, err := h.Resolve("media/a.txt")
+	if err != nil {
+		return err
+	}
+	remote, err := h.Remote("media/a.txt")
+	if err != nil {
+		return err
+	}
+	if id, err := h.GetXattr(a, "user.aliyun.file_id"); err != nil || string(id) != remote.FileId {
+		return fmt.Errorf("file_id is %q, %v, want %v", id, err, remote.FileId)
+	}
+	names, err := h.ListXattr(a)
+	if err != nil {
+		return err
+	}
+	listed := strings.Join(names, " ")
+	if !strings.Contains(listed, "user.aliyun.file_id") || !strings.Contains(listed, "user.aliyun.content_hash") {
+		return fmt.Errorf("listxattr = %v", names)
+	}
+	if _, err = h.GetXattr(a, "user.aliyun.nope"); !IsErrno(err, syscall.ENODATA) {
+		return fmt.Errorf("missing xattr: %v", err)
+	}
+	if err = h.SetXattr(a, "user.aliyun.category", []byte("video"), 0); !IsErrno(err, syscall.EPERM) {
+		return fmt.Errorf("setting a read-only xattr: %v", err)
+	}
+	if id, err := h.GetXattr(root, "user.aliyun.file_id"); err != nil || string(id) != fs.RootFileId {
+		return fmt.Errorf("file_id of the root is %q, %v", id, err)
+	}
+
+	// an upload changes the hash
+	handle, err := h.Open(a)
+	if err != nil {
+		return err
+	}
+	if err = h.Write(a, handle, 0, []byte("changed")); err != nil {
+		return err
+	}
+	if err = h.Flush(a, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+	hash, err := h.GetXattr(a, "user.aliyun.content_hash")
+	if err != nil {
+		return err
+	}
+	if string(hash) == hashes["a.txt"] {
+		return fmt.Errorf("content_hash unchanged after an upload")
+	}
+	return nil
+}
+
+// userXattr sets extended attributes that are kept in user_meta, so they
+// survive uploads and show up on another mount of the same drive.
+func userXattr(h *Harness) error {
+	dir, err := h.MkDir(root, "tags")
+	if err != nil {
+		return err
+	}
+	photo, err := h.WriteFile(dir, "photo.jpg", []byte("p"))
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(dir, "other.jpg", []byte("o")); err != nil {
+		return err
+	}
+	remote, err := h.Remote("tags/other.jpg")
+	if err != nil {
+		return err
+	}
+	// what another client keeps in user_meta stays
+	store, ok := h.Backend.(interface {
+		SetUserMeta(ctx context.Context, fileId string, userMeta string) error
+	})
+	if !ok {
+		return nil
+	}
+	if err = store.SetUserMeta(context.Background(), remote.FileId, `{"android_local_file_path":"/sdcard/o.jpg"}`); err != nil {
+		return err
+	}
+
+	if err = h.SetXattr(photo, "user.tags", []byte("red,blue"), 0); err != nil {
+		return fmt.Errorf("setxattr: %v", err)
+	}
+	if err = h.SetXattr(photo, "user.tags", []byte("x"), 0x1); !IsErrno(err, syscall.EEXIST) {
+		return fmt.Errorf("create of an existing xattr: %v", err)
+	}
+	if err = h.SetXattr(photo, "user.missing", []byte("x"), 0x2); !IsErrno(err, syscall.ENODATA) {
+		return fmt.Errorf("replace of a missing xattr: %v", err)
+	}
+	if err = h.SetXattr(photo, "security.selinux", []byte("x"), 0); !IsErrno(err, syscall.ENOTSUP) {
+		return fmt.Errorf("setxattr in the security namespace: %v", err)
+	}
+	names, err := h.ListXattr(photo)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(strings.Join(names, " "), "user.tags") {
+		return fmt.Errorf("listxattr = %v", names)
+	}
+
+	// content rewritten, the tags stay
+	handle, err := h.Open(photo)
+	if err != nil {
+		return err
+	}
+	if err = h.Write(photo, handle, 0, []byte("P")); err != nil {
+		return err
+	}
+	if err = h.Flush(photo, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+	// set before the first upload
+	inode, handle, err := h.Create(dir, "new.jpg")
+	if err != nil {
+		return err
+	}
+	if err = h.SetXattr(inode, "user.tags", []byte("green"), 0); err != nil {
+		return err
+	}
+	if err = h.Flush(inode, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+	other, err := h.Resolve("tags/other.jpg")
+	if err != nil {
+		return err
+	}
+	if err = h.SetXattr(other, "user.tags", []byte("gray"), 0); err != nil {
+		return err
+	}
+
+	// a second mount of the same drive
+	h2 := New(h.Backend)
+	for p, want := range map[string]string{"tags/photo.jpg": "red,blue", "tags/new.jpg": "green", "tags/other.jpg": "gray"} {
+		inode, err := h2.Resolve(p)
+		if err != nil {
+			return err
+		}
+		value, err := h2.GetXattr(inode, "user.tags")
+		if err != nil || string(value) != want {
+			return fmt.Errorf("user.tags of %v on another mount is %q, %v, want %q", p, value, err, want)
+		}
+	}
+	item, err := h.Backend.Stat(context.Background(), remote.FileId)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(item.UserMeta, "android_local_file_path") {
+		return fmt.Errorf("user_meta of another client lost: %v", item.UserMeta)
+	}
+
+	if err = h.RemoveXattr(photo, "user.tags"); err != nil {
+		return err
+	}
+	if err = h.RemoveXattr(photo, "user.tags"); !IsErrno(err, syscall.ENODATA) {
+		return fmt.Errorf("second removexattr: %v", err)
+	}
+	if _, err = h.GetXattr(photo, "user.tags"); !IsErrno(err, syscall.ENODATA) {
+		return fmt.Errorf("getxattr after removexattr: %v", err)
+	}
+	return expectContent(h, "tags/photo.jpg", []byte("P"))
+}
+
+// starred stars entries through their user.aliyun.starred xattr, finds
+// them in /.starred and unstars them from there.
+func starred(h *Harness) error {
+	if _, err := h.LookUp(root, ".starred"); IsErrno(err, syscall.ENOENT) {
+		// the backend can't star
+		return nil
+	} else if err != nil {
+		return err
+	}
+	a, err := h.MkDir(root, "a")
+	if err != nil {
+		return err
+	}
+	b, err := h.MkDir(root, "b")
+	if err != nil {
+		return err
+	}
+	if _, err = h.MkDir(a, "proj"); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		dir  fuseops.InodeID
+		name string
+	}{{a, "report.txt"}, {b, "report.txt"}, {a, "notes.txt"}} {
+		if _, err = h.WriteFile(f.dir, f.name, []byte("r")); err != nil {
+			return err
+		}
+	}
+	for _, p := range []string{"a/report.txt", "b/report.txt", "a/proj"} {
+		inode, err := h.Resolve(p)
+		if err != nil {
+			return err
+		}
+		if err = h.SetXattr(inode, "user.aliyun.starred", []byte("1"), 0); err != nil {
+			return fmt.Errorf("starring %v: %v", p, err)
+		}
+	}
+	report, err := h.Resolve("a/report.txt")
+	if err != nil {
+		return err
+	}
+	if err = h.SetXattr(report, "user.aliyun.starred", []byte("maybe"), 0); !IsErrno(err, syscall.EINVAL) {
+		return fmt.Errorf("starring with a bad value: %v", err)
+	}
+	if value, err := h.GetXattr(report, "user.aliyun.starred"); err != nil || string(value) != "true" {
+		return fmt.Errorf("user.aliyun.starred = %q, %v", value, err)
+	}
+
+	bin, err := h.Resolve(".starred")
+	if err != nil {
+		return err
+	}
+	entries, err := h.ReadDir(bin)
+	if err != nil {
+		return err
+	}
+	names := Names(entries)
+	if len(names) != 3 || names[0] != "proj" || names[1] != "report.txt" || !strings.HasPrefix(names[2], "report.txt~") {
+		return fmt.Errorf("starred entries are %v", names)
+	}
+	if err = expectContent(h, ".starred/report.txt", []byte("r")); err != nil {
+		return err
+	}
+	if _, _, err = h.Create(bin, "new"); !IsErrno(err, syscall.EROFS) {
+		return fmt.Errorf("create in .starred: %v", err)
+	}
+	if err = h.Rename(a, "notes.txt", bin, "notes.txt"); !IsErrno(err, syscall.EPERM) {
+		return fmt.Errorf("move into .starred: %v", err)
+	}
+
+	// unlink and rmdir unstar
+	if err = h.RmDir(bin, "proj"); err != nil {
+		return fmt.Errorf("rmdir in .starred: %v", err)
+	}
+	if err = h.Unlink(bin, "report.txt"); err != nil {
+		return fmt.Errorf("unlink in .starred: %v", err)
+	}
+	// the other one no longer needs an alias
+	if err = expectNames(h, bin, "report.txt"); err != nil {
+		return err
+	}
+	other, err := h.LookUp(bin, "report.txt")
+	if err != nil {
+		return err
+	}
+	if err = h.RemoveXattr(other.Child, "user.aliyun.starred"); err != nil {
+		return err
+	}
+	if err = expectNames(h, bin); err != nil {
+		return err
+	}
+	for _, p := range []string{"a/report.txt", "b/report.txt", "a/proj"} {
+		item, err := h.Remote(p)
+		if err != nil {
+			return err
+		}
+		if item.Starred {
+			return fmt.Errorf("%v is still starred", p)
+		}
+	}
+	return h.ExpectTree(map[string]int64{"a": Folder, "a/proj": Folder, "a/report.txt": 1, "a/notes.txt": 1,
+		"b": Folder, "b/report.txt": 1})
+}
+
+// symlink makes symlinks, which are files holding the target on the drive,
+// and finds them again after the inodes are forgotten.
+func symlink(h *Harness) error {
+	dir, err := h.MkDir(root, "repo")
+	if err != nil {
+		return err
+	}
+	if _, err = h.WriteFile(dir, "README", []byte("hi")); err != nil {
+		return err
+	}
+	link, err := h.Symlink(dir, "readme", "README")
+	if IsErrno(err, syscall.EPERM) {
+		// the backend can't mark symlinks
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err = h.Symlink(dir, "README", "elsewhere"); !IsErrno(err, syscall.EEXIST) {
+		return fmt.Errorf("symlink over a file: %v", err)
+	}
+	if target, err := h.ReadSymlink(link); err != nil || target != "README" {
+		return fmt.Errorf("readlink = %q, %v", target, err)
+	}
+	attrs, err := h.GetAttributes(link)
+	if err != nil {
+		return err
+	}
+	if attrs.Mode&os.ModeSymlink == 0 || attrs.Size != 6 {
+		return fmt.Errorf("symlink has mode %v and size %v", attrs.Mode, attrs.Size)
+	}
+	file, err := h.Resolve("repo/README")
+	if err != nil {
+		return err
+	}
+	if _, err = h.ReadSymlink(file); !IsErrno(err, syscall.EINVAL) {
+		return fmt.Errorf("readlink of a file: %v", err)
+	}
+	item, err := h.Remote("repo/readme")
+	if err != nil {
+		return err
+	}
+	if target, ok := item.SymlinkTarget(); !ok || target != "README" || item.Hidden {
+		return fmt.Errorf("remote symlink is %q, hidden %v", target, item.Hidden)
+	}
+
+	// known from the listing after the inodes are gone
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	dir, err = h.Resolve("repo")
+	if err != nil {
+		return err
+	}
+	entries, err := h.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if want := e.Name == "readme"; (e.Type == fuseutil.DT_Link) != want {
+			return fmt.Errorf("%v has type %v", e.Name, e.Type)
+		}
+	}
+	if err = h.Rename(dir, "readme", dir, "link"); err != nil {
+		return err
+	}
+	link, err = h.Resolve("repo/link")
+	if err != nil {
+		return err
+	}
+	if target, err := h.ReadSymlink(link); err != nil || target != "README" {
+		return fmt.Errorf("readlink after rename = %q, %v", target, err)
+	}
+
+	// hidden from the web UI, still seen by the mount
+	hidden := NewWithFlags(h.Backend, &common.FlagStorage{HideSymlinks: true})
+	if _, err = hidden.Symlink(fuseops.RootInodeID, "modules", "repo"); err != nil {
+		return err
+	}
+	if item, err = h.Remote("modules"); err != nil || !item.Hidden {
+		return fmt.Errorf("symlink made with -hide-symlinks: %+v, %v", item, err)
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	modules, err := h.Resolve("modules")
+	if err != nil {
+		return err
+	}
+	if target, err := h.ReadSymlink(modules); err != nil || target != "repo" {
+		return fmt.Errorf("readlink of the hidden symlink = %q, %v", target, err)
+	}
+	if err = h.Unlink(root, "modules"); err != nil {
+		return err
+	}
+	return h.ExpectTree(map[string]int64{"repo": Folder, "repo/README": 2, "repo/link": 6})
+}
+
+// posix changes modes, which stay with the files across remounts, uploads
+// and other mounts of the same drive.
+func posix(h *Harness) error {
+	if _, ok := h.Backend.(interface {
+		SetUserMeta(ctx context.Context, fileId string, userMeta string) error
+	}); !ok {
+		return nil
+	}
+	dir, err := h.MkDir(root, "bin")
+	if err != nil {
+		return err
+	}
+	script, err := h.WriteFile(dir, "run.sh", []byte("#!"))
+	if err != nil {
+		return err
+	}
+	if err = expectMode(h, script, 0644); err != nil {
+		return err
+	}
+	if attrs, err := h.Chmod(script, 0755); err != nil || attrs.Mode.Perm() != 0755 {
+		return fmt.Errorf("chmod = %v, %v", attrs.Mode, err)
+	}
+	if err = h.SetXattr(script, "user.note", []byte("x"), 0); err != nil {
+		return err
+	}
+	if _, err = h.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	if _, err = h.Chmod(root, 0700); !IsErrno(err, syscall.EPERM) {
+		return fmt.Errorf("chmod of the root: %v", err)
+	}
+	// the mode given to create is kept with the first upload
+	private, handle, err := h.CreateMode(dir, "key", 0600)
+	if err != nil {
+		return err
+	}
+	if err = expectMode(h, private, 0600); err != nil {
+		return err
+	}
+	if err = h.Flush(private, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+
+	// rewritten, then known from the listing
+	handle, err = h.Open(script)
+	if err != nil {
+		return err
+	}
+	if err = h.Write(script, handle, 0, []byte("#!/bin/sh")); err != nil {
+		return err
+	}
+	if err = h.Flush(script, handle); err != nil {
+		return err
+	}
+	if err = h.Release(handle); err != nil {
+		return err
+	}
+	if err = h.ForgetAll(); err != nil {
+		return err
+	}
+	for p, mode := range map[string]os.FileMode{"bin": 0700, "bin/run.sh": 0755, "bin/key": 0600} {
+		inode, err := h.Resolve(p)
+		if err != nil {
+			return err
+		}
+		if err = expectMode(h, inode, mode); err != nil {
+			return fmt.Errorf("%v: %v", p, err)
+		}
+	}
+	if script, err = h.Resolve("bin/run.sh"); err != nil {
+		return err
+	}
+	if value, err := h.GetXattr(script, "user.note"); err != nil || string(value) != "x" {
+		return fmt.Errorf("user.note = %q, %v", value, err)
+	}
+
+	// another mount with its own defaults, the owner set elsewhere
+	item, err := h.Remote("bin/key")
+	if err != nil {
+		return err
+	}
+	store := h.Backend.(interface {
+		SetUserMeta(ctx context.Context, fileId string, userMeta string) error
+	})
+	if err = store.SetUserMeta(context.Background(), item.FileId, `{"posix":{"mode":384,"uid":0,"gid":0}}`); err != nil {
+		return err
+	}
+	// created with the default mode, nothing is kept
+	if _, err = h.WriteFile(root, "plain", nil); err != nil {
+		return err
+	}
+	if item, err = h.Remote("plain"); err != nil || item.UserMeta != "" {
+		return fmt.Errorf("user_meta of plain is %q, %v", item.UserMeta, err)
+	}
+	other := NewWithFlags(h.Backend, &common.FlagStorage{MountOptions: map[string]string{"uid": "4242", "umask": "027"}})
+	for p, want := range map[string]struct {
+		mode os.FileMode
+		uid  uint32
+	}{"plain": {0640, 4242}, "bin": {0700, 4242}, "bin/run.sh": {0755, 4242}, "bin/key": {0600, 0}} {
+		inode, err := other.Resolve(p)
+		if err != nil {
+			return err
+		}
+		attrs, err := other.GetAttributes(inode)
+		if err != nil {
+			return err
+		}
+		if attrs.Mode.Perm() != want.mode || attrs.Uid != want.uid {
+			return fmt.Errorf("%v has mode %v and uid %v in the other mount", p, attrs.Mode, attrs.Uid)
+		}
+	}
+	return h.ExpectTree(map[string]int64{"bin": Folder, "bin/run.sh": 9, "bin/key": 0, "plain": 0})
+}
+
+func expectMode(h *Harness, inode fuseops.InodeID, want os.FileMode) error {
+	attrs, err := h.GetAttributes(inode)
+	if err != nil {
+		return err
+	}
+	if attrs.Mode.Perm() != want {
+		return fmt.Errorf("mode is %v, want %v", attrs.Mode.Perm(), want)
+	}
+	return nil
+}
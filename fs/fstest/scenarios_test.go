@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/syncutil"
+)
+
+func TestMain(m *testing.M) {
+	// flushes stage the uploads in the working directory
+	dir, err := ioutil.TempDir("", "fstest")
+	if err != nil {
+		panic(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	syncutil.EnableInvariantChecking()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestScenarios(t *testing.T) {
+	for _, b := range Backends {
+		b := b
+		t.Run(b.Name, func(t *testing.T) {
+			for _, s := range Scenarios {
+				s := s
+				t.Run(s.Name, func(t *testing.T) {
+					backend, closeBackend := b.New()
+					defer closeBackend()
+					if err := RunScenario(s, New(backend)); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// handleLeakAge is how long a handle may stay open before it is reported
+// as a possible leak.
+const handleLeakAge = time.Hour
+
+// OpenHandle describes one entry of the handle table.
+type OpenHandle struct {
+	Id     fuseops.HandleID
+	Dir    bool
+	Inode  fuseops.InodeID
+	Path   string
+	Opened time.Time
+}
+
+// allocHandleUnlocked returns a handle id that is not in use. Dir and file
+// handles share the id space so a stale id can never hit the wrong table.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *AliYunDriveFs) allocHandleUnlocked() fuseops.HandleID {
+	for {
+		id := fs.nextHandleID
+		fs.nextHandleID++
+		if fs.nextHandleID == 0 {
+			fs.nextHandleID = 1
+		}
+		if fs.dirHandles[id] == nil && fs.fileHandles[id] == nil {
+			return id
+		}
+	}
+}
+
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) addDirHandle(dh *DirHandle) fuseops.HandleID {
+	dh.opened = time.Now()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	id := fs.allocHandleUnlocked()
+	fs.dirHandles[id] = dh
+	return id
+}
+
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) addFileHandle(fh *FileHandle) fuseops.HandleID {
+	fh.opened = time.Now()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	id := fs.allocHandleUnlocked()
+	fs.fileHandles[id] = fh
+	return id
+}
+
+// dirHandle returns EBADF instead of panicking on an id the kernel should
+// not have sent, the mount stays usable and the error ends up in the log.
+//
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) dirHandle(id fuseops.HandleID) (*DirHandle, error) {
+	fs.mu.RLock()
+	dh := fs.dirHandles[id]
+	fs.mu.RUnlock()
+	if dh == nil {
+		fuseLog.Errorln("unknown dir handle", id)
+		return nil, syscall.EBADF
+	}
+	return dh, nil
+}
+
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) fileHandle(id fuseops.HandleID) (*FileHandle, error) {
+	fs.mu.RLock()
+	fh := fs.fileHandles[id]
+	fs.mu.RUnlock()
+	if fh == nil {
+		fuseLog.Errorln("unknown file handle", id)
+		return nil, syscall.EBADF
+	}
+	return fh, nil
+}
+
+// removeDirHandle takes the handle out of the table, the caller closes it.
+//
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) removeDirHandle(id fuseops.HandleID) (*DirHandle, error) {
+	fs.mu.Lock()
+	dh := fs.dirHandles[id]
+	delete(fs.dirHandles, id)
+	fs.mu.Unlock()
+	if dh == nil {
+		fuseLog.Errorln("release of unknown dir handle", id)
+		return nil, syscall.EBADF
+	}
+	return dh, nil
+}
+
+// ACQUIRES_LOCK(fs.mu)
+func (fs *AliYunDriveFs) removeFileHandle(id fuseops.HandleID) (*FileHandle, error) {
+	fs.mu.Lock()
+	fh := fs.fileHandles[id]
+	delete(fs.fileHandles, id)
+	fs.mu.Unlock()
+	if fh == nil {
+		fuseLog.Errorln("release of unknown file handle", id)
+		return nil, syscall.EBADF
+	}
+	return fh, nil
+}
+
+// OpenHandles lists the handle table ordered by id.
+func (fs *AliYunDriveFs) OpenHandles() []OpenHandle {
+	fs.mu.RLock()
+	handles := make([]OpenHandle, 0, len(fs.dirHandles)+len(fs.fileHandles))
+	for id, dh := range fs.dirHandles {
+		handles = append(handles, OpenHandle{Id: id, Dir: true, Inode: dh.inode.Id, Path: dh.inode.FullName(), Opened: dh.opened})
+	}
+	for id, fh := range fs.fileHandles {
+		handles = append(handles, OpenHandle{Id: id, Inode: fh.inode.Id, Path: fh.inode.FullName(), Opened: fh.opened})
+	}
+	fs.mu.RUnlock()
+	sort.Slice(handles, func(i, j int) bool { return handles[i].Id < handles[j].Id })
+	return handles
+}
+
+// DumpHandles writes one line per open handle to w.
+func (fs *AliYunDriveFs) DumpHandles(w io.Writer) {
+	handles := fs.OpenHandles()
+	fmt.Fprintf(w, "%v open handles\n", len(handles))
+	for _, h := range handles {
+		kind := "file"
+		if h.Dir {
+			kind = "dir"
+		}
+		fmt.Fprintf(w, "%6v %-4v inode %-6v %-10v %v\n",
+			h.Id, kind, h.Inode, time.Since(h.Opened).Truncate(time.Second), h.Path)
+	}
+}
+
+// leakedHandles returns the handles open for longer than age.
+func (fs *AliYunDriveFs) leakedHandles(age time.Duration) (leaked []OpenHandle) {
+	for _, h := range fs.OpenHandles() {
+		if time.Since(h.Opened) > age {
+			leaked = append(leaked, h)
+		}
+	}
+	return
+}
+
+// watchHandles dumps the table sizes and the handle table on SIGUSR1,
+// pauses or resumes the prefetch crawler on SIGUSR2 and periodically warns
+// about handles that look leaked.
+func (fs *AliYunDriveFs) watchHandles() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	ticker := time.NewTicker(handleLeakAge / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGUSR2 {
+				if fs.crawler != nil {
+					fs.crawler.TogglePause()
+				}
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%+v\n", fs.Stats())
+			if fs.crawler != nil {
+				fmt.Fprintf(os.Stderr, "prefetch %+v\n", fs.crawler.Progress())
+			}
+			if r, ok := fs.backend.(cacheReporter); ok {
+				for _, s := range r.CacheStats() {
+					fmt.Fprintf(os.Stderr, "cache %+v\n", s)
+				}
+			}
+			fs.DumpHandles(os.Stderr)
+		case <-ticker.C:
+			for _, h := range fs.leakedHandles(handleLeakAge) {
+				fuseLog.Warnf("handle %v on %v open since %v, leaked?", h.Id, h.Path, h.Opened.Format(time.RFC3339))
+			}
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/sirupsen/logrus"
+	"goaldfuse/aliyun/model"
 	"os"
 	"strings"
 	"sync"
@@ -31,6 +32,8 @@ import (
 type InodeAttributes struct {
 	Size  uint64
 	Mtime time.Time
+	// Posix is the mode and owner kept in the user_meta of the file.
+	Posix model.Posix
 }
 
 func (i InodeAttributes) Equal(other InodeAttributes) bool {
@@ -39,6 +42,7 @@ func (i InodeAttributes) Equal(other InodeAttributes) bool {
 
 type Inode struct {
 	Id           fuseops.InodeID
+	Generation   fuseops.GenerationNumber
 	Name         string
 	fs           *AliYunDriveFs
 	Attributes   InodeAttributes
@@ -46,6 +50,9 @@ type Inode struct {
 	FileId       string
 	ParentFileId string
 	Type         string
+	// SymlinkTarget is where a symlink points, empty for anything else.
+	// Symlinks are files of Type "file" on the drive.
+	SymlinkTarget string
 	// It is generally safe to read `AttrTime` without locking because if some other
 	// operation is modifying `AttrTime`, in most cases the reader is okay with working with
 	// stale data. But Time is a struct and modifying it is not atomic. However
@@ -67,6 +74,13 @@ type Inode struct {
 
 	Invalid     bool
 	ImplicitDir bool
+	// inTrash is set below trashName, up to the entry restored from there.
+	inTrash bool
+	// inStarred is set below starredName.
+	inStarred bool
+	// meta is what the drive last told about the inode, nil until listed
+	// or asked for, and again after an upload.
+	meta *model.ListModel
 
 	fileHandles uint64
 
@@ -130,13 +144,36 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 	if inode.dir != nil {
 		attr.Nlink = 2
 		attr.Mode = inode.fs.flags.DirMode | os.ModeDir
+	} else if inode.SymlinkTarget != "" {
+		attr.Nlink = 1
+		attr.Mode = 0777 | os.ModeSymlink
+		return
 	} else {
 		attr.Nlink = 1
 		attr.Mode = inode.fs.flags.FileMode
 	}
+	p := inode.Attributes.Posix
+	if p.Mode != nil {
+		attr.Mode = attr.Mode&^os.ModePerm | os.FileMode(*p.Mode)&os.ModePerm
+	}
+	if p.Uid != nil {
+		attr.Uid = *p.Uid
+	}
+	if p.Gid != nil {
+		attr.Gid = *p.Gid
+	}
 	return
 }
 
+// setMetaUnlocked keeps item as what the drive last told about inode,
+// along with the mode and owner in its user_meta.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setMetaUnlocked(item *model.ListModel) {
+	inode.meta = item
+	inode.Attributes.Posix = item.Posix()
+}
+
 func (inode *Inode) logFuse(op string, args ...interface{}) {
 	if fuseLog.Level >= logrus.DebugLevel {
 		fuseLog.Debugln(op, inode.Id, inode.FullName(), args)
@@ -182,9 +219,12 @@ func (inode *Inode) DeRef(n uint64) (stale bool) {
 	return
 }
 
+// GetAttributes answers from memory, remote changes are brought in by the
+// change poller.
 func (inode *Inode) GetAttributes() (*fuseops.InodeAttributes, error) {
-	// XXX refresh attributes
 	//inode.logFuse("GetAttributes")
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
 	if inode.Invalid {
 		return nil, fuse.ENOENT
 	}
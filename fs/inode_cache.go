@@ -0,0 +1,199 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"sync/atomic"
+)
+
+// Inodes live as long as the kernel holds a reference to them, or while
+// they are part of a cached directory listing. Listings are kept in
+// fs.listings, most recently used first, and once there are more than
+// flags.MaxCachedDirs of them the oldest is dropped together with every
+// child nobody refers to. A lookup that misses in a directory without a
+// cached listing fetches it again.
+
+// Stats reports the size of the in-memory tables.
+type Stats struct {
+	Inodes      int
+	CachedDirs  int
+	NameCache   int
+	FileHandles int
+	DirHandles  int
+	Forgets     uint64
+	Evictions   uint64
+	Polls       uint64
+	// Deletes is the number of remote deletes queued or in flight,
+	// FailedDeletes the number of those that failed.
+	Deletes       int
+	FailedDeletes uint64
+}
+
+func (fs *AliYunDriveFs) Stats() (s Stats) {
+	fs.mu.RLock()
+	s.Inodes = len(fs.inodes)
+	s.FileHandles = len(fs.fileHandles)
+	s.DirHandles = len(fs.dirHandles)
+	fs.mu.RUnlock()
+	fs.pnMu.Lock()
+	s.NameCache = len(fs.pnCache)
+	fs.pnMu.Unlock()
+	fs.lruMu.Lock()
+	s.CachedDirs = fs.listings.Len()
+	fs.lruMu.Unlock()
+	s.Forgets = atomic.LoadUint64(&fs.forgotCnt)
+	s.Evictions = atomic.LoadUint64(&fs.evictCnt)
+	s.Polls = atomic.LoadUint64(&fs.pollCnt)
+	s.Deletes = fs.deletes.Pending()
+	s.FailedDeletes = fs.deletes.Failed()
+	return
+}
+
+// listed reports whether the complete listing of dir is cached, so a
+// lookup that misses in it can answer ENOENT right away.
+func (fs *AliYunDriveFs) listed(dir *Inode) bool {
+	fs.lruMu.Lock()
+	defer fs.lruMu.Unlock()
+	return dir.dir.listing != nil
+}
+
+// cachedListing marks the listing of dir as cached and most recently
+// used, then evicts the oldest listings over the limit.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *AliYunDriveFs) cachedListing(dir *Inode) {
+	fs.revalidate(dir)
+	fs.lruMu.Lock()
+	if dir.dir.listing == nil {
+		dir.dir.listing = fs.listings.PushFront(dir)
+	} else {
+		fs.listings.MoveToFront(dir.dir.listing)
+	}
+	fs.lruMu.Unlock()
+	fs.evictOverLimit()
+}
+
+// warmListing marks the listing of dir, about to be merged by the crawler,
+// as cached without making it recently used. A new one goes in as the
+// least recently used, so prefetched listings only take the room the
+// user's don't need and don't get polled ahead of them. It returns false,
+// leaving dir as it is, when the cache is full.
+//
+// LOCKS_REQUIRED(dir.mu)
+func (fs *AliYunDriveFs) warmListing(dir *Inode) bool {
+	fs.lruMu.Lock()
+	defer fs.lruMu.Unlock()
+	if dir.dir.listing != nil {
+		return true
+	}
+	if fs.flags.MaxCachedDirs > 0 && fs.listings.Len() >= fs.flags.MaxCachedDirs {
+		return false
+	}
+	dir.dir.listing = fs.listings.PushBack(dir)
+	return true
+}
+
+// evictOverLimit drops the least recently used listings over the limit.
+func (fs *AliYunDriveFs) evictOverLimit() {
+	for {
+		fs.lruMu.Lock()
+		if fs.flags.MaxCachedDirs <= 0 || fs.listings.Len() <= fs.flags.MaxCachedDirs {
+			fs.lruMu.Unlock()
+			return
+		}
+		victim := fs.listings.Remove(fs.listings.Back()).(*Inode)
+		victim.dir.listing = nil
+		fs.lruMu.Unlock()
+		fs.evictListing(victim)
+	}
+}
+
+// unlist forgets that the listing of dir is cached.
+func (fs *AliYunDriveFs) unlist(dir *Inode) {
+	fs.lruMu.Lock()
+	if dir.dir.listing != nil {
+		fs.listings.Remove(dir.dir.listing)
+		dir.dir.listing = nil
+	}
+	fs.lruMu.Unlock()
+}
+
+// evictListing drops the cached subtree of dir, children the kernel still
+// refers to or that have open handles stay.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *AliYunDriveFs) evictListing(dir *Inode) {
+	dir.mu.Lock()
+	var subdirs []*Inode
+	for _, child := range dir.dir.Children {
+		if child.isDir() && child.Name != "." && child.Name != ".." {
+			subdirs = append(subdirs, child)
+		}
+	}
+	dir.mu.Unlock()
+
+	for _, sub := range subdirs {
+		fs.unlist(sub)
+		fs.evictListing(sub)
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	children := make([]*Inode, len(dir.dir.Children))
+	copy(children, dir.dir.Children)
+	for _, child := range children {
+		if child.Name == "." || child.Name == ".." || !child.unreferencedUnlocked() {
+			continue
+		}
+		dir.removeChildUnlocked(child)
+		fs.removeInode(child)
+		atomic.AddUint64(&fs.evictCnt, 1)
+	}
+}
+
+// unreferencedUnlocked reports whether inode can be dropped: the kernel
+// has forgotten it, it has no open handles and no cached children.
+//
+// LOCKS_REQUIRED(inode.Parent.mu)
+func (inode *Inode) unreferencedUnlocked() bool {
+	if inode.refcnt != 0 || atomic.LoadUint64(&inode.fileHandles) != 0 {
+		return false
+	}
+	if !inode.isDir() {
+		return true
+	}
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	return len(inode.dir.Children) <= 2
+}
+
+// detachChildUnlocked unlinks inode from parent after it was deleted or
+// replaced. An unreferenced inode is dropped right away since no forget
+// will come for it, otherwise the kernel's forget does it.
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) detachChildUnlocked(inode *Inode) {
+	parent.removeChildUnlocked(inode)
+	inode.Parent = nil
+	if inode.refcnt == 0 && atomic.LoadUint64(&inode.fileHandles) == 0 {
+		parent.fs.removeInode(inode)
+	}
+}
+
+// removeInode takes inode out of the inode table, a directory also loses
+// its cached subtree. The caller has already unlinked it from its parent.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *AliYunDriveFs) removeInode(inode *Inode) {
+	fs.mu.Lock()
+	if fs.inodes[inode.Id] == inode {
+		delete(fs.inodes, inode.Id)
+		fs.ids.release(inode.Id)
+	}
+	fs.mu.Unlock()
+	if inode.isDir() {
+		fs.unlist(inode)
+		fs.evictListing(inode)
+	}
+}
@@ -0,0 +1,166 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// tempInodeBase starts the range of inode numbers for files created
+// through the mount, they have no FileId until the first upload. Numbers
+// derived from a FileId stay below it.
+const tempInodeBase = fuseops.InodeID(1) << 63
+
+// inodeIds hands out inode numbers. A file that exists on the drive gets a
+// number derived from its FileId, so it keeps the same st_ino across
+// remounts, forget and lookup cycles and renames. Everything is guarded by
+// fs.mu.
+type inodeIds struct {
+	// path is where the remapped numbers are saved, empty to keep them in
+	// memory only.
+	path string
+	// owners remembers which file got each number last, so the generation
+	// is bumped when a number moves to a different file.
+	owners map[fuseops.InodeID]inodeOwner
+	// remapped holds the files whose derived number was taken by another
+	// file when they were first seen.
+	remapped map[string]fuseops.InodeID
+	nextTemp fuseops.InodeID
+}
+
+type inodeOwner struct {
+	FileId     string
+	Generation fuseops.GenerationNumber
+}
+
+// savedInode is one entry of the inode map file.
+type savedInode struct {
+	Ino        fuseops.InodeID          `json:"ino"`
+	Generation fuseops.GenerationNumber `json:"gen,omitempty"`
+}
+
+func newInodeIds(path string) *inodeIds {
+	ids := &inodeIds{
+		path:     path,
+		owners:   make(map[fuseops.InodeID]inodeOwner),
+		remapped: make(map[string]fuseops.InodeID),
+	}
+	if path == "" {
+		return ids
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fuseLog.Errorln("reading inode map", err)
+		}
+		return ids
+	}
+	var saved map[string]savedInode
+	if err = json.Unmarshal(data, &saved); err != nil {
+		fuseLog.Errorln("reading inode map", path, err)
+		return ids
+	}
+	for fileId, s := range saved {
+		ids.remapped[fileId] = s.Ino
+		ids.owners[s.Ino] = inodeOwner{FileId: fileId, Generation: s.Generation}
+	}
+	return ids
+}
+
+// fileIdInode maps a FileId onto the range below tempInodeBase, skipping 0
+// and the root.
+func fileIdInode(fileId string) fuseops.InodeID {
+	h := fnv.New64a()
+	h.Write([]byte(fileId))
+	id := fuseops.InodeID(h.Sum64()) &^ tempInodeBase
+	if id <= fuseops.RootInodeID {
+		id += fuseops.RootInodeID + 1
+	}
+	return id
+}
+
+// assign returns the inode number and generation for a new inode of
+// fileId. A number still held by a live inode is never handed out again,
+// the file moves on to the next free one and keeps it from then on.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (ids *inodeIds) assign(fileId string, live map[fuseops.InodeID]*Inode) (fuseops.InodeID, fuseops.GenerationNumber) {
+	if fileId == "" {
+		for {
+			ids.nextTemp++
+			id := tempInodeBase | ids.nextTemp
+			if live[id] == nil {
+				return id, 0
+			}
+		}
+	}
+
+	id, ok := ids.remapped[fileId]
+	if !ok {
+		id = fileIdInode(fileId)
+	}
+	collided := false
+	for live[id] != nil {
+		collided = true
+		id++
+		if id >= tempInodeBase {
+			id = fuseops.RootInodeID + 1
+		}
+	}
+
+	owner := ids.owners[id]
+	if owner.FileId != fileId {
+		if owner.FileId != "" {
+			owner.Generation++
+		}
+		owner.FileId = fileId
+		ids.owners[id] = owner
+	}
+	if collided {
+		fuseLog.Infof("inode %v of %v collides, using %v", fileIdInode(fileId), fileId, id)
+		ids.remapped[fileId] = id
+		ids.save()
+	}
+	return id, owner.Generation
+}
+
+// release is called when id leaves the inode table. Only the owners of
+// remapped numbers are remembered after that, keeping the table bounded.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (ids *inodeIds) release(id fuseops.InodeID) {
+	owner, ok := ids.owners[id]
+	if ok && ids.remapped[owner.FileId] != id {
+		delete(ids.owners, id)
+	}
+}
+
+// save writes the remapped numbers to ids.path. Collisions are rare so
+// this is cheap enough to do under fs.mu.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (ids *inodeIds) save() {
+	if ids.path == "" {
+		return
+	}
+	saved := make(map[string]savedInode, len(ids.remapped))
+	for fileId, id := range ids.remapped {
+		saved[fileId] = savedInode{Ino: id, Generation: ids.owners[id].Generation}
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		tmp := ids.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, ids.path)
+		}
+	}
+	if err != nil {
+		fuseLog.Errorln("saving inode map", ids.path, err)
+	}
+}
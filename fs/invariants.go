@@ -0,0 +1,153 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"fmt"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// checkInvariants covers the state guarded by fs.mu, it runs on every
+// lock and unlock once syncutil.EnableInvariantChecking was called.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *AliYunDriveFs) checkInvariants() {
+	if fs.inodes[fuseops.RootInodeID] == nil {
+		panic("root inode is missing")
+	}
+	for id, inode := range fs.inodes {
+		if inode.Id != id {
+			panic(fmt.Sprintf("inode %v registered as %v", inode.Id, id))
+		}
+	}
+	for id, fh := range fs.fileHandles {
+		if fs.inodes[fh.inode.Id] != fh.inode {
+			panic(fmt.Sprintf("file handle %v refers to unknown inode %v", id, fh.inode.Id))
+		}
+	}
+	for id, dh := range fs.dirHandles {
+		if fs.inodes[dh.inode.Id] != dh.inode {
+			panic(fmt.Sprintf("dir handle %v refers to unknown inode %v", id, dh.inode.Id))
+		}
+		if fs.fileHandles[id] != nil {
+			panic(fmt.Sprintf("handle %v is both a dir and a file handle", id))
+		}
+	}
+}
+
+// CheckInvariants walks the whole inode tree and the handle tables and
+// reports the first inconsistency found. lookups holds the number of
+// references the kernel owns for each inode, they must match the refcnt
+// of the inodes and every inode nobody refers to must be part of a cached
+// listing. It is meant to be called while no operation is running.
+func (fs *AliYunDriveFs) CheckInvariants(lookups map[fuseops.InodeID]uint64) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	fs.mu.RLock()
+	fs.checkInvariants()
+	inodes := make(map[fuseops.InodeID]*Inode, len(fs.inodes))
+	for id, inode := range fs.inodes {
+		inodes[id] = inode
+	}
+	handles := make(map[*Inode]uint64)
+	for _, fh := range fs.fileHandles {
+		handles[fh.inode]++
+	}
+	fs.mu.RUnlock()
+	fs.pnMu.Lock()
+	pnCache := make(map[string]*Inode, len(fs.pnCache))
+	for k, v := range fs.pnCache {
+		pnCache[k] = v
+	}
+	fs.pnMu.Unlock()
+
+	for id, n := range lookups {
+		if n != 0 && inodes[id] == nil {
+			return fmt.Errorf("kernel holds %v references to forgotten inode %v", n, id)
+		}
+	}
+	for id, inode := range inodes {
+		if inode.refcnt != lookups[id] {
+			return fmt.Errorf("inode %v %v has refcnt %v but the kernel holds %v",
+				id, inode.FullName(), inode.refcnt, lookups[id])
+		}
+	}
+
+	for _, inode := range inodes {
+		inode.mu.Lock()
+		open := inode.fileHandles
+		inode.mu.Unlock()
+		if open != handles[inode] {
+			return fmt.Errorf("inode %v %v counts %v open handles, the table has %v",
+				inode.Id, inode.FullName(), open, handles[inode])
+		}
+	}
+
+	reachable := map[*Inode]bool{inodes[fuseops.RootInodeID]: true}
+	if err = fs.checkTree(inodes[fuseops.RootInodeID], inodes, pnCache, reachable); err != nil {
+		return err
+	}
+	for id, inode := range inodes {
+		if !reachable[inode] && inode.refcnt == 0 && handles[inode] == 0 {
+			return fmt.Errorf("inode %v %v is neither referenced nor cached", id, inode.Name)
+		}
+	}
+	for key, inode := range pnCache {
+		if inodes[inode.Id] != inode {
+			return fmt.Errorf("name cache entry %q points at dropped inode %v", key, inode.Id)
+		}
+	}
+
+	fs.lruMu.Lock()
+	listings := fs.listings.Len()
+	fs.lruMu.Unlock()
+	if limit := fs.flags.MaxCachedDirs; limit > 0 && listings > limit {
+		return fmt.Errorf("%v cached listings, the limit is %v", listings, limit)
+	}
+	return nil
+}
+
+func (fs *AliYunDriveFs) checkTree(dir *Inode, inodes map[fuseops.InodeID]*Inode, pnCache map[string]*Inode,
+	reachable map[*Inode]bool) error {
+	dir.mu.Lock()
+	children := make([]*Inode, len(dir.dir.Children))
+	copy(children, dir.dir.Children)
+	dir.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, child := range children {
+		if child.Name == "." || child.Name == ".." {
+			continue
+		}
+		if child.Parent != dir {
+			return fmt.Errorf("%v is listed in %v but its parent is %v",
+				child.Name, dir.FullName(), child.Parent)
+		}
+		if inodes[child.Id] != child {
+			return fmt.Errorf("%v (inode %v) is listed in %v but not in the inode table",
+				child.FullName(), child.Id, dir.FullName())
+		}
+		key := child.Name + child.Type
+		if seen[key] {
+			return fmt.Errorf("%v is listed twice in %v", child.Name, dir.FullName())
+		}
+		seen[key] = true
+		reachable[child] = true
+		if pnCache[dir.FileId+key] != child {
+			return fmt.Errorf("name cache entry of %v does not point at inode %v",
+				child.FullName(), child.Id)
+		}
+		if child.isDir() {
+			if err := fs.checkTree(child, inodes, pnCache, reachable); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetaDB is a small embedded key-value store kept in a single append-only
+// file. Only the keys and the location of their latest value are held in
+// memory, values are read back from the file. A record is
+//
+//	crc32(rest) | key length | value length | key | value
+//
+// with a value length of deletedLen marking a deletion. A torn record at
+// the end, left by a crash, is cut off when the file is opened. The file
+// is rewritten without the stale records once they outweigh the live ones,
+// in the background while the db is in use.
+type MetaDB struct {
+	path string
+
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	index map[string]metaRecord
+	// live and dead count the bytes of current and overwritten records.
+	live int64
+	dead int64
+	// compacting is set while a background compaction runs, Close waits
+	// for it on compacted.
+	compacting bool
+	compacted  *sync.Cond
+}
+
+type metaRecord struct {
+	off int64
+	len uint32
+	crc uint32
+}
+
+const (
+	metaHeaderLen = 12
+	deletedLen    = ^uint32(0)
+	// compactMin keeps small files from being rewritten over and over.
+	compactMin = 1 << 20
+)
+
+var errMetaDBClosed = errors.New("metadata db closed")
+
+func OpenMetaDB(path string) (*MetaDB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db := &MetaDB{path: path, f: f, index: make(map[string]metaRecord)}
+	db.compacted = sync.NewCond(&db.mu)
+	if err = db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if db.needsCompactionLocked() {
+		db.compactNowLocked()
+	}
+	return db, nil
+}
+
+// load rebuilds the index from the file.
+func (db *MetaDB) load() error {
+	r := bufio.NewReaderSize(io.NewSectionReader(db.f, 0, 1<<62), 1<<16)
+	var off int64
+	hdr := make([]byte, metaHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		crc := binary.LittleEndian.Uint32(hdr[0:])
+		klen := binary.LittleEndian.Uint32(hdr[4:])
+		vlen := binary.LittleEndian.Uint32(hdr[8:])
+		n := klen
+		if vlen != deletedLen {
+			n += vlen
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		h := crc32.NewIEEE()
+		h.Write(hdr[4:])
+		h.Write(body)
+		if h.Sum32() != crc {
+			break
+		}
+		key := string(body[:klen])
+		recLen := int64(metaHeaderLen) + int64(n)
+		db.dropLocked(key)
+		if vlen == deletedLen {
+			db.dead += recLen
+		} else {
+			db.index[key] = metaRecord{off: off + metaHeaderLen + int64(klen), len: vlen, crc: crc32.ChecksumIEEE(body[klen:])}
+			db.live += recLen
+		}
+		off += recLen
+	}
+	if fi, err := db.f.Stat(); err == nil && fi.Size() > off {
+		fuseLog.Warnf("%v: dropping %v bytes of torn records", db.path, fi.Size()-off)
+		if err = db.f.Truncate(off); err != nil {
+			return err
+		}
+	}
+	db.size = off
+	return nil
+}
+
+// dropLocked accounts the current record of key as dead.
+//
+// LOCKS_REQUIRED(db.mu)
+func (db *MetaDB) dropLocked(key string) {
+	if old, ok := db.index[key]; ok {
+		n := int64(metaHeaderLen) + int64(len(key)) + int64(old.len)
+		db.live -= n
+		db.dead += n
+		delete(db.index, key)
+	}
+}
+
+func (db *MetaDB) Get(key string) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return nil, false
+	}
+	rec, ok := db.index[key]
+	if !ok {
+		return nil, false
+	}
+	buf := make([]byte, rec.len)
+	if _, err := db.f.ReadAt(buf, rec.off); err != nil {
+		fuseLog.Errorln("reading", db.path, err)
+		return nil, false
+	}
+	return buf, true
+}
+
+// Put stores value under key. Writing the value already stored is a no-op,
+// so revalidating an unchanged tree doesn't grow the file.
+func (db *MetaDB) Put(key string, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if old, ok := db.index[key]; ok && old.len == uint32(len(value)) && old.crc == crc32.ChecksumIEEE(value) {
+		return nil
+	}
+	return db.appendLocked(key, value, false)
+}
+
+func (db *MetaDB) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.index[key]; !ok {
+		return nil
+	}
+	return db.appendLocked(key, nil, true)
+}
+
+// Keys returns the keys starting with prefix, sorted.
+func (db *MetaDB) Keys(prefix string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var keys []string
+	for key := range db.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LOCKS_REQUIRED(db.mu)
+func (db *MetaDB) appendLocked(key string, value []byte, deleted bool) error {
+	if db.f == nil {
+		return errMetaDBClosed
+	}
+	rec := encodeMetaRecord(key, value, deleted)
+	if _, err := db.f.WriteAt(rec, db.size); err != nil {
+		// a partial record is cut off on the next open
+		return err
+	}
+	db.dropLocked(key)
+	if deleted {
+		db.dead += int64(len(rec))
+	} else {
+		db.index[key] = metaRecord{off: db.size + metaHeaderLen + int64(len(key)), len: uint32(len(value)), crc: crc32.ChecksumIEEE(value)}
+		db.live += int64(len(rec))
+	}
+	db.size += int64(len(rec))
+	if !db.compacting && db.needsCompactionLocked() {
+		db.compacting = true
+		go db.compact()
+	}
+	return nil
+}
+
+// needsCompactionLocked reports whether the stale records outweigh the
+// live ones.
+//
+// LOCKS_REQUIRED(db.mu)
+func (db *MetaDB) needsCompactionLocked() bool {
+	return db.dead > compactMin && db.dead > db.live
+}
+
+// compactNowLocked compacts the file while holding db.mu, when nothing
+// else uses the db. A failure only leaves the file larger than needed.
+//
+// LOCKS_REQUIRED(db.mu)
+func (db *MetaDB) compactNowLocked() {
+	tmp, index, off, err := db.writeCompacted(db.f, db.index)
+	if err == nil {
+		err = db.replaceLocked(tmp, index, off, db.size)
+	}
+	if err != nil {
+		fuseLog.Errorln("compacting", db.path, err)
+	}
+}
+
+// compact rewrites the live records without holding db.mu, so reads and
+// writes go on meanwhile. What was written in the meantime is copied over
+// at the end.
+//
+// LOCKS_EXCLUDED(db.mu)
+func (db *MetaDB) compact() {
+	db.mu.Lock()
+	f := db.f
+	from := db.size
+	index := make(map[string]metaRecord, len(db.index))
+	for key, rec := range db.index {
+		index[key] = rec
+	}
+	db.mu.Unlock()
+
+	// the file is only appended to, the records in index stay where
+	// they are
+	tmp, index, off, err := db.writeCompacted(f, index)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err == nil {
+		err = db.replaceLocked(tmp, index, off, from)
+	}
+	if err != nil {
+		fuseLog.Errorln("compacting", db.path, err)
+	}
+	db.compacting = false
+	db.compacted.Broadcast()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func encodeMetaRecord(key string, value []byte, deleted bool) []byte {
+	rec := make([]byte, metaHeaderLen, metaHeaderLen+len(key)+len(value))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(key)))
+	if deleted {
+		binary.LittleEndian.PutUint32(rec[8:], deletedLen)
+	} else {
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(value)))
+	}
+	rec = append(rec, key...)
+	rec = append(rec, value...)
+	binary.LittleEndian.PutUint32(rec[0:], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// writeCompacted writes the records of index, read from f, to a new
+// temporary file and returns it along with where they are in it and its
+// size.
+func (db *MetaDB) writeCompacted(f *os.File, index map[string]metaRecord) (*os.File, map[string]metaRecord, int64, error) {
+	tmp, err := os.OpenFile(db.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	w := bufio.NewWriterSize(tmp, 1<<16)
+	written := make(map[string]metaRecord, len(index))
+	var off int64
+	for key, rec := range index {
+		buf := make([]byte, rec.len)
+		if _, err = f.ReadAt(buf, rec.off); err != nil {
+			break
+		}
+		enc := encodeMetaRecord(key, buf, false)
+		if _, err = w.Write(enc); err != nil {
+			break
+		}
+		written[key] = metaRecord{off: off + metaHeaderLen + int64(len(key)), len: rec.len, crc: rec.crc}
+		off += int64(len(enc))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(db.path + ".tmp")
+		return nil, nil, 0, err
+	}
+	return tmp, written, off, nil
+}
+
+// replaceLocked makes tmp, holding the records index of size off written
+// from the file as it was up to from, the db file. The records appended
+// after from are copied over first.
+//
+// LOCKS_REQUIRED(db.mu)
+func (db *MetaDB) replaceLocked(tmp *os.File, index map[string]metaRecord, off int64, from int64) (err error) {
+	if db.f == nil {
+		err = errMetaDBClosed
+	}
+	tail := make([]byte, db.size-from)
+	if err == nil {
+		_, err = db.f.ReadAt(tail, from)
+	}
+	if err == nil {
+		_, err = tmp.WriteAt(tail, off)
+	}
+	if err == nil && len(tail) != 0 {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(db.path+".tmp", db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(db.path + ".tmp")
+		return err
+	}
+	// make the rename itself survive a crash
+	if err = syncDir(filepath.Dir(db.path)); err != nil {
+		fuseLog.Warnln("syncing the directory of", db.path, err)
+	}
+
+	// a record written after from moved with the tail, any other is
+	// the one compacted
+	live := int64(0)
+	for key, rec := range db.index {
+		if rec.off >= from {
+			rec.off += off - from
+		} else {
+			rec = index[key]
+		}
+		index[key] = rec
+		live += int64(metaHeaderLen) + int64(len(key)) + int64(rec.len)
+	}
+	for key := range index {
+		if _, ok := db.index[key]; !ok {
+			delete(index, key)
+		}
+	}
+	db.f.Close()
+	db.f = tmp
+	db.index = index
+	db.size = off + int64(len(tail))
+	db.live = live
+	db.dead = db.size - live
+	return nil
+}
+
+// Close syncs the file, compacting it first if that pays off.
+func (db *MetaDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.compacting {
+		db.compacted.Wait()
+	}
+	if db.f == nil {
+		return nil
+	}
+	if db.needsCompactionLocked() {
+		db.compactNowLocked()
+	}
+	err := db.f.Sync()
+	if e := db.f.Close(); err == nil {
+		err = e
+	}
+	db.f = nil
+	return err
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func expectRecords(t *testing.T, db *MetaDB, want map[string]string) {
+	t.Helper()
+	if keys := db.Keys(""); len(keys) != len(want) {
+		t.Fatalf("%v keys, want %v", len(keys), len(want))
+	}
+	for key, value := range want {
+		if got, ok := db.Get(key); !ok || string(got) != value {
+			t.Fatalf("%v has %v bytes, want %v", key, len(got), len(value))
+		}
+	}
+}
+
+// TestMetaDBCompaction keeps writing while the file is compacted in the
+// background, then checks the records before and after reopening.
+func TestMetaDBCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	db, err := OpenMetaDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	written := 0
+	for i := 0; i < 5000; i++ {
+		key := "k" + strconv.Itoa(i%20)
+		if i%7 == 0 {
+			err = db.Delete(key)
+			delete(want, key)
+		} else {
+			value := strings.Repeat(strconv.Itoa(i), 500)
+			err = db.Put(key, []byte(value))
+			want[key] = value
+			written += len(value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRecords(t, db, want)
+
+	db.mu.Lock()
+	for db.compacting {
+		db.compacted.Wait()
+	}
+	size := db.size
+	db.mu.Unlock()
+	if size >= int64(written) {
+		t.Errorf("file has %v bytes after writing %v, never compacted", size, written)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = OpenMetaDB(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expectRecords(t, db, want)
+}
@@ -0,0 +1,205 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"goaldfuse/aliyun/model"
+)
+
+// Changes made from elsewhere, the web UI or the phone app, are found by
+// listing the most recently used directories again every
+// flags.PollInterval. A directory whose listing no longer matches its
+// cached children is brought in line: new ones are added, deleted ones detached,
+// renamed ones renamed in place and files whose size or mtime changed are
+// updated and have their page cache dropped on the next open.
+
+// refresher is implemented by backends that cache listings themselves,
+// Refresh makes the next List of parentId ask the server.
+type refresher interface {
+	Refresh(parentId string)
+}
+
+func (fs *AliYunDriveFs) watchChanges() {
+	ticker := time.NewTicker(fs.flags.PollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := fs.withOpTimeout(context.Background())
+		if n := fs.PollChanges(ctx); n != 0 {
+			fuseLog.Infof("%v directories changed remotely", n)
+		}
+		cancel()
+	}
+}
+
+// PollChanges lists the hot directories again and applies what changed,
+// returning how many did.
+func (fs *AliYunDriveFs) PollChanges(ctx context.Context) (changed int) {
+	for _, dir := range fs.hotDirs() {
+		if r, ok := fs.backend.(refresher); ok {
+			r.Refresh(dir.FileId)
+		}
+		items, err := fs.backend.List(ctx, dir.FileId)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fuseLog.Warnln("polling", dir.FullName(), err)
+			continue
+		}
+		items = fs.deletes.withoutPending(items)
+		if fs.applyListing(dir, items) {
+			changed++
+		}
+	}
+	atomic.AddUint64(&fs.pollCnt, 1)
+	return
+}
+
+// hotDirs returns up to flags.PollDirs of the directories with a cached
+// listing, most recently used first. Zero polls all of them.
+func (fs *AliYunDriveFs) hotDirs() (dirs []*Inode) {
+	fs.lruMu.Lock()
+	defer fs.lruMu.Unlock()
+	for e := fs.listings.Front(); e != nil; e = e.Next() {
+		if fs.flags.PollDirs > 0 && len(dirs) >= fs.flags.PollDirs {
+			break
+		}
+		dirs = append(dirs, e.Value.(*Inode))
+	}
+	return
+}
+
+// listingDigest changes whenever a child is added, removed, renamed or
+// rewritten. Folders only count with their name.
+func listingDigest(items []model.ListModel) uint64 {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.FileId + "\x00" + item.Name
+		if item.Type != "folder" {
+			keys[i] += "\x00" + strconv.FormatInt(item.Size, 10) + "\x00" + strconv.FormatInt(item.UpdatedAt.UnixNano(), 10)
+		}
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// childrenDigest is the listingDigest of what is cached for dir, leaving
+// out the children not uploaded yet.
+//
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) childrenDigest() uint64 {
+	items := make([]model.ListModel, 0, len(dir.dir.Children))
+	for _, child := range dir.dir.Children {
+		if child.Name == "." || child.Name == ".." || child.FileId == "" || child.isVirtual() {
+			continue
+		}
+		item := model.ListModel{FileId: child.FileId, Name: child.Name, Type: child.Type}
+		if !child.isDir() {
+			child.mu.Lock()
+			item.Size = int64(child.Attributes.Size)
+			item.UpdatedAt = child.Attributes.Mtime
+			child.mu.Unlock()
+		}
+		items = append(items, item)
+	}
+	return listingDigest(items)
+}
+
+// revalidate merges a fresh listing of dir in the background once it
+// arrives, if the one just cached was a saved copy.
+func (fs *AliYunDriveFs) revalidate(dir *Inode) {
+	if r, ok := fs.backend.(revalidator); ok {
+		r.Revalidate(dir.FileId, func(items []model.ListModel) {
+			fs.applyListing(dir, fs.deletes.withoutPending(items))
+		})
+	}
+}
+
+// applyListing brings the children of dir in line with items, the fresh
+// listing from the backend. Children not uploaded yet are left alone, as
+// are files with open handles, whose local state wins.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *AliYunDriveFs) applyListing(dir *Inode, items []model.ListModel) bool {
+	digest := listingDigest(items)
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	// evicted or removed meanwhile, merging would add unreachable inodes
+	if !fs.listed(dir) || dir.childrenDigest() == digest {
+		return false
+	}
+
+	byId := make(map[string]model.ListModel, len(items))
+	for _, item := range items {
+		byId[item.FileId] = item
+	}
+	children := make([]*Inode, len(dir.dir.Children))
+	copy(children, dir.dir.Children)
+
+	var renamed []*Inode
+	for _, child := range children {
+		if child.Name == "." || child.Name == ".." || child.FileId == "" || child.isVirtual() {
+			continue
+		}
+		item, ok := byId[child.FileId]
+		if !ok {
+			fuseLog.Debugln("removed remotely", child.FullName())
+			child.mu.Lock()
+			child.Invalid = true
+			child.mu.Unlock()
+			dir.detachChildUnlocked(child)
+			continue
+		}
+		meta := item
+		child.mu.Lock()
+		child.setMetaUnlocked(&meta)
+		child.mu.Unlock()
+		if item.Name != child.Name {
+			fuseLog.Debugln("renamed remotely", child.FullName(), item.Name)
+			// put back once every old name is gone, the new name may
+			// still be taken by a child deleted in the same round
+			dir.removeChildUnlocked(child)
+			renamed = append(renamed, child)
+		}
+		if child.isDir() || atomic.LoadUint64(&child.fileHandles) != 0 {
+			continue
+		}
+		child.mu.Lock()
+		if child.Attributes.Size != uint64(item.Size) || !child.Attributes.Mtime.Equal(item.UpdatedAt) {
+			child.Attributes.Size = uint64(item.Size)
+			child.Attributes.Mtime = item.UpdatedAt
+			child.invalidateCache = true
+		}
+		child.mu.Unlock()
+	}
+	for _, child := range renamed {
+		child.mu.Lock()
+		child.Name = byId[child.FileId].Name
+		child.mu.Unlock()
+		if other := dir.findChildUnlocked(child.Name, child.Type); other != nil {
+			// a local file not uploaded yet has the name, the kernel
+			// forgets the renamed one eventually
+			child.Parent = nil
+			if child.refcnt == 0 && atomic.LoadUint64(&child.fileHandles) == 0 {
+				fs.removeInode(child)
+			}
+			continue
+		}
+		dir.insertChildUnlocked(child)
+	}
+	dir.mergeListingUnlocked(items)
+	return true
+}
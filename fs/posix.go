@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"goaldfuse/aliyun/model"
+)
+
+// The permission bits of an entry are kept in its user_meta once they
+// differ from DirMode or FileMode, so executables stay executable on
+// every machine mounting the drive. An owner found there is shown as
+// well, chown itself doesn't reach the file system: the FUSE library
+// drops the new owner.
+
+// chmod keeps the permission bits of mode in the user_meta of inode.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *AliYunDriveFs) chmod(ctx context.Context, inode *Inode, mode os.FileMode) error {
+	if inode.SymlinkTarget != "" {
+		// always 0777
+		return nil
+	}
+	if inode.Id == fuseops.RootInodeID || inode.isVirtual() {
+		return syscall.EPERM
+	}
+	if _, ok := fs.backend.(userMetaStore); !ok {
+		// nowhere to keep it, like before
+		return nil
+	}
+	perm := uint32(mode & os.ModePerm)
+	def := uint32(fs.flags.FileMode & os.ModePerm)
+	if inode.isDir() {
+		def = uint32(fs.flags.DirMode & os.ModePerm)
+	}
+	return fs.editUserMeta(ctx, inode, func(meta *model.ListModel) (string, error) {
+		p := meta.Posix()
+		if p.Mode == nil && perm == def {
+			return meta.UserMeta, nil
+		}
+		p.Mode = &perm
+		return model.WithPosix(meta.UserMeta, p)
+	})
+}
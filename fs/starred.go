@@ -0,0 +1,148 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"goaldfuse/aliyun/model"
+)
+
+// The starred entries of the whole drive are listed in the directory
+// starredName at the top of the mount, all next to each other under
+// their own names unless two share one. A starred folder shows up empty
+// there. Unlink or rmdir of an entry unstars it, the user.aliyun.starred
+// xattr stars or unstars any entry of the mount.
+
+const (
+	starredName = ".starred"
+	// starredId is the FileId of starredName, it never reaches the
+	// backend.
+	starredId = "starred:"
+	// starredTTL is how long a lookup uses the last listing of starredName.
+	starredTTL = 10 * time.Second
+)
+
+// starredRoot returns the starredName directory, nil if the backend can't
+// star entries.
+//
+// LOCKS_EXCLUDED(root.mu)
+func (fs *AliYunDriveFs) starredRoot() *Inode {
+	if _, ok := fs.backend.(starrer); !ok {
+		return nil
+	}
+	return fs.virtualRoot(starredName, starredId, func(s *Inode) { s.inStarred = true })
+}
+
+// refreshStarred lists the starred entries again, unless it was within
+// starredTTL and force is not set.
+func (fs *AliYunDriveFs) refreshStarred(ctx context.Context, force bool) error {
+	fs.starredMu.Lock()
+	defer fs.starredMu.Unlock()
+	if !force && time.Since(fs.starredListed) < starredTTL {
+		return nil
+	}
+	s := fs.starredRoot()
+	if s == nil {
+		return fuse.ENOENT
+	}
+	items, err := fs.backend.(starrer).ListStarred(ctx)
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+	items = fs.deletes.withoutPending(items)
+	sort.Slice(items, func(i, j int) bool { return items[i].FileId < items[j].FileId })
+
+	node := &virtualNode{children: make(map[string]*virtualNode)}
+	for i := range items {
+		name := items[i].Name
+		if node.children[name] != nil {
+			name = virtualAlias(name, items[i].FileId)
+		}
+		node.children[name] = &virtualNode{item: &items[i]}
+	}
+	fs.syncVirtualDir(s, node)
+	fs.starredListed = time.Now()
+	return nil
+}
+
+// staleStarred makes the next lookup in starredName list it again.
+func (fs *AliYunDriveFs) staleStarred() {
+	fs.starredMu.Lock()
+	fs.starredListed = time.Time{}
+	fs.starredMu.Unlock()
+}
+
+// setStarred stars or unstars inode. The other inodes of the same entry
+// ask the backend for their xattrs again.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *AliYunDriveFs) setStarred(ctx context.Context, inode *Inode, starred bool) error {
+	s, ok := fs.backend.(starrer)
+	if !ok || inode.Id == fuseops.RootInodeID || inode.FileId == "" || inode.isTrashFolder() || inode.FileId == starredId {
+		return syscall.EPERM
+	}
+	if err := s.SetStarred(ctx, inode.FileId, starred); err != nil {
+		return backendErr(ctx, err)
+	}
+
+	inode.mu.Lock()
+	meta := inode.meta
+	if meta != nil {
+		updated := *meta
+		updated.Starred = starred
+		inode.meta = &updated
+	}
+	inode.mu.Unlock()
+	if meta != nil {
+		if other := fs.cachedChild(meta.ParentFileId, meta.Name, meta.Type); other != nil && other != inode {
+			other.mu.Lock()
+			if other.FileId == inode.FileId {
+				other.meta = nil
+			}
+			other.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// unstar takes the entry name out of starredName, of type typ.
+func (fs *AliYunDriveFs) unstar(ctx context.Context, parent *Inode, name string, typ string) error {
+	parent.mu.Lock()
+	inode := parent.findChildUnlocked(name, typ)
+	if inode == nil {
+		parent.mu.Unlock()
+		return fuse.ENOENT
+	}
+	err := fs.setStarred(ctx, inode, false)
+	if err == nil {
+		parent.detachChildUnlocked(inode)
+	}
+	parent.mu.Unlock()
+	if err == nil {
+		fs.staleStarred()
+	}
+	return err
+}
+
+// setStarredXattr handles model.StarredXattr, removing it unstars.
+func (fs *AliYunDriveFs) setStarredXattr(ctx context.Context, inode *Inode, value []byte, remove bool) error {
+	starred := false
+	if !remove {
+		var ok bool
+		if starred, ok = model.ParseStarred(value); !ok {
+			return syscall.EINVAL
+		}
+	}
+	if err := fs.setStarred(ctx, inode, starred); err != nil {
+		return err
+	}
+	fs.staleStarred()
+	return nil
+}
@@ -0,0 +1,134 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"goaldfuse/aliyun/model"
+)
+
+// Symlinks are stored as small files holding the target, marked as
+// symlinks in their user_meta. The web UI shows them as regular files
+// unless HideSymlinks hides them there.
+
+func (fs *AliYunDriveFs) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	fs.mu.RLock()
+	parent := fs.getInodeOrDie(op.Parent)
+	fs.mu.RUnlock()
+	if parent.isVirtual() {
+		return syscall.EROFS
+	}
+	if _, ok := fs.backend.(symlinker); !ok {
+		return syscall.EPERM
+	}
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	// a file of the same name may still be waiting to be deleted
+	fs.deletes.Sync()
+	inode, err := parent.Symlink(ctx, op.Name, op.Target)
+	parent.logFuse("<-- CreateSymlink", op.Name, op.Target, err)
+	if err != nil {
+		return err
+	}
+	op.Entry.Child = inode.Id
+	op.Entry.Generation = inode.Generation
+	op.Entry.Attributes = inode.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	return nil
+}
+
+func (fs *AliYunDriveFs) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+	if inode.SymlinkTarget == "" {
+		return syscall.EINVAL
+	}
+	op.Target = inode.SymlinkTarget
+	return nil
+}
+
+// Symlink uploads the file holding target as name and marks it as a
+// symlink. The parent is only locked to check the name and to insert the
+// inode, a listing merged while the file is uploaded may have added it
+// already, as a regular file if it came before the marking.
+//
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) Symlink(ctx context.Context, name string, target string) (*Inode, error) {
+	fs := parent.fs
+	f, err := ioutil.TempFile("", "symlink")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.WriteString(f, target); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	parent.mu.Lock()
+	parentId := parent.FileId
+	exists := parent.findChildUnlocked(name, "") != nil
+	parent.mu.Unlock()
+	if exists {
+		f.Close()
+		return nil, syscall.EEXIST
+	}
+	fileId, err := fs.backend.Upload(ctx, parentId, name, f, int64(len(target)))
+	if err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	err = fs.backend.(symlinker).MarkSymlink(ctx, fileId, model.SymlinkUserMeta(target), fs.flags.HideSymlinks)
+	if err != nil {
+		// don't leave a regular file behind
+		if e := fs.backend.Delete(ctx, fileId, parentId); e != nil {
+			fuseLog.Errorln("removing unmarked symlink", name, e)
+		}
+		return nil, backendErr(ctx, err)
+	}
+
+	now := time.Now()
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	if inode := parent.findChildUnlocked(name, ""); inode != nil {
+		if inode.FileId != fileId {
+			// created here meanwhile, the kernel serializes that so
+			// it hardly ever happens
+			if e := fs.backend.Delete(ctx, fileId, parentId); e != nil {
+				fuseLog.Errorln("removing symlink", name, e)
+			}
+			return nil, syscall.EEXIST
+		}
+		inode.mu.Lock()
+		inode.SymlinkTarget = target
+		inode.Attributes.Size = uint64(len(target))
+		inode.mu.Unlock()
+		inode.Ref()
+		parent.touch()
+		return inode, nil
+	}
+	inode := NewInode(fs, parent, name)
+	inode.Type = "file"
+	inode.FileId = fileId
+	inode.ParentFileId = parentId
+	inode.SymlinkTarget = target
+	inode.Attributes = InodeAttributes{
+		Size:  uint64(len(target)),
+		Mtime: now,
+	}
+	fs.insertInode(parent, inode)
+	parent.touch()
+	return inode, nil
+}
@@ -0,0 +1,376 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"goaldfuse/aliyun/model"
+)
+
+// The recycle bin of backends that have one is shown as the directory
+// trashName at the top of the mount. Every trashed entry appears under the
+// path of the folder it was deleted from, the folders on the way are made
+// up. A trashed folder shows up empty, its content comes back with it.
+//
+// Nothing can be created in there: moving an entry out restores it,
+// unlink or rmdir of an entry deletes it for good and rmdir of trashName
+// itself empties the recycle bin.
+
+const (
+	trashName = ".trash"
+	// trashIdPrefix starts the FileIds of trashName and the folders made
+	// up in it, they never reach the backend.
+	trashIdPrefix = "trash:"
+	// trashTTL is how long a lookup uses the last listing of the bin.
+	trashTTL = 10 * time.Second
+)
+
+// virtualNode is an entry of the tree shown below a made up directory,
+// item is nil for the made up folders.
+type virtualNode struct {
+	item     *model.ListModel
+	children map[string]*virtualNode
+}
+
+func (n *virtualNode) dir(name string) *virtualNode {
+	child := n.children[name]
+	if child == nil {
+		child = &virtualNode{children: make(map[string]*virtualNode)}
+		n.children[name] = child
+	}
+	return child
+}
+
+// isTrashFolder reports whether inode is trashName or a folder made up in
+// it, as opposed to a trashed entry.
+func (inode *Inode) isTrashFolder() bool {
+	return inode.inTrash && strings.HasPrefix(inode.FileId, trashIdPrefix)
+}
+
+// trashRoot returns the trashName directory, putting it back into the
+// root after it was evicted. Nil if the backend has no recycle bin.
+//
+// LOCKS_EXCLUDED(root.mu)
+func (fs *AliYunDriveFs) trashRoot() *Inode {
+	if _, ok := fs.backend.(recycleBin); !ok {
+		return nil
+	}
+	return fs.virtualRoot(trashName, trashIdPrefix, func(t *Inode) { t.inTrash = true })
+}
+
+// virtualRoot returns the directory name at the top of the mount that is
+// made up by the file system, created with FileId fileId and marked by
+// mark if it is not there.
+//
+// LOCKS_EXCLUDED(root.mu)
+func (fs *AliYunDriveFs) virtualRoot(name string, fileId string, mark func(dir *Inode)) *Inode {
+	fs.mu.RLock()
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if dir := root.findChildUnlocked(name, "folder"); dir != nil {
+		return dir
+	}
+	dir := NewInode(fs, root, name)
+	dir.refcnt = 0
+	dir.ToDir()
+	dir.Type = "folder"
+	dir.FileId = fileId
+	dir.ParentFileId = RootFileId
+	mark(dir)
+	fs.insertInode(root, dir)
+	return dir
+}
+
+// isVirtual reports whether inode is below a directory made up by the
+// file system, where nothing can be created.
+func (inode *Inode) isVirtual() bool {
+	return inode.inTrash || inode.inStarred
+}
+
+// refreshTrash lists the recycle bin again, unless it was within trashTTL
+// and force is not set, and rebuilds the tree below trashName.
+func (fs *AliYunDriveFs) refreshTrash(ctx context.Context, force bool) error {
+	fs.trashMu.Lock()
+	defer fs.trashMu.Unlock()
+	if !force && time.Since(fs.trashListed) < trashTTL {
+		return nil
+	}
+	t := fs.trashRoot()
+	if t == nil {
+		return fuse.ENOENT
+	}
+	items, err := fs.backend.(recycleBin).ListTrash(ctx)
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].FileId < items[j].FileId })
+
+	root := &virtualNode{children: make(map[string]*virtualNode)}
+	folders := map[string][]string{RootFileId: nil}
+	dirs := make([]*virtualNode, len(items))
+	for i, item := range items {
+		names, err := fs.folderNames(ctx, item.ParentFileId, folders, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return backendErr(ctx, err)
+			}
+			// the folder is gone for good, show the entry at the top
+			names = nil
+		}
+		dir := root
+		for _, name := range names {
+			dir = dir.dir(name)
+		}
+		dirs[i] = dir
+	}
+	// the made up folders first, an entry of the same name gets an alias
+	for i := range items {
+		name := items[i].Name
+		if dirs[i].children[name] != nil {
+			name = virtualAlias(name, items[i].FileId)
+		}
+		dirs[i].children[name] = &virtualNode{item: &items[i]}
+	}
+	fs.syncVirtualDir(t, root)
+	fs.trashListed = time.Now()
+	return nil
+}
+
+// virtualAlias is the name of an entry whose name is taken, by another
+// entry of the same name or by a made up folder.
+func virtualAlias(name string, fileId string) string {
+	if len(fileId) > 8 {
+		fileId = fileId[len(fileId)-8:]
+	}
+	return name + "~" + fileId
+}
+
+// folderNames returns the names of the folders from the top down to
+// folderId, remembered in names.
+func (fs *AliYunDriveFs) folderNames(ctx context.Context, folderId string, names map[string][]string, depth int) ([]string, error) {
+	if n, ok := names[folderId]; ok {
+		return n, nil
+	}
+	if depth > 100 {
+		return nil, syscall.ELOOP
+	}
+	item, err := fs.backend.Stat(ctx, folderId)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := fs.folderNames(ctx, item.ParentFileId, names, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	n := make([]string, len(parent)+1)
+	copy(n, parent)
+	n[len(parent)] = item.Name
+	names[folderId] = n
+	return n, nil
+}
+
+// syncVirtualDir brings the children of the made up directory dir in line
+// with node, keeping the inodes of the entries still there. New entries
+// are marked like dir.
+//
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *AliYunDriveFs) syncVirtualDir(dir *Inode, node *virtualNode) {
+	type sub struct {
+		inode *Inode
+		node  *virtualNode
+	}
+	var subs []sub
+
+	dir.mu.Lock()
+	kept := make(map[string]bool)
+	children := make([]*Inode, len(dir.dir.Children))
+	copy(children, dir.dir.Children)
+	for _, child := range children {
+		if child.Name == "." || child.Name == ".." {
+			continue
+		}
+		want := node.children[child.Name]
+		same := want != nil && ((want.item == nil && child.isTrashFolder()) ||
+			(want.item != nil && want.item.FileId == child.FileId))
+		if !same {
+			dir.detachChildUnlocked(child)
+			continue
+		}
+		kept[child.Name] = true
+		if want.item == nil {
+			subs = append(subs, sub{child, want})
+		}
+	}
+	for name, want := range node.children {
+		if kept[name] {
+			continue
+		}
+		entry := NewInode(fs, dir, name)
+		entry.refcnt = 0
+		entry.inTrash = dir.inTrash
+		entry.inStarred = dir.inStarred
+		if want.item == nil {
+			entry.ToDir()
+			entry.Type = "folder"
+			entry.FileId = dir.FileId + "/" + name
+			entry.ParentFileId = dir.FileId
+			subs = append(subs, sub{entry, want})
+		} else {
+			if want.item.Type == "folder" {
+				entry.ToDir()
+				entry.Type = "folder"
+			} else {
+				entry.Type = "file"
+				entry.Attributes = InodeAttributes{Size: uint64(want.item.Size), Mtime: want.item.UpdatedAt}
+				entry.SymlinkTarget, _ = want.item.SymlinkTarget()
+			}
+			entry.FileId = want.item.FileId
+			entry.setMetaUnlocked(want.item)
+			// where Restore puts it back
+			entry.ParentFileId = want.item.ParentFileId
+		}
+		fs.insertInode(dir, entry)
+	}
+	dir.mu.Unlock()
+
+	for _, s := range subs {
+		fs.syncVirtualDir(s.inode, s.node)
+	}
+}
+
+// fetchVirtual lists a directory made up by the file system, asking the
+// backend again for the top one.
+//
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) fetchVirtual(ctx context.Context) error {
+	parent := dh.inode
+	fs := parent.fs
+	// what was just deleted should be in there
+	fs.deletes.Sync()
+	var err error
+	if parent.inStarred {
+		err = fs.refreshStarred(ctx, parent.FileId == starredId)
+	} else {
+		err = fs.refreshTrash(ctx, parent.FileId == trashIdPrefix)
+	}
+	if err != nil {
+		return err
+	}
+	parent.mu.Lock()
+	for _, child := range parent.dir.Children {
+		if child.Name == "." || child.Name == ".." {
+			continue
+		}
+		dh.entries = append(dh.entries, &DirHandleEntry{Name: child.Name, Inode: child.Id, Type: direntType(child),
+			Offset: fuseops.DirOffset(len(dh.entries) + 1)})
+	}
+	parent.mu.Unlock()
+	dh.done = true
+	return nil
+}
+
+// restore moves the trashed entry name out of the trash directory parent
+// to newName in newParent: it goes back where it was deleted from and is
+// then moved on if asked to.
+func (fs *AliYunDriveFs) restore(ctx context.Context, parent *Inode, name string, newParent *Inode, newName string) error {
+	if !parent.inTrash || newParent.inTrash {
+		return syscall.EPERM
+	}
+	parent.mu.Lock()
+	inode := parent.findChildUnlocked(name, "")
+	parent.mu.Unlock()
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if inode.isTrashFolder() {
+		return syscall.EPERM
+	}
+	if err := fs.ensureListed(ctx, newParent); err != nil {
+		return err
+	}
+
+	// newParent is never below trashName, so it goes first
+	newParent.mu.Lock()
+	defer newParent.mu.Unlock()
+	if newParent.findChildUnlocked(newName, "") != nil {
+		return syscall.EEXIST
+	}
+	backend := fs.backend
+	if err := backend.(recycleBin).Restore(ctx, inode.FileId, inode.ParentFileId); err != nil {
+		return backendErr(ctx, err)
+	}
+	fs.deletes.restored(inode.FileId)
+	item, err := backend.Stat(ctx, inode.FileId)
+	if err == nil && item.ParentFileId != newParent.FileId {
+		err = backend.Move(ctx, inode.FileId, newParent.FileId, newName)
+	} else if err == nil && item.Name != newName {
+		err = backend.Rename(ctx, inode.FileId, newName)
+	}
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	inode.mu.Lock()
+	inode.inTrash = false
+	inode.mu.Unlock()
+	parent.moveChildUnlocked(inode, newParent, newName)
+	return nil
+}
+
+// deleteForever removes the trashed entry name from the recycle bin. An
+// empty made up folder just goes away, which lets rm -r work through the
+// trash.
+func (fs *AliYunDriveFs) deleteForever(ctx context.Context, parent *Inode, name string, typ string) error {
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	inode := parent.findChildUnlocked(name, typ)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if inode.isTrashFolder() {
+		inode.mu.Lock()
+		empty := len(inode.dir.Children) <= 2
+		inode.mu.Unlock()
+		if !empty {
+			return syscall.ENOTEMPTY
+		}
+	} else if err := fs.backend.(recycleBin).DeleteForever(ctx, inode.FileId); err != nil {
+		return backendErr(ctx, err)
+	}
+	inode.mu.Lock()
+	inode.Invalid = true
+	inode.mu.Unlock()
+	parent.detachChildUnlocked(inode)
+	return nil
+}
+
+// emptyTrash deletes everything in the recycle bin for good, including
+// what is still queued to be moved there.
+func (fs *AliYunDriveFs) emptyTrash(ctx context.Context) error {
+	t := fs.trashRoot()
+	if t == nil {
+		return fuse.ENOENT
+	}
+	fs.deletes.Sync()
+	if err := fs.backend.(recycleBin).EmptyTrash(ctx); err != nil {
+		return backendErr(ctx, err)
+	}
+	fs.trashMu.Lock()
+	fs.syncVirtualDir(t, &virtualNode{})
+	fs.trashListed = time.Now()
+	fs.trashMu.Unlock()
+	return nil
+}
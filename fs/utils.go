@@ -17,8 +17,10 @@
 package fs
 
 import (
+	"context"
 	"github.com/jacobsa/fuse"
 	"github.com/shirou/gopsutil/process"
+	"syscall"
 	"time"
 )
 
@@ -32,6 +34,19 @@ func MaxUInt64(a, b uint64) uint64 {
 	}
 }
 
+// interruptedErr maps a finished context to the errno reported back to the
+// kernel: EINTR when the request was interrupted, ETIMEDOUT when it ran out
+// of time. It returns nil while ctx is still live.
+func interruptedErr(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return syscall.EINTR
+	case context.DeadlineExceeded:
+		return syscall.ETIMEDOUT
+	}
+	return nil
+}
+
 func TryUnmount(mountPoint string) (err error) {
 	for i := 0; i < 20; i++ {
 		err = fuse.Unmount(mountPoint)
@@ -0,0 +1,217 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"goaldfuse/aliyun/model"
+)
+
+// Extended attributes under model.XattrPrefix are read-only and show the
+// metadata of the drive: hashes, category, labels and so on, so scripts
+// can dedupe or filter without downloading anything. The others are kept
+// in the user_meta of the file, where other machines see them, and go
+// along with every upload.
+
+// flags of setxattr
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// currentMeta returns what the drive knows about inode, asking the
+// backend when the inode was not listed since its last upload. For a file
+// not uploaded yet it only holds the user_meta to upload with it.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) currentMeta(ctx context.Context) (*model.ListModel, error) {
+	inode.mu.Lock()
+	meta := inode.meta
+	fileId := inode.FileId
+	inode.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	if fileId == "" {
+		return &model.ListModel{}, nil
+	}
+	item, err := inode.fs.backend.Stat(ctx, fileId)
+	if err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	inode.mu.Lock()
+	if inode.FileId == fileId {
+		inode.setMetaUnlocked(&item)
+	}
+	inode.mu.Unlock()
+	return &item, nil
+}
+
+// xattrs returns the extended attributes of inode.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) xattrs(ctx context.Context) (map[string][]byte, error) {
+	switch {
+	case inode.Id == fuseops.RootInodeID:
+		meta := &model.ListModel{FileId: RootFileId}
+		return meta.Xattrs(), nil
+	case inode.isTrashFolder():
+		return map[string][]byte{}, nil
+	}
+	meta, err := inode.currentMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Xattrs(), nil
+}
+
+// setXattr sets the extended attribute name of inode to value, or removes
+// it, in the user_meta of the file.
+func (fs *AliYunDriveFs) setXattr(ctx context.Context, inode *Inode, name string, value []byte, flags uint32, remove bool) error {
+	if name == model.StarredXattr {
+		return fs.setStarredXattr(ctx, inode, value, remove)
+	}
+	if strings.HasPrefix(name, model.XattrPrefix) {
+		return syscall.EPERM
+	}
+	if _, ok := fs.backend.(userMetaStore); !ok || !model.StoredXattr(name) {
+		return syscall.ENOTSUP
+	}
+	if inode.Id == fuseops.RootInodeID || inode.isVirtual() {
+		return syscall.EPERM
+	}
+
+	return fs.editUserMeta(ctx, inode, func(meta *model.ListModel) (string, error) {
+		_, exists := meta.UserXattrs()[name]
+		switch {
+		case (remove || flags == xattrReplace) && !exists:
+			return "", fuse.ENOATTR
+		case flags == xattrCreate && exists:
+			return "", syscall.EEXIST
+		}
+		if remove {
+			return model.WithoutUserXattr(meta.UserMeta, name)
+		}
+		return model.WithUserXattr(meta.UserMeta, name, value)
+	})
+}
+
+// editUserMeta rewrites the user_meta of inode with what edit returns,
+// nothing is sent if it stays the same. Before the first upload it is
+// only kept with the inode.
+func (fs *AliYunDriveFs) editUserMeta(ctx context.Context, inode *Inode, edit func(meta *model.ListModel) (string, error)) error {
+	store := fs.backend.(userMetaStore)
+	// one at a time, each rewrites the whole user_meta
+	fs.xattrMu.Lock()
+	defer fs.xattrMu.Unlock()
+	meta, err := inode.currentMeta(ctx)
+	if err != nil {
+		return err
+	}
+	userMeta, err := edit(meta)
+	if _, ok := err.(syscall.Errno); ok {
+		return err
+	} else if err != nil {
+		// user_meta of another client that is no JSON object
+		return syscall.ENOTSUP
+	}
+	if userMeta == meta.UserMeta {
+		return nil
+	}
+	if meta.FileId != "" {
+		if err = store.SetUserMeta(ctx, meta.FileId, userMeta); err != nil {
+			return backendErr(ctx, err)
+		}
+	}
+	updated := *meta
+	updated.UserMeta = userMeta
+	inode.mu.Lock()
+	if inode.FileId == meta.FileId {
+		inode.setMetaUnlocked(&updated)
+	}
+	inode.mu.Unlock()
+	return nil
+}
+
+// fillXattr copies value to dst the way getxattr and listxattr want it,
+// an empty dst only asks for the size.
+func fillXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+	return copy(dst, value), nil
+}
+
+func (fs *AliYunDriveFs) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) (err error) {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	attrs, err := inode.xattrs(ctx)
+	if err != nil {
+		return err
+	}
+	value, ok := attrs[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = fillXattr(op.Dst, value)
+	return
+}
+
+func (fs *AliYunDriveFs) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) (err error) {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	attrs, err := inode.xattrs(ctx)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+	}
+	op.BytesRead, err = fillXattr(op.Dst, buf)
+	return
+}
+
+func (fs *AliYunDriveFs) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) (err error) {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	return fs.setXattr(ctx, inode, op.Name, op.Value, op.Flags, false)
+}
+
+func (fs *AliYunDriveFs) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) (err error) {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+
+	ctx, cancel := fs.withOpTimeout(ctx)
+	defer cancel()
+	return fs.setXattr(ctx, inode, op.Name, nil, 0, true)
+}
@@ -1,6 +1,7 @@
 package fs_windows
 
 import (
+	"context"
 	"fmt"
 	"github.com/billziss-gh/cgofuse/fuse"
 	cmap "github.com/orcaman/concurrent-map"
@@ -20,13 +21,13 @@ import (
 
 var aliLog = GetLogger("ali")
 
-func NewAliYunDriveFSHost(config model.Config) *fuse.FileSystemHost {
-	fs := &AliYunDriveFS{Config: config}
+func NewAliYunDriveFSHost(client *aliyun.Client, config model.Config, hideSymlinks bool) *fuse.FileSystemHost {
+	fs := &AliYunDriveFS{Config: config, client: client, hideSymlinks: hideSymlinks}
 	TOTAL = 0
 	USED = 0
 	fs.ino++
 	fmt.Println(config)
-	list, _ := aliyun.GetList(config.Token, config.DriveId, "")
+	list, _ := fs.client.GetList(context.Background(), config.Token, config.DriveId, "")
 	fs.root = newNode(0, fs.ino, fuse.S_IFDIR|00777, 0, 0, "root", "")
 	fs.inodes = cmap.New()
 	fs.inodes.Set("/", model.ListModel{Name: "Default", Type: "folder", FileId: "root", ParentFileId: ""})
@@ -41,10 +42,14 @@ func NewAliYunDriveFSHost(config model.Config) *fuse.FileSystemHost {
 	fs.openmap = map[uint64]*node_t{}
 
 	go func(driveFs *AliYunDriveFS) {
+		if driveFs.client.Replaying {
+			// the tokens of a cassette can't be refreshed
+			return
+		}
 		for {
 			aliLog.Log("Refresh Token")
 			time.Sleep(120 * time.Second)
-			refreshResult := aliyun.RefreshToken(driveFs.Config.RefreshToken)
+			refreshResult := driveFs.client.RefreshToken(context.Background(), driveFs.Config.RefreshToken)
 			if !reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) {
 				driveFs.Config = model.Config{
 					DriveId:      refreshResult.DefaultDriveId,
@@ -52,7 +57,7 @@ func NewAliYunDriveFSHost(config model.Config) *fuse.FileSystemHost {
 					Token:        refreshResult.AccessToken,
 					ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
 				}
-				err := ioutil.WriteFile(".refresh_token", []byte(refreshResult.RefreshToken), 0600)
+				err := driveFs.client.SaveRefreshToken(".refresh_token", refreshResult.RefreshToken)
 				if err != nil {
 					fmt.Println("Can't write token file, token will not be able to persist")
 				}
@@ -76,7 +81,7 @@ func NewAliYunDriveFSHost(config model.Config) *fuse.FileSystemHost {
 
 func (fs *AliYunDriveFS) walkfn(path string, fi model.ListModel, node *node_t) {
 	if fi.Type == "folder" {
-		list, _ := aliyun.GetList(fs.Config.Token, fs.Config.DriveId, fi.FileId)
+		list, _ := fs.client.GetList(context.Background(), fs.Config.Token, fs.Config.DriveId, fi.FileId)
 		for _, item := range list.Items {
 			fmt.Println("Prefetch:", path+"/"+item.Name)
 			if item.Type == "folder" {
@@ -102,6 +107,8 @@ type node_t struct {
 	_if          string
 	_tf          string
 	lock         sync.RWMutex
+	// target is where a symlink points
+	target string
 }
 
 func newNode(dev uint64, ino uint64, mode uint32, uid uint32, gid uint32, fileId string, parentFileId string) *node_t {
@@ -143,7 +150,7 @@ func (fs *AliYunDriveFS) lookupNode(path string, ancestor *node_t) (prnt *node_t
 			l, _ := fs.inodes.Get(path)
 			r := l.(model.ListModel)
 			if r.Type == "folder" {
-				list, _ := aliyun.GetList(fs.Config.Token, fs.Config.DriveId, r.FileId)
+				list, _ := fs.client.GetList(context.Background(), fs.Config.Token, fs.Config.DriveId, r.FileId)
 				for _, item := range list.Items {
 					if !fs.inodes.Has(path + "/" + item.Name) {
 						if item.Type == "folder" {
@@ -194,17 +201,22 @@ func (self *AliYunDriveFS) makeNode(path string, mode uint32, dev uint64, size i
 	prnt.stat.Ctim = node.stat.Ctim
 	prnt.stat.Mtim = node.stat.Ctim
 	if fileId != "" && parentFileId != "" {
-		fi := aliyun.GetFileDetail(self.Config.Token, self.Config.DriveId, fileId)
+		fi := self.client.GetFileDetail(context.Background(), self.Config.Token, self.Config.DriveId, fileId)
+		applyPosix(node, fi.Posix())
+		if target, ok := fi.SymlinkTarget(); ok {
+			node.stat.Mode = fuse.S_IFLNK | 0777
+			node.target = target
+		}
 		self.lock.Lock()
 		self.inodes.Set(path, fi)
 		self.lock.Unlock()
 		return 0, node, prnt
 	}
 	if !self.inodes.Has(path) && mode == fuse.S_IFDIR|0777 {
-		dir := aliyun.MakeDir(self.Config.Token, self.Config.DriveId, name, prnt.fileId)
+		dir := self.client.MakeDir(context.Background(), self.Config.Token, self.Config.DriveId, name, prnt.fileId)
 		node.fileId = dir.FileId
 		node.parentFileId = dir.ParentFileId
-		fi := aliyun.GetFileDetail(self.Config.Token, self.Config.DriveId, dir.FileId)
+		fi := self.client.GetFileDetail(context.Background(), self.Config.Token, self.Config.DriveId, dir.FileId)
 		self.lock.Lock()
 		self.inodes.Set(path, fi)
 		self.lock.Unlock()
@@ -239,7 +251,7 @@ func (self *AliYunDriveFS) removeNode(path string, dir bool) int {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 	self.inodes.Remove(path)
-	aliyun.RemoveTrash(self.Config.Token, self.Config.DriveId, node.fileId, node.parentFileId)
+	self.client.RemoveTrash(context.Background(), self.Config.Token, self.Config.DriveId, node.fileId, node.parentFileId)
 	tmsp := fuse.Now()
 	node.stat.Ctim = tmsp
 	prnt.stat.Ctim = tmsp
@@ -296,6 +308,7 @@ type AliYunDriveFS struct {
 	fuse.FileSystemBase
 	//Ali API Config
 	Config model.Config
+	client *aliyun.Client
 	//Read Write Lock
 	lock    sync.RWMutex
 	root    *node_t
@@ -303,6 +316,10 @@ type AliYunDriveFS struct {
 	inodes  cmap.ConcurrentMap
 	pnCache map[string]*node_t
 	openmap map[uint64]*node_t
+	// xattrMu serializes the changes to user_meta.
+	xattrMu sync.Mutex
+	// hideSymlinks hides the files holding symlinks from the web UI.
+	hideSymlinks bool
 }
 
 var TOTAL uint64
@@ -329,7 +346,7 @@ func (fs *AliYunDriveFS) Destroy() {
 func (fs *AliYunDriveFS) Statfs(path string, stat *fuse.Statfs_t) int {
 
 	if TOTAL == 0 && USED == 0 {
-		total, used := aliyun.GetBoxSize(fs.Config.Token)
+		total, used := fs.client.GetBoxSize(context.Background(), fs.Config.Token)
 		TOTAL, _ = strconv.ParseUint(total, 10, 64)
 		USED, _ = strconv.ParseUint(used, 10, 64)
 	}
@@ -383,16 +400,54 @@ func (fs *AliYunDriveFS) Link(oldpath string, newpath string) int {
 	return -fuse.ENOENT
 }
 
-// Symlink creates a symbolic link.
+// Symlink creates a symbolic link, a small file holding target that is
+// marked as a symlink in its user_meta.
 
 func (fs *AliYunDriveFS) Symlink(target string, newpath string) int {
-	return -fuse.ENOENT
+	prnt, name, node := fs.lookupNode(newpath, nil)
+	if nil == prnt {
+		return -fuse.ENOENT
+	}
+	if nil != node {
+		return -fuse.EEXIST
+	}
+	f, err := ioutil.TempFile("", "symlink")
+	if err != nil {
+		return -fuse.EIO
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = io.WriteString(f, target); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return -fuse.EIO
+	}
+	ctx := context.Background()
+	fileId := fs.client.ContentHandle(ctx, f, fs.Config.Token, fs.Config.DriveId, prnt.fileId, name, uint64(len(target)))
+	if fileId == "" {
+		return -fuse.EIO
+	}
+	if !fs.client.MarkSymlink(ctx, fs.Config.Token, fs.Config.DriveId, fileId, model.SymlinkUserMeta(target), fs.hideSymlinks) {
+		// don't leave a regular file behind
+		fs.client.RemoveTrash(ctx, fs.Config.Token, fs.Config.DriveId, fileId, prnt.fileId)
+		return -fuse.EIO
+	}
+	errc, _, _ := fs.makeNode(newpath, fuse.S_IFLNK|0777, 0, int64(len(target)), fileId, prnt.fileId)
+	return errc
 }
 
 // Readlink reads the target of a symbolic link.
 
 func (fs *AliYunDriveFS) Readlink(path string) (int, string) {
-	return -fuse.EINVAL, ""
+	_, _, node := fs.lookupNode(path, nil)
+	if nil == node {
+		return -fuse.ENOENT, ""
+	}
+	if fuse.S_IFLNK != node.stat.Mode&fuse.S_IFMT {
+		return -fuse.EINVAL, ""
+	}
+	return 0, node.target
 }
 
 // Rename renames a file.
@@ -415,14 +470,14 @@ func (fs *AliYunDriveFS) Rename(oldpath string, newpath string) (errc int) {
 		return 0
 	}
 	if oldprnt == newprnt && oldname != newname {
-		aliyun.ReName(fs.Config.Token, fs.Config.DriveId, newname, oldnode.fileId)
+		fs.client.ReName(context.Background(), fs.Config.Token, fs.Config.DriveId, newname, oldnode.fileId)
 	}
 	if oldprnt != newprnt && oldname == newname {
-		aliyun.BatchFile(fs.Config.Token, fs.Config.DriveId, oldnode.fileId, newprnt.fileId)
+		fs.client.BatchFile(context.Background(), fs.Config.Token, fs.Config.DriveId, oldnode.fileId, newprnt.fileId, "")
 	}
 	if oldprnt != newprnt && oldname != newname {
-		aliyun.ReName(fs.Config.Token, fs.Config.DriveId, newname, oldnode.fileId)
-		aliyun.BatchFile(fs.Config.Token, fs.Config.DriveId, oldnode.fileId, newprnt.fileId)
+		fs.client.ReName(context.Background(), fs.Config.Token, fs.Config.DriveId, newname, oldnode.fileId)
+		fs.client.BatchFile(context.Background(), fs.Config.Token, fs.Config.DriveId, oldnode.fileId, newprnt.fileId, "")
 	}
 	if nil != newnode {
 		errc = fs.removeNode(newpath, fuse.S_IFDIR == oldnode.stat.Mode&fuse.S_IFMT)
@@ -435,17 +490,27 @@ func (fs *AliYunDriveFS) Rename(oldpath string, newpath string) (errc int) {
 	return 0
 }
 
-// Chmod changes the permission bits of a file.
+// Chmod changes the permission bits of a file, kept in its user_meta.
 
 func (fs *AliYunDriveFS) Chmod(path string, mode uint32) int {
-	fmt.Println("chmod")
-	return 0
+	perm := mode & 0777
+	return fs.setPosix(path, func(p *model.Posix) {
+		p.Mode = &perm
+	})
 }
 
-// Chown changes the owner and group of a file.
+// Chown changes the owner and group of a file, kept in its user_meta.
 
 func (fs *AliYunDriveFS) Chown(path string, uid uint32, gid uint32) int {
-	return 0
+	return fs.setPosix(path, func(p *model.Posix) {
+		// ^0 leaves it as it is
+		if uid != ^uint32(0) {
+			p.Uid = &uid
+		}
+		if gid != ^uint32(0) {
+			p.Gid = &gid
+		}
+	})
 }
 
 // Utimens changes the access and modification times of a file.
@@ -510,7 +575,7 @@ func (fs *AliYunDriveFS) Read(path string, buff []byte, ofst int64, fh uint64) i
 			return -fuse.EINPROGRESS
 		}
 	}
-	fi := aliyun.GetFileDetail(fs.Config.Token, fs.Config.DriveId, node.fileId)
+	fi := fs.client.GetFileDetail(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId)
 	if fi.DownloadUrl == "" {
 		fmt.Println("No Download URL")
 		return fuse.ENOENT
@@ -534,7 +599,7 @@ func (fs *AliYunDriveFS) Read(path string, buff []byte, ofst int64, fh uint64) i
 	//create temp file for performance consideration
 	//if node._tf == "" {
 	//	now := time.Now()
-	resp := aliyun.GetFile(fi.DownloadUrl, fs.Config.Token, rangeStr)
+	resp := fs.client.GetFile(context.Background(), fi.DownloadUrl, fs.Config.Token, rangeStr)
 	//	tempFile, _ := os.OpenFile(os.TempDir()+"/_tf"+name+strconv.FormatUint(node.stat.Ino, 10), os.O_RDWR|os.O_CREATE, 0666)
 	//	io.Copy(tempFile, resp.Body)
 	//	tempFile.Close()
@@ -646,7 +711,7 @@ func (fs *AliYunDriveFS) Release(path string, fh uint64) int {
 		fs.closeNode(fh)
 		return 0
 	}
-	fileId := aliyun.ContentHandle(intermediateFile, fs.Config.Token, fs.Config.DriveId, parent.fileId, name, uint64(stat.Size()))
+	fileId := fs.client.ContentHandle(context.Background(), intermediateFile, fs.Config.Token, fs.Config.DriveId, parent.fileId, name, uint64(stat.Size()))
 	node.stat.Size = stat.Size()
 	node.fileId = fileId
 	node.parentFileId = parent.fileId
@@ -720,6 +785,32 @@ func (fs *AliYunDriveFS) Setxattr(path string, name string, value []byte, flags
 	if "com.apple.ResourceFork" == name {
 		return -fuse.ENOTSUP
 	}
+	if model.StarredXattr == name {
+		starred, ok := model.ParseStarred(value)
+		if !ok {
+			return -fuse.EINVAL
+		}
+		return fs.setStarred(node, starred)
+	}
+	if strings.HasPrefix(name, model.XattrPrefix) {
+		return -fuse.EPERM
+	}
+	if remoteXattr(node, name) {
+		fs.xattrMu.Lock()
+		defer fs.xattrMu.Unlock()
+		item := fs.client.GetFileDetail(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId)
+		_, ok := item.UserXattrs()[name]
+		if fuse.XATTR_CREATE == flags && ok {
+			return -fuse.EEXIST
+		} else if fuse.XATTR_REPLACE == flags && !ok {
+			return -fuse.ENOATTR
+		}
+		userMeta, err := model.WithUserXattr(item.UserMeta, name, value)
+		if err != nil {
+			return -fuse.ENOTSUP
+		}
+		return fs.updateUserMeta(node, userMeta)
+	}
 	if fuse.XATTR_CREATE == flags {
 		if _, ok := node.xatr[name]; ok {
 			return -fuse.EEXIST
@@ -749,6 +840,13 @@ func (fs *AliYunDriveFS) Getxattr(path string, name string) (int, []byte) {
 	if "com.apple.ResourceFork" == name {
 		return -fuse.ENOTSUP, nil
 	}
+	if strings.HasPrefix(name, model.XattrPrefix) || remoteXattr(node, name) {
+		xatr, ok := fs.driveXattrs(node)[name]
+		if !ok {
+			return -fuse.ENOATTR, nil
+		}
+		return 0, xatr
+	}
 	xatr, ok := node.xatr[name]
 	if !ok {
 		return -fuse.ENOATTR, nil
@@ -767,6 +865,25 @@ func (fs *AliYunDriveFS) Removexattr(path string, name string) int {
 	if "com.apple.ResourceFork" == name {
 		return -fuse.ENOTSUP
 	}
+	if model.StarredXattr == name {
+		return fs.setStarred(node, false)
+	}
+	if strings.HasPrefix(name, model.XattrPrefix) {
+		return -fuse.EPERM
+	}
+	if remoteXattr(node, name) {
+		fs.xattrMu.Lock()
+		defer fs.xattrMu.Unlock()
+		item := fs.client.GetFileDetail(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId)
+		if _, ok := item.UserXattrs()[name]; !ok {
+			return -fuse.ENOATTR
+		}
+		userMeta, err := model.WithoutUserXattr(item.UserMeta, name)
+		if err != nil {
+			return -fuse.ENOTSUP
+		}
+		return fs.updateUserMeta(node, userMeta)
+	}
 	if _, ok := node.xatr[name]; !ok {
 		return -fuse.ENOATTR
 	}
@@ -777,5 +894,100 @@ func (fs *AliYunDriveFS) Removexattr(path string, name string) int {
 // Listxattr lists extended attributes.
 
 func (fs *AliYunDriveFS) Listxattr(path string, fill func(name string) bool) int {
+	_, _, node := fs.lookupNode(path, nil)
+	if nil == node {
+		return -fuse.ENOENT
+	}
+	for name := range fs.driveXattrs(node) {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	for name := range node.xatr {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	return 0
+}
+
+// remoteXattr reports whether the extended attribute name of node is kept
+// in the user_meta of the file on the drive rather than in node.xatr.
+func remoteXattr(node *node_t, name string) bool {
+	return node.fileId != "" && node.fileId != "root" && model.StoredXattr(name)
+}
+
+// driveXattrs returns the extended attributes of node kept on the drive,
+// the read-only user.aliyun.* ones and those in user_meta.
+func (fs *AliYunDriveFS) driveXattrs(node *node_t) map[string][]byte {
+	if node.fileId == "" {
+		return nil
+	}
+	item := model.ListModel{FileId: node.fileId}
+	if node.fileId != "root" {
+		item = fs.client.GetFileDetail(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId)
+	}
+	return item.Xattrs()
+}
+
+func (fs *AliYunDriveFS) updateUserMeta(node *node_t, userMeta string) int {
+	if !fs.client.UpdateUserMeta(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId, userMeta) {
+		return -fuse.EIO
+	}
+	return 0
+}
+
+// setPosix changes the mode and owner of path with edit, in the user_meta
+// of the file once it is on the drive.
+func (fs *AliYunDriveFS) setPosix(path string, edit func(p *model.Posix)) int {
+	_, _, node := fs.lookupNode(path, nil)
+	if nil == node {
+		return -fuse.ENOENT
+	}
+	if fuse.S_IFLNK == node.stat.Mode&fuse.S_IFMT {
+		return 0
+	}
+	if node.fileId == "" || node.fileId == "root" {
+		var p model.Posix
+		edit(&p)
+		applyPosix(node, p)
+		return 0
+	}
+	fs.xattrMu.Lock()
+	defer fs.xattrMu.Unlock()
+	item := fs.client.GetFileDetail(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId)
+	p := item.Posix()
+	edit(&p)
+	userMeta, err := model.WithPosix(item.UserMeta, p)
+	if err != nil {
+		return -fuse.ENOTSUP
+	}
+	if errc := fs.updateUserMeta(node, userMeta); errc != 0 {
+		return errc
+	}
+	applyPosix(node, p)
+	return 0
+}
+
+// applyPosix shows the mode and owner p on node.
+func applyPosix(node *node_t, p model.Posix) {
+	if p.Mode != nil {
+		node.stat.Mode = node.stat.Mode&^0777 | *p.Mode&0777
+	}
+	if p.Uid != nil {
+		node.stat.Uid = *p.Uid
+	}
+	if p.Gid != nil {
+		node.stat.Gid = *p.Gid
+	}
+}
+
+func (fs *AliYunDriveFS) setStarred(node *node_t, starred bool) int {
+	if node.fileId == "" || node.fileId == "root" {
+		return -fuse.EPERM
+	}
+	if !fs.client.SetStarred(context.Background(), fs.Config.Token, fs.Config.DriveId, node.fileId, starred) {
+		return -fuse.EIO
+	}
 	return 0
 }
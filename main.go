@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/uuid"
@@ -12,9 +13,12 @@ import (
 	"goaldfuse/aliyun"
 	"goaldfuse/aliyun/cache"
 	"goaldfuse/aliyun/model"
+	"goaldfuse/aliyun/net"
+	"goaldfuse/common"
 	"goaldfuse/fs"
 	"goaldfuse/utils"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
 	"runtime"
@@ -72,48 +76,131 @@ func main() {
 	var refreshToken *string
 	var mp *string
 	var version *bool
+	var configFile *string
+	var apiBase *string
+	var apiEndpoints *string
+	var localRoot *string
+	flags := &common.FlagStorage{}
 
 	refreshToken = flag.String("rt", "", "refresh_token")
 	mp = flag.String("mp", "", "mount_point，will create if not exist")
 	version = flag.Bool("v", false, "Print version and exit")
+	configFile = flag.String("config", "", "JSON file of flag values, flags given on the command line take precedence")
+	apiBase = flag.String("api-base", os.Getenv("ALIYUNDRIVE_API_BASE"), "API base url, e.g. a mock server or reverse proxy (env ALIYUNDRIVE_API_BASE)")
+	localRoot = flag.String("local", "", "serve this local directory instead of Aliyun Drive, for trying out the mount")
+	apiEndpoints = flag.String("api-endpoints", os.Getenv("ALIYUNDRIVE_API_ENDPOINTS"), "JSON file overriding individual API paths (env ALIYUNDRIVE_API_ENDPOINTS)")
+	flag.DurationVar(&flags.OpTimeout, "op-timeout", 2*time.Minute, "time limit for a single metadata operation, 0 to disable")
+	flag.StringVar(&flags.InodeMapFile, "inode-map", ".inodes.json", "file keeping the inode numbers that had to be remapped, empty to not save them")
+	flag.IntVar(&flags.MaxCachedDirs, "max-cached-dirs", 1000, "number of directory listings kept in memory, 0 for no limit")
+	flag.DurationVar(&flags.ListCacheTTL, "list-cache-ttl", 5*time.Minute, "how long folder listings fetched from the API are reused, 0 to disable")
+	flag.DurationVar(&flags.FileCacheTTL, "file-cache-ttl", 5*time.Minute, "how long file details and paths fetched from the API are reused, 0 to disable")
+	flag.DurationVar(&flags.SearchCacheTTL, "search-cache-ttl", time.Minute, "how long search results are reused, 0 to disable")
+	flag.StringVar(&flags.MetaDBFile, "meta-db", ".metadata.db", "file keeping listings and file details for fast restarts and offline browsing, empty to disable")
+	flag.DurationVar(&flags.PollInterval, "poll-interval", time.Minute, "how often recently used folders are checked for changes made elsewhere, 0 to disable")
+	flag.IntVar(&flags.PollDirs, "poll-dirs", 20, "number of recently used folders checked on every poll, 0 for all cached ones")
+	flag.StringVar(&flags.Prefetch, "prefetch", "", "comma separated folders to crawl in the background after mounting, / for the whole drive; SIGUSR2 pauses and resumes")
+	flag.IntVar(&flags.PrefetchWorkers, "prefetch-workers", 2, "folders the crawler lists at once")
+	flag.BoolVar(&flags.PermanentDelete, "permanent-delete", false, "delete files for good instead of moving them to the recycle bin")
+	flag.Func("o", "comma separated mount options: allow_other, uid=N, gid=N and umask=NNN for the entries without their own", flags.ParseMountOptions)
+	flag.Func("dir-mode", "permission bits of the folders without their own, octal (default 0755)", func(s string) (err error) {
+		flags.DirMode, err = common.ParseMode(s)
+		return
+	})
+	flag.Func("file-mode", "permission bits of the files without their own, octal (default 0644)", func(s string) (err error) {
+		flags.FileMode, err = common.ParseMode(s)
+		return
+	})
+	flag.BoolVar(&flags.HideSymlinks, "hide-symlinks", false, "hide the files holding symlinks from the web UI instead of showing them as regular files")
+	flag.IntVar(&flags.MetaCacheSize, "meta-cache-size", 10000, "entries kept per kind of cached API metadata, 0 for no limit")
+	flag.StringVar(&flags.ProxyURL, "proxy", "", "proxy url, http://, https:// or socks5://, with user:password@ if required")
+	flag.StringVar(&flags.CABundle, "ca-bundle", "", "PEM file of extra CA certificates to trust")
+	flag.DurationVar(&flags.DialTimeout, "dial-timeout", 30*time.Second, "timeout for establishing connections")
+	flag.DurationVar(&flags.TLSHandshakeTimeout, "tls-timeout", 10*time.Second, "timeout for TLS handshakes")
+	flag.DurationVar(&flags.HTTPTimeout, "http-timeout", time.Minute, "timeout waiting for response headers")
+	flag.IntVar(&flags.MaxIdleConns, "max-idle-conns", 100, "size of the idle connection pool")
+	flag.StringVar(&flags.UserAgent, "user-agent", "", "user agent sent with every request")
+	flag.BoolVar(&flags.HTTP2, "http2", false, "allow HTTP/2")
+	flag.Float64Var(&flags.APIRate, "api-rate", 10, "API requests per second, the prefetch crawler only uses what the mount leaves over; 0 for no limit")
+	flag.StringVar(&flags.RecordFile, "record", "", "record API traffic, with tokens redacted, to this cassette file")
+	flag.StringVar(&flags.ReplayFile, "replay", "", "answer API requests from this cassette file instead of the network")
+	flag.StringVar(&flags.FaultsFile, "faults", "", "JSON file of fault injection rules, for testing only")
 	flag.Parse()
 	if *version {
 		fmt.Println(Version)
 		return
 	}
-	rtoken := *refreshToken
-	if len(*refreshToken) == 0 {
-		rt, ok := ioutil.ReadFile(".refresh_token")
-		if ok != nil {
-			fmt.Println("Refresh token required,use touch .refresh_token;echo YOUR_REFRESH_TOKE > .refresh_token")
+	if len(*configFile) != 0 {
+		if err := common.ApplyConfigFile(*configFile, flag.CommandLine); err != nil {
+			fmt.Println("Failed to load config", err)
 			return
 		}
-		rtoken = string(rt)
-	} else {
-		rtoken = *refreshToken
+		// parse again so explicit flags override the config file
+		_ = flag.CommandLine.Parse(os.Args[1:])
 	}
-
-	rr := aliyun.RefreshToken(rtoken)
-	if reflect.DeepEqual(rr, model.RefreshTokenModel{}) {
-		fmt.Println("Invalid Refresh Token")
+	transport, err := common.NewHTTPTransport(flags)
+	if err != nil {
+		fmt.Println("Invalid HTTP settings", err)
 		return
 	}
-	err := ioutil.WriteFile(".refresh_token", []byte(rr.RefreshToken), 0600)
-	if err != nil {
-		fmt.Println("Can't write token file, token will not be able to persist")
+	var rt http.RoundTripper = transport
+	if len(flags.FaultsFile) != 0 {
+		rules, err := net.LoadFaultRules(flags.FaultsFile)
+		if err != nil {
+			fmt.Println("Failed to load fault rules", err)
+			return
+		}
+		rt = net.NewFaultInjector(transport, rules...)
 	}
-	config := &model.Config{
-		DriveId:      rr.DefaultDriveId,
-		Token:        rr.AccessToken,
-		RefreshToken: rr.RefreshToken,
-		ExpireTime:   time.Now().Unix() + rr.ExpiresIn,
+	if len(flags.ReplayFile) != 0 {
+		replayer, err := net.LoadReplayer(flags.ReplayFile)
+		if err != nil {
+			fmt.Println("Failed to load cassette", err)
+			return
+		}
+		rt = replayer
+	} else if len(flags.RecordFile) != 0 {
+		recorder, err := net.NewRecorder(rt, flags.RecordFile)
+		if err != nil {
+			fmt.Println("Failed to create cassette", err)
+			return
+		}
+		defer recorder.Close()
+		rt = recorder
 	}
-	afs, _ := fs.NewAliYunDriveFsServer(*config)
-	cache.Init()
+	net.Configure(rt, flags.UserAgent)
+	net.SetRateLimit(flags.APIRate)
+	var backend fs.Backend
+	if len(*localRoot) != 0 {
+		backend, err = fs.NewLocalBackend(*localRoot)
+	} else {
+		var db *fs.MetaDB
+		if len(flags.MetaDBFile) != 0 {
+			db, err = fs.OpenMetaDB(flags.MetaDBFile)
+			if err != nil {
+				fmt.Println("Can't open metadata db, every start lists the drive again", err)
+				db = nil
+			} else {
+				defer db.Close()
+			}
+		}
+		backend, err = newAliyunBackend(flags, db, *refreshToken, *apiBase, *apiEndpoints)
+		if pb, ok := backend.(*fs.PersistentBackend); ok {
+			// runs before db.Close, once the background refreshes are done
+			defer pb.Close()
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	afs, _ := fs.NewAliYunDriveFsServer(backend, flags)
 	mountConfig := &fuse.MountConfig{FSName: "AliYunDrive",
 		ReadOnly:           false,
 		VolumeName:         "AliYunDrive",
 		EnableVnodeCaching: false,
+		// default_permissions is always on, the kernel checks the
+		// stored modes
+		Options: kernelMountOptions(flags),
 		//ErrorLogger:        log.New(os.Stderr, "FuseError: ", log.LstdFlags),
 		//DebugLogger:        log.New(os.Stdout, "FuseDebug: ", log.LstdFlags),
 	}
@@ -162,6 +249,78 @@ func main() {
 
 }
 
+// kernelMountOptions returns the -o options handed to the mount command,
+// leaving out those the file system applies itself.
+func kernelMountOptions(flags *common.FlagStorage) map[string]string {
+	opts := make(map[string]string)
+	for name, value := range flags.MountOptions {
+		switch name {
+		case "uid", "gid", "umask":
+		default:
+			opts[name] = value
+		}
+	}
+	return opts
+}
+
+// newAliyunBackend logs in with the refresh token given on the command line
+// or stored in .refresh_token. With a metadata db the listings are saved,
+// and a failed login still mounts the saved tree read-only.
+func newAliyunBackend(flags *common.FlagStorage, db *fs.MetaDB, refreshToken string, apiBase string, apiEndpoints string) (fs.Backend, error) {
+	endpoints, err := model.ResolveEndpoints(apiBase, apiEndpoints)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid API endpoints %v", err)
+	}
+	client := aliyun.NewClient(endpoints)
+	client.Replaying = len(flags.ReplayFile) != 0
+	client.Cache = cache.New(cache.Options{
+		ListTTL:    flags.ListCacheTTL,
+		FileTTL:    flags.FileCacheTTL,
+		PathTTL:    flags.FileCacheTTL,
+		SearchTTL:  flags.SearchCacheTTL,
+		MaxEntries: flags.MetaCacheSize,
+	})
+	newBackend := func(config model.Config) *fs.AliyunBackend {
+		b := fs.NewAliyunBackend(client, config)
+		b.Permanent = flags.PermanentDelete
+		return b
+	}
+	rtoken := refreshToken
+	if len(refreshToken) == 0 {
+		rt, ok := ioutil.ReadFile(".refresh_token")
+		if ok != nil {
+			return nil, errors.New("Refresh token required,use touch .refresh_token;echo YOUR_REFRESH_TOKE > .refresh_token")
+		}
+		rtoken = string(rt)
+	} else {
+		rtoken = refreshToken
+	}
+
+	rr := client.RefreshToken(context.Background(), rtoken)
+	if reflect.DeepEqual(rr, model.RefreshTokenModel{}) {
+		if db != nil && len(fs.LastDriveId(db)) != 0 {
+			fmt.Println("Can't refresh token, mounting the saved metadata read-only until the drive is reachable")
+			config := model.Config{DriveId: fs.LastDriveId(db), RefreshToken: rtoken}
+			return fs.NewPersistentBackend(newBackend(config), db, config.DriveId, true), nil
+		}
+		return nil, errors.New("Invalid Refresh Token")
+	}
+	err = client.SaveRefreshToken(".refresh_token", rr.RefreshToken)
+	if err != nil {
+		fmt.Println("Can't write token file, token will not be able to persist")
+	}
+	config := &model.Config{
+		DriveId:      rr.DefaultDriveId,
+		Token:        rr.AccessToken,
+		RefreshToken: rr.RefreshToken,
+		ExpireTime:   time.Now().Unix() + rr.ExpiresIn,
+	}
+	if db != nil {
+		return fs.NewPersistentBackend(newBackend(*config), db, config.DriveId, false), nil
+	}
+	return newBackend(*config), nil
+}
+
 //func main() {
 //	out, _ := os.OpenFile("./goaldfuse.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 //	err, _ := os.OpenFile("./goaldfuse_err.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
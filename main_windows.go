@@ -4,16 +4,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/topcheer/daemon"
 	"goaldfuse/aliyun"
-	"goaldfuse/aliyun/cache"
 	"goaldfuse/aliyun/model"
+	"goaldfuse/aliyun/net"
+	"goaldfuse/common"
 	"goaldfuse/fs_windows"
 	"goaldfuse/utils"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"reflect"
 	"runtime"
@@ -22,6 +25,11 @@ import (
 
 var Version = "v1.2.0"
 
+// httpFlags holds the HTTP settings and the other FlagStorage ones bound to
+// the command line flags
+var httpFlags common.FlagStorage
+var apiBase, apiEndpoints string
+
 type FsHost struct {
 	//host *fuse.FileSystemHost
 	command *cobra.Command
@@ -53,6 +61,37 @@ func (f FsHost) Start() {
 	if err != nil {
 		vm = "阿里云盘"
 	}
+	transport, err := common.NewHTTPTransport(&httpFlags)
+	if err != nil {
+		fmt.Println("Invalid HTTP settings", err)
+		return
+	}
+	var roundTripper http.RoundTripper = transport
+	if len(httpFlags.FaultsFile) != 0 {
+		rules, err := net.LoadFaultRules(httpFlags.FaultsFile)
+		if err != nil {
+			fmt.Println("Failed to load fault rules", err)
+			return
+		}
+		roundTripper = net.NewFaultInjector(transport, rules...)
+	}
+	if len(httpFlags.ReplayFile) != 0 {
+		replayer, err := net.LoadReplayer(httpFlags.ReplayFile)
+		if err != nil {
+			fmt.Println("Failed to load cassette", err)
+			return
+		}
+		roundTripper = replayer
+	} else if len(httpFlags.RecordFile) != 0 {
+		recorder, err := net.NewRecorder(roundTripper, httpFlags.RecordFile)
+		if err != nil {
+			fmt.Println("Failed to create cassette", err)
+			return
+		}
+		defer recorder.Close()
+		roundTripper = recorder
+	}
+	net.Configure(roundTripper, httpFlags.UserAgent)
 	MountMe(rt, mp, vm)
 
 }
@@ -77,12 +116,19 @@ func MountMe(rt string, mp string, volname string) {
 		rt = string(rt1)
 	}
 
-	rr := aliyun.RefreshToken(rt)
+	endpoints, err := model.ResolveEndpoints(apiBase, apiEndpoints)
+	if err != nil {
+		fmt.Println("Invalid API endpoints", err)
+		return
+	}
+	client := aliyun.NewClient(endpoints)
+	client.Replaying = len(httpFlags.ReplayFile) != 0
+	rr := client.RefreshToken(context.Background(), rt)
 	if reflect.DeepEqual(rr, model.RefreshTokenModel{}) {
 		fmt.Println("Invalid Refresh Token")
 		return
 	}
-	err := ioutil.WriteFile(".refresh_token", []byte(rr.RefreshToken), 0600)
+	err = client.SaveRefreshToken(".refresh_token", rr.RefreshToken)
 	if err != nil {
 		fmt.Println("Can't write token file, token will not be able to persist")
 	}
@@ -94,8 +140,7 @@ func MountMe(rt string, mp string, volname string) {
 	}
 	utils.AccessToken = rr.AccessToken
 	utils.DriveId = rr.DefaultDriveId
-	cache.Init()
-	afs := fs_windows.NewAliYunDriveFSHost(*config)
+	afs := fs_windows.NewAliYunDriveFSHost(client, *config, httpFlags.HideSymlinks)
 
 	utils.VerboseLog = true
 	if runtime.GOOS == "windows" && len(mp) == 0 {
@@ -127,6 +172,7 @@ func main() {
 	var refreshToken string
 	var _mp string
 	var volname string
+	var configFile string
 	//var version *bool
 	command := daemon.GetCommand()
 	command.TraverseChildren = true
@@ -134,12 +180,35 @@ func main() {
 	command.PersistentFlags().StringVarP(&refreshToken, "refresh-token", "r", "", "refresh_token")
 	command.PersistentFlags().StringVarP(&_mp, "mount-point", "m", "G:", "mount-point，use any available drive")
 	command.PersistentFlags().StringVarP(&volname, "volume-name", "v", "阿里云盘", "volume-name，default to 阿里云盘")
+	command.PersistentFlags().StringVar(&configFile, "config", "", "JSON file of flag values, flags given on the command line take precedence")
+	command.PersistentFlags().StringVar(&apiBase, "api-base", os.Getenv("ALIYUNDRIVE_API_BASE"), "API base url, e.g. a mock server or reverse proxy (env ALIYUNDRIVE_API_BASE)")
+	command.PersistentFlags().StringVar(&apiEndpoints, "api-endpoints", os.Getenv("ALIYUNDRIVE_API_ENDPOINTS"), "JSON file overriding individual API paths (env ALIYUNDRIVE_API_ENDPOINTS)")
+	command.PersistentFlags().StringVar(&httpFlags.ProxyURL, "proxy", "", "proxy url, http://, https:// or socks5://, with user:password@ if required")
+	command.PersistentFlags().StringVar(&httpFlags.CABundle, "ca-bundle", "", "PEM file of extra CA certificates to trust")
+	command.PersistentFlags().DurationVar(&httpFlags.DialTimeout, "dial-timeout", 30*time.Second, "timeout for establishing connections")
+	command.PersistentFlags().DurationVar(&httpFlags.TLSHandshakeTimeout, "tls-timeout", 10*time.Second, "timeout for TLS handshakes")
+	command.PersistentFlags().DurationVar(&httpFlags.HTTPTimeout, "http-timeout", time.Minute, "timeout waiting for response headers")
+	command.PersistentFlags().IntVar(&httpFlags.MaxIdleConns, "max-idle-conns", 100, "size of the idle connection pool")
+	command.PersistentFlags().StringVar(&httpFlags.UserAgent, "user-agent", "", "user agent sent with every request")
+	command.PersistentFlags().BoolVar(&httpFlags.HTTP2, "http2", false, "allow HTTP/2")
+	command.PersistentFlags().BoolVar(&httpFlags.HideSymlinks, "hide-symlinks", false, "hide the files holding symlinks from the web UI instead of showing them as regular files")
+	command.PersistentFlags().StringVar(&httpFlags.RecordFile, "record", "", "record API traffic, with tokens redacted, to this cassette file")
+	command.PersistentFlags().StringVar(&httpFlags.ReplayFile, "replay", "", "answer API requests from this cassette file instead of the network")
+	command.PersistentFlags().StringVar(&httpFlags.FaultsFile, "faults", "", "JSON file of fault injection rules, for testing only")
 
 	host := &FsHost{command: command}
 	errp := command.ParseFlags(os.Args)
 	if errp != nil {
 		return
 	}
+	if len(configFile) != 0 {
+		if err := common.ApplyConfigFile(configFile, command.PersistentFlags()); err != nil {
+			fmt.Println("Failed to load config", err)
+			return
+		}
+		// parse again so explicit flags override the config file
+		_ = command.ParseFlags(os.Args)
+	}
 	vn, _ := command.PersistentFlags().GetString("volume-name")
 	out, _ := os.OpenFile("./goaldfuse"+vn+".log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	err, _ := os.OpenFile("./goaldfuse_err"+vn+".log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)